@@ -1,3 +1,15 @@
+-- Organizations known to the service. The assistant uses these to tailor its instruction
+-- to each customer (see internal/service/orgs.go). Rows are added by the fixtures.
+CREATE TABLE organizations (
+    id UUID PRIMARY KEY,
+    name TEXT NOT NULL,
+    -- Suffix of the org's asset partition and query role, e.g. assets_org_111111111111.
+    partition_hash TEXT NOT NULL UNIQUE,
+    -- Optional details: {"industry": "...", "timezone": "America/New_York",
+    -- "features": ["..."]}
+    settings JSONB NOT NULL DEFAULT '{}'
+);
+
 -- Contains a copy of all asset data.
 CREATE TABLE assets (
     -- Asset ID
@@ -0,0 +1,54 @@
+-- Conversation history for /ask sessions. Bedrock only keeps a session for 15 minutes
+-- of inactivity (and the other backends only keep it in memory), so the service keeps
+-- its own copy of each turn to restore context when a user comes back later.
+
+-- Who each session belongs to. Session IDs are unique across orgs, so a session ID from
+-- one org can't be claimed by another.
+CREATE TABLE sessions (
+    session_id TEXT PRIMARY KEY,
+    org_id UUID NOT NULL,
+    -- Subject ("sub" claim) of the token that started the session. Sessions of requests
+    -- without one aren't stored.
+    subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE session_turns (
+    org_id UUID NOT NULL,
+    -- Session ID as given to or generated by /ask.
+    session_id TEXT NOT NULL,
+    -- 1-based position of the turn in the session.
+    turn INT NOT NULL,
+    question TEXT NOT NULL,
+    answer TEXT NOT NULL,
+    -- Formatted references ("Title - URL") shown with the answer.
+    refs JSONB NOT NULL DEFAULT '[]',
+    -- Functions the agent called while answering (bricks.ToolCall).
+    tool_calls JSONB NOT NULL DEFAULT '[]',
+    -- IDs of the assets referenced in the answer.
+    asset_ids JSONB NOT NULL DEFAULT '[]',
+    -- Input tokens of the request's largest model call, roughly how much context the
+    -- session had. Compaction is based on it.
+    context_tokens INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (org_id, session_id, turn)
+);
+
+-- The running digest of a compacted session. Once a session's context grows past the
+-- compaction threshold, its older turns are summarized here and the agent continues in a
+-- new backend session that starts from the digest instead of the full history.
+CREATE TABLE session_digests (
+    org_id UUID NOT NULL,
+    session_id TEXT NOT NULL,
+    -- The summary covers turns 1 through this one.
+    through_turn INT NOT NULL,
+    -- The last turn before the current backend session started.
+    resumed_after_turn INT NOT NULL,
+    -- How many times the session was compacted.
+    compactions INT NOT NULL,
+    summary TEXT NOT NULL,
+    -- Asset IDs the user was working on, kept verbatim across compactions.
+    pinned_asset_ids JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (org_id, session_id)
+);
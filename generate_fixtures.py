@@ -13,7 +13,7 @@ orgs = [
     "55555555-5555-5555-5555-555555555555",
 ]
 
-# Names for those organizations (not used currently).
+# Names for those organizations, written to the organizations table.
 org_names = {
     "11111111-1111-1111-1111-111111111111": "Alpha Corp",
     "22222222-2222-2222-2222-222222222222": "Beta LLC",
@@ -22,6 +22,15 @@ org_names = {
     "55555555-5555-5555-5555-555555555555": "Epsilon GmbH",
 }
 
+# Settings for the organizations table, used to tailor the agent instruction per org.
+org_settings = {
+    "11111111-1111-1111-1111-111111111111": {"industry": "Financial services", "timezone": "America/New_York", "features": ["attack_surface_management", "continuous_pentesting", "emerging_threats"]},
+    "22222222-2222-2222-2222-222222222222": {"industry": "Healthcare", "timezone": "America/Chicago", "features": ["attack_surface_management"]},
+    "33333333-3333-3333-3333-333333333333": {"industry": "Retail", "timezone": "America/Los_Angeles", "features": ["attack_surface_management", "emerging_threats"]},
+    "44444444-4444-4444-4444-444444444444": {"industry": "Manufacturing", "timezone": "Europe/London", "features": ["attack_surface_management", "continuous_pentesting"]},
+    "55555555-5555-5555-5555-555555555555": {"industry": "Energy", "timezone": "Europe/Berlin", "features": ["attack_surface_management", "continuous_pentesting", "emerging_threats"]},
+}
+
 def generate_name():
 
     adjectives_opinion = ["awesome", "terrible", "fantastic", "mediocre", "excellent", "poor", "great", "bad", "superb", "awful"]
@@ -281,6 +290,15 @@ for org in orgs:
 # Output to the fixtures SQL file which is loaded during docker compose startup. The
 # config folder is a Postgres init folder.
 with open("config/2.fixtures.sql", "w") as f:
+    f.write("-- generated organizations --\n")
+    f.write("INSERT INTO organizations (id, name, partition_hash, settings) VALUES\n")
+    # The partition hash is the last 12 characters of the org ID, like getOrgHash in
+    # internal/service/assets.go.
+    f.write(",\n".join(
+        f"    ('{org}', '{org_names[org]}', '{org[-12:]}', '{json.dumps(org_settings[org])}')"
+        for org in orgs
+    ) + ";\n\n")
+
     f.write("-- generated assets --\n")
 
     std_keys = {"id", "parent_id", "parent_type", "tags"}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -118,6 +119,13 @@ func QueryAssetsFunction(c bricks.FunctionContext) (any, error) {
 		return nil, fmt.Errorf("db query failed; %w", err)
 	}
 
+	// The query and the assets it found are returned with the answer as references, so
+	// clients can show what the answer is based on.
+	c.AddReference(service.QueryRef{SQL: req.Query, Rows: len(result.Rows), Truncated: result.Truncated}.Reference())
+	for _, asset := range result.AssetRefs() {
+		c.AddReference(asset.Reference())
+	}
+
 	// Format the results when the AI is querying the asset database. We've seen
 	// decent results with this "CSV" type of output. While we could benefit from
 	// formatting certain fields in certain ways, we can't depend on any field names,
@@ -285,6 +293,7 @@ func GetAssetsOverviewLinkFunction(c bricks.FunctionContext) (any, error) {
 
 	fullURL, _ := url.Parse(baseUrl)
 	fullURL.RawQuery = params.Encode()
+	c.AddReference(service.OverviewLinkRef{AssetType: req.AssetType, URL: fullURL.String()}.Reference())
 	return fullURL.String(), nil
 }
 
@@ -292,6 +301,31 @@ func GetAssetsOverviewLinkFunction(c bricks.FunctionContext) (any, error) {
 // returns a list of emerging_threat data for testing against.
 type GetLatestEmergingThreatsRequest struct{}
 
+// Matches the id, cve and title fields of a <threat> block.
+var threatFieldPattern = regexp.MustCompile(`(?m)^(id|cve|title): (.*)$`)
+
+// Reference each threat in get_latest_emerging_threats output.
+func emergingThreatRefs(threats string) []service.EmergingThreatRef {
+	var refs []service.EmergingThreatRef
+	for _, block := range strings.Split(threats, "<threat>")[1:] {
+		var ref service.EmergingThreatRef
+		for _, field := range threatFieldPattern.FindAllStringSubmatch(block, -1) {
+			switch field[1] {
+			case "id":
+				ref.ID = field[2]
+			case "cve":
+				ref.CVE = field[2]
+			case "title":
+				ref.Title = field[2]
+			}
+		}
+		if ref.ID != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
 func GetLatestEmergingThreatsFunction(c bricks.FunctionContext) (any, error) {
 	// For demonstration purposes, returning a static list of threats.
 	//
@@ -312,7 +346,7 @@ func GetLatestEmergingThreatsFunction(c bricks.FunctionContext) (any, error) {
 	// want to truncate the field. In the example below, we mark one such truncated field
 	// with natural language "(truncated list...)".
 
-	return `Here is information about the 5 latest emerging threats:
+	threats := `Here is information about the 5 latest emerging threats:
 <threat>
 cpe: n/a
 cve: CVE-2025-59118
@@ -378,7 +412,46 @@ technology: F5
 tier: 3
 title: F5 Review and Response
 </threat>
-`, nil
+`
+	for _, ref := range emergingThreatRefs(threats) {
+		c.AddReference(ref.Reference())
+	}
+	return threats, nil
+}
+
+// Input for search_documentation. The query is matched by keywords, so a question works
+// as well as a list of terms.
+type SearchDocumentationRequest struct {
+	Query string `json:"query" desc:"What to look for, e.g. set up the Azure connector" required:"true"`
+}
+
+// Handler for search_documentation. The Bedrock agents can also search the documentation
+// through the knowledgebase, but MCP clients only see these functions, so this makes the
+// same documentation available to them.
+func SearchDocumentationFunction(c bricks.FunctionContext) (any, error) {
+	var req SearchDocumentationRequest
+	c.MustBind(&req)
+	qc := service.MustGetQueryContext(c)
+
+	results, err := qc.Service.SearchDocumentation(c, qc.OrgID, req.Query)
+	if errors.Is(err, service.ErrDocsUnavailable) {
+		return "Documentation search is not available right now.", nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return "No documentation found for the query.", nil
+	}
+
+	// Each section is wrapped with its title and link, so the model can cite it the same
+	// way as a knowledgebase reference.
+	var sections []string
+	for _, result := range results {
+		sections = append(sections, fmt.Sprintf("<section title=%q url=%q>\n%s\n</section>",
+			result.Title, result.URL, result.Text))
+		c.AddReference(result.Source.Reference())
+	}
+	return strings.Join(sections, "\n"), nil
 }
 
 //go:embed prompt/query_assets_desc.txt
@@ -393,6 +466,9 @@ var getAssetsOverviewLinkDesc string
 //go:embed prompt/get_latest_emerging_threats_desc.txt
 var getLatestEmergingThreatsDesc string
 
+//go:embed prompt/search_documentation_desc.txt
+var searchDocumentationDesc string
+
 // This is just like routing in an API.
 func GetFunctions(svc Service) *bricks.FunctionSet {
 	fs := bricks.NewFunctionSet("bishopfox")
@@ -402,5 +478,10 @@ func GetFunctions(svc Service) *bricks.FunctionSet {
 		GetAssetsOverviewLinkRequest{}, GetAssetsOverviewLinkFunction)
 	fs.AddFunction("get_latest_emerging_threats", getLatestEmergingThreatsDesc, "",
 		GetLatestEmergingThreatsRequest{}, GetLatestEmergingThreatsFunction)
+	fs.AddFunction("search_documentation", searchDocumentationDesc, "",
+		SearchDocumentationRequest{}, SearchDocumentationFunction)
+
+	// Applies to the /ask agents and to MCP tool calls alike.
+	fs.Use(bricks.LogFunctionCalls)
 	return fs
 }
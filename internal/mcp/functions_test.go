@@ -24,11 +24,25 @@ func (m *MockService) QueryAssets(ctx context.Context, orgID uuid.UUID, query st
 	}, nil
 }
 
-func (m *MockService) Ask(ctx context.Context, query string, orgID uuid.UUID, authorization string, sessionID string) (service.AskResult, error) {
+func (m *MockService) Ask(ctx context.Context, query string, orgID uuid.UUID, authorization string, sessionID string, opts service.AskOptions) (service.AskResult, error) {
 	return service.AskResult{}, nil
 }
 
-func (m *MockService) SetFunctions(fs *bricks.FunctionSet) {}
+func (m *MockService) SetFunctions(fs *bricks.FunctionSet) error { return nil }
+
+func (m *MockService) SearchDocumentation(ctx context.Context, orgID uuid.UUID, query string) ([]service.DocumentationResult, error) {
+	return []service.DocumentationResult{
+		{Title: "Setup", URL: "https://example.com/" + orgID.String() + "#setup", Text: "# Setup\n" + query},
+	}, nil
+}
+
+func (m *MockService) DebugPrompt(ctx context.Context, query string, orgID uuid.UUID, profile string) (service.PromptDebug, error) {
+	return service.PromptDebug{}, nil
+}
+
+func (m *MockService) GetSession(ctx context.Context, orgID uuid.UUID, authorization string, sessionID string) (service.SessionInfo, error) {
+	return service.SessionInfo{}, nil
+}
 
 func toJSON(data any) []byte {
 	b, _ := json.Marshal(data)
@@ -75,3 +89,31 @@ func TestQueryAssetsFunction(t *testing.T) {
 	//
 	// These help to guide the model.
 }
+
+func TestFunctionsFitBedrockLimits(t *testing.T) {
+	// Descriptions are easy to grow past the Bedrock limits while tuning prompts.
+	if _, err := mcp.GetFunctions(&MockService{}).GetActionGroups(); err != nil {
+		t.Errorf("functions break the Bedrock limits: %v", err)
+	}
+}
+
+func TestSearchDocumentationFunction(t *testing.T) {
+	svc := &MockService{}
+	orgID := uuid.MustParse("11111111-1111-1111-1111-111111111111")
+
+	result, err := mcp.GetFunctions(svc).Invoke(
+		service.WrapContextForTool(context.Background(), orgID, "test-auth", svc),
+		"search_documentation",
+		toJSON(mcp.SearchDocumentationRequest{Query: "azure connector"}),
+	)
+	if err != nil {
+		t.Fatalf("Function invocation failed: %v", err)
+	}
+
+	// [SPEC] Each section is wrapped with its title and link for citations.
+	expected := "<section title=\"Setup\" url=\"https://example.com/11111111-1111-1111-1111-111111111111#setup\">\n" +
+		"# Setup\nazure connector\n</section>"
+	if result != expected {
+		t.Errorf("Expected result %q, got %q", expected, result)
+	}
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+// Agent backends that Ask can use. Selected with the AGENT_BACKEND environment variable.
+const (
+	// Bedrock inline agents (default).
+	AgentBackendBedrock = "bedrock"
+	// Anthropic Messages API.
+	AgentBackendAnthropic = "anthropic"
+	// OpenAI-compatible chat completions, e.g., a self-hosted vLLM, Ollama or llama.cpp
+	// server.
+	AgentBackendOpenAI = "openai"
+	// Bedrock Runtime Converse API. Uses the same models and knowledgebase as the
+	// bedrock backend, for comparing the two side by side.
+	AgentBackendConverse = "converse"
+)
+
+// Claude 3.7 is deprecated, but using an old/cheaper model to see how robust it is.
+const defaultBedrockModel = "us.anthropic.claude-3-7-sonnet-20250219-v1:0"
+
+const defaultAnthropicModel = "claude-sonnet-4-5"
+
+// Our knowledgebase. To see how this knowledgebase is built, see the knowledgebase
+// folder. We also have a video on it.
+const cosmosKnowledgebaseID = "CETGU0P5D7"
+const cosmosKnowledgebaseDesc = "Contains documentation on the Cosmos platform, helpful for resolving user queries about platform functionality"
+
+// Configuration for the agent backend used by Ask.
+//
+//   - AGENT_BACKEND: One of [bedrock, converse, anthropic, openai]. Defaults to bedrock.
+//   - AGENT_MODEL: Model ID for the backend. Bedrock, Converse and Anthropic have
+//     defaults, the OpenAI-compatible backend requires it.
+//   - AGENT_BASE_URL: Base URL for the Anthropic or OpenAI-compatible API. Required for
+//     the OpenAI-compatible backend, e.g., http://localhost:11434/v1.
+//   - AGENT_API_KEY: API key for the Anthropic or OpenAI-compatible API. Required for
+//     Anthropic.
+//   - AGENT_TOOL_TOP_K: How many of the most relevant tools to give the agent for each
+//     question. Defaults to 5. 0 gives it every tool.
+//   - AGENT_GUARDRAIL_ID, AGENT_GUARDRAIL_VERSION: Bedrock Guardrail to apply. Only
+//     supported by the bedrock backend.
+//   - AGENT_FALLBACK_MODELS: Comma-separated model IDs to try in order when the model is
+//     throttled or unavailable. Only supported by the bedrock backend.
+type AgentBackendConfig struct {
+	Backend          string
+	Model            string
+	FallbackModels   []string
+	BaseURL          string
+	APIKey           string
+	ToolTopK         int
+	GuardrailID      string
+	GuardrailVersion string
+}
+
+const defaultToolTopK = 5
+
+// Load the agent backend configuration from the environment and check that the required
+// values for the selected backend are present.
+func agentBackendConfigFromEnv() (AgentBackendConfig, error) {
+	cfg := AgentBackendConfig{
+		Backend: os.Getenv("AGENT_BACKEND"),
+		Model:   os.Getenv("AGENT_MODEL"),
+		BaseURL: os.Getenv("AGENT_BASE_URL"),
+		APIKey:  os.Getenv("AGENT_API_KEY"),
+
+		GuardrailID:      os.Getenv("AGENT_GUARDRAIL_ID"),
+		GuardrailVersion: os.Getenv("AGENT_GUARDRAIL_VERSION"),
+	}
+	for _, model := range strings.Split(os.Getenv("AGENT_FALLBACK_MODELS"), ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			cfg.FallbackModels = append(cfg.FallbackModels, model)
+		}
+	}
+	if (cfg.GuardrailID == "") != (cfg.GuardrailVersion == "") {
+		return cfg, fmt.Errorf("%w; AGENT_GUARDRAIL_ID and AGENT_GUARDRAIL_VERSION must be set together", ErrSelfCheckFailed)
+	}
+
+	cfg.ToolTopK = defaultToolTopK
+	if topK := os.Getenv("AGENT_TOOL_TOP_K"); topK != "" {
+		n, err := strconv.Atoi(topK)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("%w; AGENT_TOOL_TOP_K must be a non-negative integer", ErrSelfCheckFailed)
+		}
+		cfg.ToolTopK = n
+	}
+
+	switch cfg.Backend {
+	case "", AgentBackendBedrock, AgentBackendConverse:
+		if cfg.Backend == "" {
+			cfg.Backend = AgentBackendBedrock
+		}
+		if cfg.Model == "" {
+			cfg.Model = defaultBedrockModel
+		}
+	case AgentBackendAnthropic:
+		if cfg.Model == "" {
+			cfg.Model = defaultAnthropicModel
+		}
+		if cfg.APIKey == "" {
+			return cfg, fmt.Errorf("%w; AGENT_API_KEY is required for the anthropic backend", ErrSelfCheckFailed)
+		}
+	case AgentBackendOpenAI:
+		if cfg.BaseURL == "" || cfg.Model == "" {
+			return cfg, fmt.Errorf("%w; AGENT_BASE_URL and AGENT_MODEL are required for the openai backend", ErrSelfCheckFailed)
+		}
+	default:
+		return cfg, fmt.Errorf("%w; unknown AGENT_BACKEND %q", ErrSelfCheckFailed, cfg.Backend)
+	}
+	if cfg.GuardrailID != "" && cfg.Backend != AgentBackendBedrock {
+		return cfg, fmt.Errorf("%w; guardrails are only supported by the bedrock backend", ErrSelfCheckFailed)
+	}
+	if len(cfg.FallbackModels) > 0 && cfg.Backend != AgentBackendBedrock {
+		return cfg, fmt.Errorf("%w; fallback models are only supported by the bedrock backend", ErrSelfCheckFailed)
+	}
+
+	return cfg, nil
+}
+
+// Returns true if the backend needs extended function descriptions in the system prompt.
+// Bedrock has a limit on action description length, so the extended descriptions go into
+// <toolInstructions> blocks instead. The other backends take the full description in the
+// tool definition.
+func (c AgentBackendConfig) needsToolInstructions() bool {
+	return c.Backend == AgentBackendBedrock
+}
+
+// Create the agent for a single Ask request with the configured backend and the
+// request's profile.
+func (s *MainService) newAgent(profile resolvedProfile, instruction string, fs *bricks.FunctionSet) (bricks.Agent, error) {
+	cfg := s.agentConfig
+	switch cfg.Backend {
+	case AgentBackendAnthropic:
+		return bricks.NewAnthropicAgent(bricks.AnthropicAgentConfig{
+			APIKey:      cfg.APIKey,
+			BaseURL:     cfg.BaseURL,
+			Model:       profile.Model,
+			Instruction: instruction,
+			Functions:   fs,
+			History:     s.anthropicHistory,
+
+			MaxToolRounds: profile.MaxToolRounds,
+			MaxToolCalls:  profile.MaxToolCalls,
+			MaxDuration:   profile.maxDuration(),
+		}), nil
+	case AgentBackendConverse:
+		var knowledgebases []bricks.ConverseKnowledgebase
+		for _, kb := range profile.Knowledgebases {
+			knowledgebases = append(knowledgebases, bricks.ConverseKnowledgebase{
+				ID:          kb.ID,
+				Description: kb.Description,
+			})
+		}
+		return bricks.NewConverseAgent(bricks.ConverseAgentConfig{
+			Model:          profile.Model,
+			Instruction:    instruction,
+			Functions:      fs,
+			Knowledgebases: knowledgebases,
+			History:        s.converseHistory,
+
+			MaxToolRounds: profile.MaxToolRounds,
+			MaxToolCalls:  profile.MaxToolCalls,
+			MaxDuration:   profile.maxDuration(),
+		}), nil
+	case AgentBackendOpenAI:
+		return bricks.NewOpenAICompatAgent(bricks.OpenAICompatAgentConfig{
+			APIKey:      cfg.APIKey,
+			BaseURL:     cfg.BaseURL,
+			Model:       profile.Model,
+			Instruction: instruction,
+			Functions:   fs,
+			History:     s.openAIHistory,
+
+			MaxToolRounds: profile.MaxToolRounds,
+			MaxToolCalls:  profile.MaxToolCalls,
+			MaxDuration:   profile.maxDuration(),
+		}), nil
+	default:
+		// Link to the profile's knowledgebases, by default ours.
+		var knowledgebases []types.KnowledgeBase
+		for _, kb := range profile.Knowledgebases {
+			knowledgebases = append(knowledgebases, types.KnowledgeBase{
+				Description:     aws.String(kb.Description),
+				KnowledgeBaseId: aws.String(kb.ID),
+			})
+		}
+		return bricks.NewBedrockAgent(bricks.BedrockAgentConfig{
+			Model:          profile.Model,
+			FallbackModels: profile.FallbackModels,
+			Instruction:    instruction,
+			AgentName:      profile.AgentName,
+			Functions:      []*bricks.FunctionSet{fs},
+			Knowledgebases: knowledgebases,
+
+			GuardrailID:      cfg.GuardrailID,
+			GuardrailVersion: cfg.GuardrailVersion,
+
+			MaxToolRounds: profile.MaxToolRounds,
+			MaxToolCalls:  profile.MaxToolCalls,
+			MaxDuration:   profile.maxDuration(),
+		})
+	}
+}
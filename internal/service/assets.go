@@ -183,3 +183,45 @@ func (svc *MainService) QueryAssets(ctx context.Context, orgID uuid.UUID, query
 
 	return result, nil
 }
+
+// How many assets of a query are referenced. Queries can return hundreds of rows, and
+// listing each one would bury the other references.
+const maxAssetRefsPerQuery = 10
+
+// The assets in the result, for rows with an "id" column holding an asset ID. The "type"
+// and "link" columns are used if the query selected them. Queries that alias the columns
+// or select something else don't produce any. Only the first maxAssetRefsPerQuery assets
+// are returned.
+func (r QueryAssetsResult) AssetRefs() []AssetRef {
+	column := func(name string) int {
+		for i, c := range r.Columns {
+			if c == name {
+				return i
+			}
+		}
+		return -1
+	}
+	idCol, typeCol, linkCol := column("id"), column("type"), column("link")
+	if idCol < 0 {
+		return nil
+	}
+
+	var refs []AssetRef
+	for _, row := range r.Rows {
+		if len(refs) == maxAssetRefsPerQuery {
+			break
+		}
+		if _, err := uuid.Parse(row[idCol]); err != nil {
+			continue
+		}
+		ref := AssetRef{ID: row[idCol]}
+		if typeCol >= 0 {
+			ref.Type = row[typeCol]
+		}
+		if linkCol >= 0 {
+			ref.Link = row[linkCol]
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
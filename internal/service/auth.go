@@ -0,0 +1,36 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// Return the subject ("sub" claim) of the bearer token in an Authorization header, or an
+// empty string if there isn't one.
+//
+// The token's signature is NOT checked here, so the subject can only be trusted if the
+// token was already verified. Like the organization ID, it must be validated by the
+// routing middleware before the request reaches the service. Callers must treat an empty
+// subject as "no identity", never as a user of its own.
+func tokenSubject(authorization string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
@@ -0,0 +1,36 @@
+package service
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// A bearer token with the given payload. The signature isn't checked by tokenSubject.
+func bearerToken(payload string) string {
+	enc := base64.RawURLEncoding
+	return "Bearer " + enc.EncodeToString([]byte(`{"alg":"HS256"}`)) + "." +
+		enc.EncodeToString([]byte(payload)) + ".signature"
+}
+
+func TestTokenSubject(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{"subject", bearerToken(`{"sub":"user-1"}`), "user-1"},
+		{"no token", "", ""},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", ""},
+		{"malformed token", "Bearer not-a-jwt", ""},
+		{"bad payload encoding", "Bearer header.%%%.signature", ""},
+		{"payload isn't JSON", bearerToken(`sub=user-1`), ""},
+		{"no sub claim", bearerToken(`{"name":"User"}`), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenSubject(tt.authorization); got != tt.want {
+				t.Errorf("tokenSubject(%q) = %q, want %q", tt.authorization, got, tt.want)
+			}
+		})
+	}
+}
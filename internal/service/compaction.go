@@ -0,0 +1,286 @@
+package service
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Compaction keeps long sessions within the model's context. Once the input of a
+// request's largest model call passes the threshold (SESSION_COMPACTION_TOKENS), the
+// next request summarizes the older turns, with their tool results, into a running
+// digest. The agent then continues in a new backend session that starts from the digest
+// and the latest turns instead of the full history.
+
+// Compact once a model call of a request had this many input tokens. Set
+// SESSION_COMPACTION_TOKENS to override it; 0 disables compaction.
+const defaultCompactionTokens = 60000
+
+// How many of the latest turns are left out of the digest. They're sent as they are, so
+// the agent still has the details of what was just discussed.
+const keepRecentTurns = 2
+
+// At most this many asset IDs are pinned. The most recent ones are kept.
+const maxPinnedAssets = 20
+
+// Tool results are truncated to this many characters for the summarizer.
+const maxDigestResultLen = 1000
+
+//go:embed digest_instructions.txt
+var digestInstruction string
+
+// The running digest of a compacted session.
+type SessionDigest struct {
+	// The summary covers turns 1 through this one.
+	ThroughTurn int `json:"through_turn"`
+	// The current backend session started after this turn, so later turns are already
+	// in its history.
+	ResumedAfterTurn int `json:"resumed_after_turn"`
+	// How many times the session was compacted. 0 if it never was.
+	Compactions int    `json:"compactions"`
+	Summary     string `json:"summary"`
+	// The assets the user is working on: IDs from their questions and from the assets
+	// referenced in answers, most recent first. These are kept verbatim across
+	// compactions, since a summary could lose or garble them.
+	PinnedAssetIDs []string  `json:"pinned_asset_ids"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// The session ID given to the agent backend for the session's current digest. Each
+// compaction starts a new backend session.
+func (d SessionDigest) backendSessionID(agentSession string) string {
+	if d.Compactions == 0 {
+		return agentSession
+	}
+	return fmt.Sprintf("%s:%d", agentSession, d.Compactions)
+}
+
+// What GET /sessions/:id shows about a session.
+type SessionInfo struct {
+	SessionID string `json:"session_id"`
+	Turns     int    `json:"turns"`
+	// Input tokens of the largest model call of the latest request, roughly the size of
+	// the session's context.
+	ContextTokens int64 `json:"context_tokens"`
+	// The context size that triggers compaction. 0 if compaction is disabled.
+	CompactionThreshold int64 `json:"compaction_threshold"`
+	// Nil if the session hasn't been compacted.
+	Digest *SessionDigest `json:"digest"`
+}
+
+var uuidPattern = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+
+// The turns after the given turn number.
+func turnsAfter(turns []SessionTurn, turn int) []SessionTurn {
+	for i, t := range turns {
+		if t.Turn > turn {
+			return turns[i:]
+		}
+	}
+	return nil
+}
+
+// Returns true if the session's context has grown past the threshold since it was last
+// compacted, and there are turns old enough to go into the digest.
+func (s *MainService) needsCompaction(turns []SessionTurn, digest SessionDigest) bool {
+	if s.compactionTokens <= 0 || len(turns) == 0 {
+		return false
+	}
+	last := turns[len(turns)-1]
+	if last.Turn <= digest.ResumedAfterTurn || last.ContextTokens < s.compactionTokens {
+		return false
+	}
+	return len(turnsAfter(turns, digest.ThroughTurn)) > keepRecentTurns
+}
+
+// Fold the older turns into the session's digest and save it. The digest is written by
+// the agent's model, without tools; if that fails, a plain text digest is used instead
+// so the session is compacted either way.
+//
+// Returns the new digest and the usage of the summary.
+func (s *MainService) compactSession(ctx context.Context, orgID uuid.UUID, sessionID string,
+	profile resolvedProfile, turns []SessionTurn, digest SessionDigest) (SessionDigest, bricks.Usage, error) {
+
+	pending := turnsAfter(turns, digest.ThroughTurn)
+	older := pending[:len(pending)-keepRecentTurns]
+
+	summary, usage, err := s.summarizeForDigest(ctx, profile, digest.Summary, older)
+	if err != nil {
+		log.WithError(err).WithField("session", sessionID).Warn("digest summary failed; using a text digest")
+		summary = textDigest(digest.Summary, older)
+	}
+
+	next := SessionDigest{
+		ThroughTurn:      older[len(older)-1].Turn,
+		ResumedAfterTurn: turns[len(turns)-1].Turn,
+		Compactions:      digest.Compactions + 1,
+		Summary:          summary,
+		PinnedAssetIDs:   pinAssets(digest.PinnedAssetIDs, pending),
+		UpdatedAt:        time.Now(),
+	}
+	if err := s.sessions.SaveDigest(ctx, orgID, sessionID, next); err != nil {
+		return SessionDigest{}, usage, err
+	}
+
+	// The previous backend session isn't used anymore.
+	s.forgetAgentSession(digest.backendSessionID(agentSessionID(orgID, sessionID)))
+	log.WithFields(log.Fields{
+		"org":          orgID,
+		"session":      sessionID,
+		"through_turn": next.ThroughTurn,
+		"compactions":  next.Compactions,
+		"pinned":       len(next.PinnedAssetIDs),
+	}).Info("compacted session")
+	return next, usage, nil
+}
+
+// Ask the model for the new digest: the previous one with the turns added.
+func (s *MainService) summarizeForDigest(ctx context.Context, profile resolvedProfile,
+	previous string, turns []SessionTurn) (string, bricks.Usage, error) {
+
+	// A plain agent: no functions or knowledgebases, just the model.
+	profile.Knowledgebases = nil
+	agent, err := s.newAgent(profile, digestInstruction, bricks.NewFunctionSet("digest"))
+	if err != nil {
+		return "", bricks.Usage{}, fmt.Errorf("failed to create agent: %w", err)
+	}
+
+	var sb strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&sb, "<currentDigest>\n%s\n</currentDigest>\n", previous)
+	}
+	sb.WriteString("<turns>\n")
+	for _, turn := range turns {
+		fmt.Fprintf(&sb, "User: %s\n", turn.Question)
+		for _, call := range turn.ToolCalls {
+			fmt.Fprintf(&sb, "(called %s with %s, which returned: %s)\n",
+				call.Function, string(call.Params), truncateRunes(call.Result, maxDigestResultLen))
+		}
+		fmt.Fprintf(&sb, "Assistant: %s\n", strings.TrimSpace(turn.Answer))
+	}
+	sb.WriteString("</turns>")
+
+	// A throwaway session, so the summary doesn't end up in any conversation.
+	session := "digest:" + uuid.New().String()
+	defer s.forgetAgentSession(session)
+	result, err := agent.Query(ctx, sb.String(), session)
+	if err != nil {
+		return "", result.Usage, err
+	}
+	summary := strings.TrimSpace(result.Response)
+	if summary == "" {
+		return "", result.Usage, fmt.Errorf("empty digest summary")
+	}
+	return summary, result.Usage, nil
+}
+
+// A digest built from the stored text, for when the model can't write one.
+func textDigest(previous string, turns []SessionTurn) string {
+	var sb strings.Builder
+	if previous != "" {
+		sb.WriteString(previous)
+		sb.WriteString("\n")
+	}
+	for _, turn := range turns {
+		fmt.Fprintf(&sb, "- The user asked: %s\n  The assistant answered: %s\n", turn.Question, truncateAnswer(turn.Answer))
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// Add the asset IDs of the turns to the pinned ones. IDs in the user's questions come
+// before the assets in the answers, later turns before earlier ones, and the oldest are
+// dropped past maxPinnedAssets.
+func pinAssets(pinned []string, turns []SessionTurn) []string {
+	var ids []string
+	for i := len(turns) - 1; i >= 0; i-- {
+		ids = append(ids, uuidPattern.FindAllString(turns[i].Question, -1)...)
+		ids = append(ids, turns[i].AssetIDs...)
+	}
+	ids = append(ids, pinned...)
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, id := range ids {
+		id = strings.ToLower(id)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+		if len(out) == maxPinnedAssets {
+			break
+		}
+	}
+	return out
+}
+
+// The IDs of the asset references, for SessionTurn.AssetIDs.
+func referencedAssetIDs(refs []AskReference) []string {
+	var ids []string
+	for _, ref := range refs {
+		if ref.Asset != nil {
+			ids = append(ids, ref.Asset.ID)
+		}
+	}
+	return ids
+}
+
+// Drop the conversation history the service keeps for a backend session. Bedrock keeps
+// its sessions on the AWS side until they expire.
+func (s *MainService) forgetAgentSession(agentSession string) {
+	switch s.agentConfig.Backend {
+	case AgentBackendAnthropic:
+		s.anthropicHistory.Delete(agentSession)
+	case AgentBackendOpenAI:
+		s.openAIHistory.Delete(agentSession)
+	case AgentBackendConverse:
+		s.converseHistory.Delete(agentSession)
+	}
+}
+
+// Show the session's size and digest. Sessions of other orgs or users are reported as
+// not found, so session IDs can't be probed.
+func (s *MainService) GetSession(ctx context.Context, orgID uuid.UUID, authorization string,
+	sessionID string) (SessionInfo, error) {
+
+	if s.sessions == nil {
+		return SessionInfo{}, fmt.Errorf("%w; session %s", ErrSessionNotFound, sessionID)
+	}
+	ownerOrg, ownerSubject, err := s.sessions.SessionOwner(ctx, sessionID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	subject := tokenSubject(authorization)
+	if ownerOrg != orgID || subject == "" || ownerSubject != subject {
+		return SessionInfo{}, fmt.Errorf("%w; session %s", ErrSessionNotFound, sessionID)
+	}
+
+	turns, err := s.sessions.LoadTurns(ctx, orgID, sessionID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	digest, err := s.sessions.LoadDigest(ctx, orgID, sessionID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+
+	info := SessionInfo{
+		SessionID:           sessionID,
+		Turns:               len(turns),
+		CompactionThreshold: max(s.compactionTokens, 0),
+	}
+	if len(turns) > 0 {
+		info.ContextTokens = turns[len(turns)-1].ContextTokens
+	}
+	if digest.Compactions > 0 {
+		info.Digest = &digest
+	}
+	return info, nil
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+)
+
+const testCompactionTokens = 1000
+
+// Turns 1 through n. The last one has the given context size, the others are small.
+func testTurns(n int, lastContextTokens int64) []SessionTurn {
+	var turns []SessionTurn
+	for i := 1; i <= n; i++ {
+		turns = append(turns, SessionTurn{
+			OrgID:         testOrg,
+			SessionID:     testSession,
+			Turn:          i,
+			Question:      fmt.Sprintf("question %d", i),
+			Answer:        fmt.Sprintf("answer %d", i),
+			ContextTokens: 100,
+		})
+	}
+	if n > 0 {
+		turns[n-1].ContextTokens = lastContextTokens
+	}
+	return turns
+}
+
+func TestNeedsCompaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int64
+		turns     []SessionTurn
+		digest    SessionDigest
+		want      bool
+	}{
+		{"disabled", 0, testTurns(5, 5000), SessionDigest{}, false},
+		{"no turns", testCompactionTokens, nil, SessionDigest{}, false},
+		{"under the threshold", testCompactionTokens, testTurns(5, 999), SessionDigest{}, false},
+		{"at the threshold", testCompactionTokens, testTurns(3, 1000), SessionDigest{}, true},
+		// The latest turns are kept as they are, so there must be older ones to compact.
+		{"only recent turns", testCompactionTokens, testTurns(keepRecentTurns, 5000), SessionDigest{}, false},
+		{
+			"only recent turns since the digest",
+			testCompactionTokens, testTurns(6, 5000),
+			SessionDigest{ThroughTurn: 4, ResumedAfterTurn: 5, Compactions: 1},
+			false,
+		},
+		{
+			"older turns since the digest",
+			testCompactionTokens, testTurns(6, 5000),
+			SessionDigest{ThroughTurn: 3, ResumedAfterTurn: 5, Compactions: 1},
+			true,
+		},
+		// The size of the last turn was measured before the session was compacted, so
+		// it doesn't count against the new backend session.
+		{
+			"no new turn since the last compaction",
+			testCompactionTokens, testTurns(5, 5000),
+			SessionDigest{ThroughTurn: 2, ResumedAfterTurn: 5, Compactions: 1},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &MainService{compactionTokens: tt.threshold}
+			if got := s.needsCompaction(tt.turns, tt.digest); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPinAssets(t *testing.T) {
+	id := func(n int) string { return fmt.Sprintf("00000000-0000-0000-0000-%012d", n) }
+	var many []SessionTurn
+	for i := 1; i <= maxPinnedAssets+5; i++ {
+		many = append(many, SessionTurn{Turn: i, AssetIDs: []string{id(i)}})
+	}
+
+	tests := []struct {
+		name   string
+		pinned []string
+		turns  []SessionTurn
+		want   []string
+	}{
+		{"nothing", nil, nil, nil},
+		{
+			"questions before answers, newest turns first",
+			nil,
+			[]SessionTurn{
+				{Turn: 1, Question: "what is " + id(1) + "?", AssetIDs: []string{id(2)}},
+				{Turn: 2, Question: "compare " + id(3) + " and " + id(4), AssetIDs: []string{id(5)}},
+			},
+			[]string{id(3), id(4), id(5), id(1), id(2)},
+		},
+		{
+			"new IDs before the pinned ones, without duplicates",
+			[]string{id(7), id(8)},
+			[]SessionTurn{{Turn: 3, Question: "and " + strings.ToUpper("0000000a-0000-0000-0000-000000000008")}},
+			[]string{"0000000a-0000-0000-0000-000000000008", id(7), id(8)},
+		},
+		{
+			"case-insensitive duplicates",
+			[]string{id(1)},
+			[]SessionTurn{{Turn: 1, Question: strings.ToUpper("ABCDEF00-0000-0000-0000-000000000000"),
+				AssetIDs: []string{"abcdef00-0000-0000-0000-000000000000", id(1)}}},
+			[]string{"abcdef00-0000-0000-0000-000000000000", id(1)},
+		},
+		{"not UUIDs", nil, []SessionTurn{{Turn: 1, Question: "host 10.0.0.1 and 1234-5678"}}, nil},
+		{
+			"the oldest are dropped",
+			[]string{id(100)},
+			many,
+			func() []string {
+				var want []string
+				for i := maxPinnedAssets + 5; len(want) < maxPinnedAssets; i-- {
+					want = append(want, id(i))
+				}
+				return want
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pinAssets(tt.pinned, tt.turns)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// A chat completions server that answers every request with the digest, and the service
+// using it for /ask agents.
+func newCompactionService(t *testing.T, store SessionStore) (*MainService, *[]string) {
+	t.Helper()
+	var prompts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		prompts = append(prompts, string(body))
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"DIGEST"},"finish_reason":"stop"}],`+
+			`"usage":{"prompt_tokens":50,"completion_tokens":5}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &MainService{
+		agentConfig:      AgentBackendConfig{Backend: AgentBackendOpenAI, BaseURL: srv.URL, Model: "test-model"},
+		sessions:         store,
+		compactionTokens: testCompactionTokens,
+		anthropicHistory: bricks.NewSessionHistory[bricks.AnthropicMessage](),
+		openAIHistory:    bricks.NewSessionHistory[bricks.OpenAIMessage](),
+	}, &prompts
+}
+
+func TestPrepareSession(t *testing.T) {
+	base := agentSessionID(testOrg, testSession)
+	tests := []struct {
+		name   string
+		turns  []SessionTurn
+		digest SessionDigest
+		// Whether the backend still has the session's history.
+		alive bool
+
+		backendSession string
+		// Text the query must have before the question, and text it must not. Nil if the
+		// question is sent as it is.
+		history []string
+		absent  []string
+		// The saved digest, if the session is compacted.
+		compacted *SessionDigest
+	}{
+		{"new session", nil, SessionDigest{}, false, base, nil, nil, nil},
+		{"backend has the session", testTurns(3, 500), SessionDigest{}, true, base, nil, nil, nil},
+		{
+			"backend lost the session",
+			testTurns(3, 500), SessionDigest{}, false,
+			base,
+			[]string{"User: question 1", "Assistant: answer 3"},
+			[]string{"<digest>"},
+			nil,
+		},
+		{
+			// Turns 1 and 2 go into the digest, the last two are kept as they are.
+			"compacts the older turns",
+			testTurns(4, 5000), SessionDigest{}, true,
+			base + ":1",
+			[]string{"<digest>\nDIGEST\n</digest>", "User: question 3", "User: question 4"},
+			[]string{"question 1", "question 2"},
+			&SessionDigest{ThroughTurn: 2, ResumedAfterTurn: 4, Compactions: 1, Summary: "DIGEST"},
+		},
+		{
+			// The new backend session hasn't answered anything yet, so it still needs the
+			// digest, but the session isn't compacted again.
+			"resumes from the digest",
+			testTurns(4, 5000),
+			SessionDigest{ThroughTurn: 2, ResumedAfterTurn: 4, Compactions: 1, Summary: "EARLIER"},
+			true,
+			base + ":1",
+			[]string{"<digest>\nEARLIER\n</digest>", "User: question 3", "User: question 4"},
+			[]string{"question 2"},
+			nil,
+		},
+		{
+			"continues after the digest",
+			testTurns(5, 500),
+			SessionDigest{ThroughTurn: 2, ResumedAfterTurn: 4, Compactions: 1, Summary: "EARLIER"},
+			true,
+			base + ":1",
+			nil, nil, nil,
+		},
+		{
+			"compacts again",
+			testTurns(5, 5000),
+			SessionDigest{ThroughTurn: 2, ResumedAfterTurn: 4, Compactions: 1, Summary: "EARLIER"},
+			true,
+			base + ":2",
+			[]string{"<digest>\nDIGEST\n</digest>", "User: question 4", "User: question 5"},
+			[]string{"question 3", "EARLIER"},
+			&SessionDigest{ThroughTurn: 3, ResumedAfterTurn: 5, Compactions: 2, Summary: "DIGEST"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeSessionStore()
+			store.turns[testSession] = tt.turns
+			if tt.digest.Compactions > 0 {
+				store.digests[testSession] = tt.digest
+			}
+			s, prompts := newCompactionService(t, store)
+			if tt.alive {
+				s.openAIHistory.Set(tt.digest.backendSessionID(base), []bricks.OpenAIMessage{{Role: "user"}})
+			}
+			profile, err := withDefaults(AgentProfile{Name: "test"}, testBuiltinProfile())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session := s.prepareSession(context.Background(), testOrg, testSession, "next question", profile)
+			if session.backendSession != tt.backendSession {
+				t.Errorf("expected backend session %s, got %s", tt.backendSession, session.backendSession)
+			}
+			if tt.history == nil {
+				if session.query != "next question" {
+					t.Errorf("expected the question as it is, got %q", session.query)
+				}
+			} else if !strings.HasSuffix(session.query, "</conversationHistory>\n\nnext question") {
+				t.Errorf("expected the history before the question, got %q", session.query)
+			}
+			for _, text := range tt.history {
+				if !strings.Contains(session.query, text) {
+					t.Errorf("query is missing %q:\n%s", text, session.query)
+				}
+			}
+			for _, text := range tt.absent {
+				if strings.Contains(session.query, text) {
+					t.Errorf("query shouldn't have %q:\n%s", text, session.query)
+				}
+			}
+
+			saved := store.digests[testSession]
+			if tt.compacted == nil {
+				if len(*prompts) != 0 || saved.Compactions != tt.digest.Compactions {
+					t.Errorf("expected no compaction, got digest %+v", saved)
+				}
+				return
+			}
+			if saved.ThroughTurn != tt.compacted.ThroughTurn || saved.ResumedAfterTurn != tt.compacted.ResumedAfterTurn ||
+				saved.Compactions != tt.compacted.Compactions || saved.Summary != tt.compacted.Summary {
+				t.Errorf("expected digest %+v, got %+v", *tt.compacted, saved)
+			}
+			// The summarizer gets the previous digest and the turns being compacted.
+			if len(*prompts) != 1 || !strings.Contains((*prompts)[0], fmt.Sprintf("question %d", saved.ThroughTurn)) ||
+				!strings.Contains((*prompts)[0], tt.digest.Summary) {
+				t.Errorf("unexpected summary requests %v", *prompts)
+			}
+			if session.usage.Invocations != 1 || session.usage.InputTokens != 50 {
+				t.Errorf("expected the summary's usage, got %+v", session.usage)
+			}
+			// The old backend session is dropped.
+			if len(s.openAIHistory.Get(tt.digest.backendSessionID(base))) != 0 {
+				t.Errorf("the previous backend session wasn't forgotten")
+			}
+		})
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	store := newFakeSessionStore()
+	store.owners[testSession] = sessionOwner{org: testOrg, subject: "user-1"}
+	store.turns[testSession] = testTurns(3, 4200)
+	s := &MainService{sessions: store, compactionTokens: testCompactionTokens}
+
+	info, err := s.GetSession(context.Background(), testOrg, userToken, testSession)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if info.Turns != 3 || info.ContextTokens != 4200 || info.CompactionThreshold != testCompactionTokens ||
+		info.Digest != nil {
+		t.Errorf("unexpected session info %+v", info)
+	}
+
+	// Other orgs and users, and callers without a subject, can't tell the session exists.
+	for _, caller := range []struct {
+		orgID         uuid.UUID
+		authorization string
+	}{
+		{otherOrg, userToken},
+		{testOrg, otherToken},
+		{testOrg, ""},
+	} {
+		if _, err := s.GetSession(context.Background(), caller.orgID, caller.authorization, testSession); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("expected ErrSessionNotFound for %+v, got %v", caller, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+)
+
+// Where the documentation is read from by default, relative to the working directory.
+// Set DOCS_PATH to override it.
+const defaultDocsPath = "knowledgebase/docs"
+
+// How many sections SearchDocumentation returns.
+const docSearchResults = 3
+
+// Returned when the documentation couldn't be loaded at startup.
+var ErrDocsUnavailable = errors.New("documentation search is not available")
+
+// A documentation section matching a search.
+type DocumentationResult struct {
+	Title string `json:"title"`
+	// Link to the section in the Cosmos UI, the same as knowledgebase references.
+	URL string `json:"url"`
+	// The section's Markdown, including its header.
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+	// The section as a reference, for functions that return it to an agent.
+	Source KnowledgebaseRef `json:"-"`
+}
+
+var docFilePattern = regexp.MustCompile(`^(\d+)`)
+var docHeaderPattern = regexp.MustCompile(`^(#{1,6})\s+(.*)`)
+
+// Load the Markdown documentation under dir as one document per section, split the same
+// way knowledgebase/create-kb.py splits it for the Bedrock knowledgebase: each folder is a
+// documentation folder, its files starting with a number are read in numeric order, and
+// every header starts a new section. Document IDs and metadata match too.
+func loadDocumentation(dir string) ([]bricks.Document, error) {
+	folders, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read documentation: %w", err)
+	}
+
+	var docs []bricks.Document
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, folder.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read documentation: %w", err)
+		}
+		var names []string
+		for _, file := range files {
+			if docFilePattern.MatchString(file.Name()) {
+				names = append(names, file.Name())
+			}
+		}
+		sort.SliceStable(names, func(a, b int) bool {
+			return docFileNumber(names[a]) < docFileNumber(names[b])
+		})
+
+		for _, name := range names {
+			content, err := os.ReadFile(filepath.Join(dir, folder.Name(), name))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read documentation: %w", err)
+			}
+			docs = append(docs, splitDocSections(folder.Name(), string(content))...)
+		}
+	}
+	return docs, nil
+}
+
+func docFileNumber(name string) int {
+	n, _ := strconv.Atoi(docFilePattern.FindString(name))
+	return n
+}
+
+// Split a Markdown file into one document per header. Text before the first header is
+// dropped, as are sections with nothing in them.
+func splitDocSections(folder string, content string) []bricks.Document {
+	var docs []bricks.Document
+	var header string
+	var section strings.Builder
+	add := func() {
+		text := strings.TrimSpace(section.String())
+		if header == "" || text == "" {
+			return
+		}
+		// Same ID as create-kb.py, so results can be matched with the knowledgebase.
+		hash := sha1.Sum([]byte(folder + "__" + header))
+		docs = append(docs, bricks.Document{
+			ID:       folder + "_" + hex.EncodeToString(hash[:])[:10],
+			Text:     text,
+			Metadata: map[string]string{"header": header, "folder": folder},
+		})
+	}
+
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if docHeaderPattern.MatchString(line) {
+			add()
+			section.Reset()
+			header = strings.TrimSpace(line)
+		}
+		if header != "" {
+			section.WriteString(line)
+		}
+	}
+	add()
+	return docs
+}
+
+// Search the product documentation. This is the local stand-in for the Bedrock
+// knowledgebase, for MCP clients that can't use it.
+func (s *MainService) SearchDocumentation(ctx context.Context, orgID uuid.UUID, query string) ([]DocumentationResult, error) {
+	if s.docs == nil {
+		return nil, ErrDocsUnavailable
+	}
+	matches, err := s.docs.Retrieve(ctx, query, docSearchResults)
+	if err != nil {
+		return nil, fmt.Errorf("documentation search failed: %w", err)
+	}
+
+	results := make([]DocumentationResult, 0, len(matches))
+	for _, match := range matches {
+		source := KnowledgebaseRef{Folder: match.Metadata["folder"], Header: match.Metadata["header"]}
+		results = append(results, DocumentationResult{
+			Title:  formatRefTitle(source.Header),
+			URL:    documentationURL(orgID, source.Folder, source.Header),
+			Text:   match.Text,
+			Score:  match.Score,
+			Source: source,
+		})
+	}
+	return results, nil
+}
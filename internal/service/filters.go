@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result states of an Ask request, in AskResult.State.
+const (
+	// The question was answered normally.
+	AskStateOK = "ok"
+	// A content filter blocked the question or the answer. The response is a refusal
+	// message instead of an answer.
+	AskStateBlocked = "blocked"
+	// A content filter rewrote the question or the answer.
+	AskStateRewritten = "rewritten"
+	// The Bedrock Guardrail blocked or masked the question or the answer.
+	AskStateGuardrail = "guardrail"
+)
+
+// What a content filter decided about a question or answer.
+type FilterVerdict struct {
+	// Stop here. For a question, the agent isn't called; for an answer, it isn't shown.
+	Block bool
+	// If not empty (and not blocked), replaces the text for the rest of the chain.
+	Rewrite string
+	// Why the filter intervened, for the logs. Not shown to the user.
+	Reason string
+}
+
+// A content filter checks a question before it's sent to the agent, or an answer before
+// it's returned to the user. Filters run in the order they were added, each one seeing
+// the text as rewritten by the ones before. An error fails the request, since letting
+// unchecked text through is worse than not answering.
+type ContentFilter func(ctx context.Context, orgID uuid.UUID, text string) (FilterVerdict, error)
+
+// A filter in a chain, with the name used when logging its interventions.
+type namedFilter struct {
+	name   string
+	filter ContentFilter
+}
+
+// The message returned in place of a blocked question or answer.
+const blockedMessage = "Sorry, I can't help with that. I can answer questions about your " +
+	"assets, emerging threats and the Cosmos platform."
+
+// Add a filter that runs on every question before it's sent to the agent.
+func (s *MainService) AddQuestionFilter(name string, filter ContentFilter) {
+	s.questionFilters = append(s.questionFilters, namedFilter{name: name, filter: filter})
+}
+
+// Add a filter that runs on every answer before it's returned.
+func (s *MainService) AddAnswerFilter(name string, filter ContentFilter) {
+	s.answerFilters = append(s.answerFilters, namedFilter{name: name, filter: filter})
+}
+
+// Run the text through a filter chain. Returns the text to use and the resulting state:
+// AskStateOK if no filter intervened, AskStateRewritten, or AskStateBlocked, in which
+// case the returned text is the blocked message.
+func runFilters(ctx context.Context, chain []namedFilter, stage string, orgID uuid.UUID,
+	text string) (string, string, error) {
+
+	state := AskStateOK
+	for _, f := range chain {
+		verdict, err := f.filter(ctx, orgID, text)
+		if err != nil {
+			return "", "", fmt.Errorf("%s filter %s failed: %w", stage, f.name, err)
+		}
+
+		entry := log.WithFields(log.Fields{
+			"org":    orgID,
+			"stage":  stage,
+			"filter": f.name,
+			"reason": verdict.Reason,
+		})
+		if verdict.Block {
+			entry.Warn("content filter blocked ", stage)
+			return blockedMessage, AskStateBlocked, nil
+		}
+		if verdict.Rewrite != "" && verdict.Rewrite != text {
+			entry.Info("content filter rewrote ", stage)
+			text = verdict.Rewrite
+			state = AskStateRewritten
+		}
+	}
+	return text, state, nil
+}
+
+// Links into the Cosmos UI carry the org ID as the first path segment. The hex digits and
+// dashes there are matched whole, so an org ID with extra digits isn't mistaken for the
+// org's own.
+var uiOrgLinkPattern = regexp.MustCompile(`https://ui\.api\.non\.usea2\.bf9\.io/?([0-9a-fA-F-]*)\S*`)
+
+// An answer filter that removes UI links to other organizations. Asset queries are
+// already restricted to the org's own partition, so these shouldn't come up, but if the
+// model makes one up or copies one from somewhere, it must not reach the user. Links
+// whose first segment isn't exactly the org's ID, e.g., a garbled UUID, are removed too.
+func otherOrgLinkFilter(ctx context.Context, orgID uuid.UUID, text string) (FilterVerdict, error) {
+	var removed []string
+	rewritten := uiOrgLinkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		linkOrg := uiOrgLinkPattern.FindStringSubmatch(link)[1]
+		if strings.EqualFold(linkOrg, orgID.String()) {
+			return link
+		}
+		removed = append(removed, linkOrg)
+		return "[link removed]"
+	})
+	if len(removed) == 0 {
+		return FilterVerdict{}, nil
+	}
+	return FilterVerdict{
+		Rewrite: rewritten,
+		Reason:  fmt.Sprintf("links to other organizations: %s", strings.Join(removed, ", ")),
+	}, nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestOtherOrgLinkFilter(t *testing.T) {
+	const ui = "https://ui.api.non.usea2.bf9.io/"
+	own := testOrg.String()
+	tests := []struct {
+		name    string
+		text    string
+		rewrite string
+	}{
+		{"no links", "You have 3 hosts.", ""},
+		{"own org", "See " + ui + own + "/assets/host for details.", ""},
+		{"own org in upper case", "See " + ui + strings.ToUpper(own) + "/assets.", ""},
+		{"own org in a markdown link", "[hosts](" + ui + own + "/assets/host).", ""},
+		{"other org", "See " + ui + otherOrg.String() + "/assets/host now.", "See [link removed] now."},
+		{
+			"own and other org",
+			ui + own + "/assets and " + ui + otherOrg.String() + "/assets",
+			ui + own + "/assets and [link removed]",
+		},
+		{"org ID with an extra digit", "See " + ui + own + "1/assets now.", "See [link removed] now."},
+		{"truncated org ID", "See " + ui + own[:30] + "/assets now.", "See [link removed] now."},
+		{"not an org ID", "See " + ui + "assets now.", "See [link removed] now."},
+		{"other host", "See https://example.com/" + otherOrg.String() + "/assets.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, err := otherOrgLinkFilter(context.Background(), testOrg, tt.text)
+			if err != nil {
+				t.Fatalf("filter failed: %v", err)
+			}
+			if verdict.Block {
+				t.Errorf("links should be removed, not blocked")
+			}
+			if verdict.Rewrite != tt.rewrite {
+				t.Errorf("expected rewrite %q, got %q", tt.rewrite, verdict.Rewrite)
+			}
+			if (verdict.Reason != "") != (tt.rewrite != "") {
+				t.Errorf("unexpected reason %q", verdict.Reason)
+			}
+		})
+	}
+}
+
+// A filter that returns the given verdict and records the text it saw.
+func fixedFilter(verdict FilterVerdict, err error, seen *[]string) ContentFilter {
+	return func(ctx context.Context, orgID uuid.UUID, text string) (FilterVerdict, error) {
+		*seen = append(*seen, text)
+		return verdict, err
+	}
+}
+
+func TestRunFilters(t *testing.T) {
+	failure := errors.New("moderation unavailable")
+	tests := []struct {
+		name     string
+		verdicts []FilterVerdict
+		err      error
+		want     string
+		state    string
+		// The text each filter saw.
+		seen []string
+	}{
+		{"no filters", nil, nil, "question", AskStateOK, nil},
+		{"pass", []FilterVerdict{{}, {}}, nil, "question", AskStateOK, []string{"question", "question"}},
+		{
+			"rewrite is seen by later filters",
+			[]FilterVerdict{{Rewrite: "rewritten"}, {}},
+			nil, "rewritten", AskStateRewritten, []string{"question", "rewritten"},
+		},
+		{
+			"rewrite to the same text",
+			[]FilterVerdict{{Rewrite: "question"}},
+			nil, "question", AskStateOK, []string{"question"},
+		},
+		{
+			"block stops the chain",
+			[]FilterVerdict{{Rewrite: "rewritten"}, {Block: true}, {}},
+			nil, blockedMessage, AskStateBlocked, []string{"question", "rewritten"},
+		},
+		{"error", []FilterVerdict{{}}, failure, "", "", []string{"question"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			var chain []namedFilter
+			for _, verdict := range tt.verdicts {
+				chain = append(chain, namedFilter{name: "test", filter: fixedFilter(verdict, tt.err, &seen)})
+			}
+
+			text, state, err := runFilters(context.Background(), chain, "question", testOrg, "question")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if text != tt.want || state != tt.state {
+				t.Errorf("expected %q (%s), got %q (%s)", tt.want, tt.state, text, state)
+			}
+			if strings.Join(seen, "|") != strings.Join(tt.seen, "|") {
+				t.Errorf("filters saw %q, expected %q", seen, tt.seen)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+)
+
+//go:embed org_context.txt
+var orgContextSource string
+
+// What the agent is told about the user's organization. Added after the profile's
+// instruction, so custom profile instructions don't need to repeat it.
+var orgContextTemplate = template.Must(template.New("org_context").
+	Funcs(instructionFuncs).
+	Parse(orgContextSource))
+
+// The agent instruction for one request, split into the parts it's made of. Each request
+// builds its own from the profile, the organization and the tools offered. Nothing is
+// shared between requests, so concurrent requests can't change each other's prompt.
+type Instruction struct {
+	// The profile's instruction.
+	Base string `json:"base"`
+	// What the agent should know about the organization.
+	OrgContext string `json:"org_context"`
+	// Extended descriptions of the tools offered for this request, in name order. Only
+	// set for backends that can't take the full description in the tool definition
+	// (see AgentBackendConfig.needsToolInstructions).
+	ToolInstructions []ToolInstruction `json:"tool_instructions"`
+	// How to format the answer, in structured mode. See StructuredAnswer.
+	OutputFormat string `json:"output_format,omitempty"`
+}
+
+type ToolInstruction struct {
+	Function    string `json:"function"`
+	Instruction string `json:"instruction"`
+}
+
+// The complete instruction text given to the agent.
+func (in Instruction) String() string {
+	var sb strings.Builder
+	sb.WriteString(in.Base)
+	if in.OrgContext != "" {
+		sb.WriteString("\n")
+		sb.WriteString(in.OrgContext)
+	}
+	for _, ti := range in.ToolInstructions {
+		fmt.Fprintf(&sb, "<toolInstructions>\n%s\n</toolInstructions>", ti.Instruction)
+	}
+	sb.WriteString(in.OutputFormat)
+	return sb.String()
+}
+
+// Compose the instruction for a request from the profile, the organization's template
+// data and the functions offered to the agent. None of the inputs are modified.
+func buildInstruction(profile resolvedProfile, data InstructionData, fs *bricks.FunctionSet,
+	withToolInstructions bool) (Instruction, error) {
+
+	var in Instruction
+	base, err := profile.renderInstruction(data)
+	if err != nil {
+		return Instruction{}, err
+	}
+	in.Base = base
+
+	var orgContext strings.Builder
+	if err := orgContextTemplate.Execute(&orgContext, data); err != nil {
+		return Instruction{}, fmt.Errorf("failed to render org context: %w", err)
+	}
+	in.OrgContext = orgContext.String()
+
+	// Bedrock has a limit of how much text can be part of an action description. We
+	// have the "extended description" in the tool instruction section to work around
+	// this. Sorted, so the same tools always give the same prompt.
+	if withToolInstructions {
+		names := make([]string, 0, len(fs.Functions))
+		for name, fn := range fs.Functions {
+			if fn.ExtendedDescription != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			in.ToolInstructions = append(in.ToolInstructions, ToolInstruction{
+				Function:    name,
+				Instruction: fs.Functions[name].ExtendedDescription,
+			})
+		}
+	}
+	return in, nil
+}
+
+// Everything Ask decides before calling the agent: the profile, the functions offered
+// and the instruction.
+type agentSetup struct {
+	profile     resolvedProfile
+	functions   *bricks.FunctionSet
+	instruction Instruction
+}
+
+// Pick the functions for a question and compose the instruction. In structured mode,
+// the instruction asks for a StructuredAnswer.
+func (s *MainService) prepareAgent(ctx context.Context, orgID uuid.UUID, query string,
+	profile resolvedProfile, structured bool) (agentSetup, error) {
+
+	// The function set is created for each request, with only the tools that are most
+	// relevant to the question. That saves context space and keeps the model from
+	// getting distracted by tools it doesn't need. The profile decides which functions
+	// are available at all, and how many of them the agent gets.
+	fs := s.selectFunctions(ctx, query, profile)
+
+	instruction, err := buildInstruction(profile, s.instructionData(ctx, orgID), fs,
+		s.agentConfig.needsToolInstructions())
+	if err != nil {
+		return agentSetup{}, err
+	}
+	if structured {
+		instruction.OutputFormat = structuredOutputInstruction()
+	}
+	return agentSetup{profile: profile, functions: fs, instruction: instruction}, nil
+}
+
+// The prompt Ask would use for a question, for debugging prompts and tool selection.
+type PromptDebug struct {
+	Profile string `json:"profile"`
+	Model   string `json:"model"`
+	// Names of the functions that would be offered, sorted.
+	Functions []string `json:"functions"`
+	// The complete instruction text.
+	Prompt string `json:"prompt"`
+	// The same instruction, by part.
+	Instruction Instruction `json:"instruction"`
+}
+
+// Compose the prompt for a question the same way Ask does, without calling the agent.
+// An empty profile uses the org's default.
+func (s *MainService) DebugPrompt(ctx context.Context, query string, orgID uuid.UUID,
+	profile string) (PromptDebug, error) {
+
+	resolved, err := s.profiles.Resolve(orgID, profile)
+	if err != nil {
+		return PromptDebug{}, err
+	}
+	setup, err := s.prepareAgent(ctx, orgID, query, resolved, false)
+	if err != nil {
+		return PromptDebug{}, err
+	}
+	names := make([]string, 0, len(setup.functions.Functions))
+	for name := range setup.functions.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return PromptDebug{
+		Profile:     setup.profile.Name,
+		Model:       setup.profile.Model,
+		Functions:   names,
+		Prompt:      setup.instruction.String(),
+		Instruction: setup.instruction,
+	}, nil
+}
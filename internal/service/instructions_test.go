@@ -0,0 +1,134 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func TestBuildInstruction(t *testing.T) {
+	profile, err := withDefaults(AgentProfile{
+		Name:        "test",
+		Instruction: "You help {{.OrgName}}{{if .HasFeature \"threats\"}} with threats{{end}}.",
+	}, testBuiltinProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme := InstructionData{
+		OrgName:  "Acme Corp",
+		Industry: "Retail",
+		Timezone: "America/New_York",
+		Features: []string{"threats", "assets"},
+		Date:     "2025-06-01",
+	}
+	tests := []struct {
+		name string
+		data InstructionData
+		base string
+		// Text the org context must have, and text the instruction must not.
+		context []string
+		absent  []string
+	}{
+		{
+			"org details",
+			acme,
+			"You help Acme Corp with threats.",
+			[]string{
+				"The customer's organization name is: Acme Corp",
+				"The organization's industry is: Retail",
+				"The organization has these Cosmos features enabled: threats, assets.",
+				"Today's date is 2025-06-01 (America/New_York).",
+			},
+			[]string{"Globex"},
+		},
+		{
+			"another org",
+			InstructionData{OrgName: "Globex", Date: "2025-06-02"},
+			"You help Globex.",
+			[]string{"The customer's organization name is: Globex", "Today's date is 2025-06-02."},
+			[]string{"Acme", "industry", "features"},
+		},
+		{
+			"unknown org",
+			InstructionData{Date: "2025-06-03"},
+			"You help .",
+			[]string{"Today's date is 2025-06-03."},
+			[]string{"organization name"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := buildInstruction(profile, tt.data, bricks.NewFunctionSet("test"), false)
+			if err != nil {
+				t.Fatalf("build failed: %v", err)
+			}
+			if in.Base != tt.base {
+				t.Errorf("expected base %q, got %q", tt.base, in.Base)
+			}
+			for _, line := range tt.context {
+				if !strings.Contains(in.OrgContext, line) {
+					t.Errorf("org context is missing %q:\n%s", line, in.OrgContext)
+				}
+			}
+			for _, text := range tt.absent {
+				if strings.Contains(in.String(), text) {
+					t.Errorf("instruction shouldn't mention %q:\n%s", text, in.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBuildInstructionToolInstructions(t *testing.T) {
+	fs := bricks.NewFunctionSet("test")
+	fs.AddFunction("query_assets", "Query assets", "How to query assets", struct{}{}, nil)
+	fs.AddFunction("get_assets_overview_link", "Overview link", "How to link", struct{}{}, nil)
+	fs.AddFunction("search_documentation", "Search docs", "", struct{}{}, nil)
+	profile, err := withDefaults(AgentProfile{Name: "test"}, testBuiltinProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := buildInstruction(profile, InstructionData{Date: "2025-06-01"}, fs, true)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	// Sorted by name, and only for functions with an extended description.
+	var names []string
+	for _, ti := range in.ToolInstructions {
+		names = append(names, ti.Function)
+	}
+	if strings.Join(names, ",") != "get_assets_overview_link,query_assets" {
+		t.Errorf("unexpected tool instructions %v", names)
+	}
+	if !strings.HasSuffix(in.String(), "<toolInstructions>\nHow to query assets\n</toolInstructions>") {
+		t.Errorf("tool instructions should come last:\n%s", in.String())
+	}
+
+	without, err := buildInstruction(profile, InstructionData{Date: "2025-06-01"}, fs, false)
+	if err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if len(without.ToolInstructions) != 0 || strings.Contains(without.String(), "<toolInstructions>") {
+		t.Errorf("expected no tool instructions, got %v", without.ToolInstructions)
+	}
+}
+
+func TestDebugPromptWithoutFunctions(t *testing.T) {
+	// Before SetFunctions, the prompt is composed without any tools.
+	profiles, err := LoadProfileStore("", testBuiltinProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MainService{profiles: profiles, orgs: fakeOrgDirectory{}}
+
+	debug, err := s.DebugPrompt(t.Context(), "question", testOrg, "")
+	if err != nil {
+		t.Fatalf("debug prompt failed: %v", err)
+	}
+	if len(debug.Functions) != 0 || len(debug.Instruction.ToolInstructions) != 0 {
+		t.Errorf("expected no functions, got %v", debug.Functions)
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// An organization from the organizations table (config/1.setup.sql).
+type Organization struct {
+	ID   uuid.UUID
+	Name string
+	// Suffix of the org's asset partition and query role. See getOrgHash.
+	PartitionHash string
+	Settings      OrgSettings
+}
+
+// Optional organization details, stored as JSON in organizations.settings.
+type OrgSettings struct {
+	Industry string `json:"industry,omitempty"`
+	// IANA time zone name, e.g., "America/New_York".
+	Timezone string `json:"timezone,omitempty"`
+	// Cosmos features the organization has enabled.
+	Features []string `json:"features,omitempty"`
+}
+
+// Returned when an organization isn't in the directory.
+var ErrOrgNotFound = errors.New("organization not found")
+
+// Looks up organization details by ID.
+type OrgDirectory interface {
+	GetOrganization(ctx context.Context, orgID uuid.UUID) (Organization, error)
+}
+
+// How long organizations are cached. They're read on every Ask, but hardly ever change.
+const orgCacheTTL = 5 * time.Minute
+
+type cachedOrg struct {
+	org     Organization
+	err     error
+	expires time.Time
+}
+
+// OrgDirectory backed by the organizations table, with a short cache in front.
+type pgOrgDirectory struct {
+	url string
+
+	mu    sync.Mutex
+	cache map[uuid.UUID]cachedOrg
+}
+
+func newPGOrgDirectory(url string) *pgOrgDirectory {
+	return &pgOrgDirectory{url: url, cache: make(map[uuid.UUID]cachedOrg)}
+}
+
+func (d *pgOrgDirectory) GetOrganization(ctx context.Context, orgID uuid.UUID) (Organization, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[orgID]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.org, cached.err
+	}
+
+	org, err := d.loadOrganization(ctx, orgID)
+	// Unknown orgs are cached too, but connection errors aren't.
+	if err == nil || errors.Is(err, ErrOrgNotFound) {
+		d.mu.Lock()
+		d.cache[orgID] = cachedOrg{org: org, err: err, expires: time.Now().Add(orgCacheTTL)}
+		d.mu.Unlock()
+	}
+	return org, err
+}
+
+func (d *pgOrgDirectory) loadOrganization(ctx context.Context, orgID uuid.UUID) (Organization, error) {
+	// Like QueryAssets, this opens a connection per request for simplicity.
+	conn, err := pgx.Connect(ctx, d.url)
+	if err != nil {
+		return Organization{}, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	org := Organization{ID: orgID}
+	err = conn.QueryRow(ctx, `SELECT name, partition_hash, settings FROM organizations WHERE id = $1`, orgID).
+		Scan(&org.Name, &org.PartitionHash, &org.Settings)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Organization{}, fmt.Errorf("%w; %s", ErrOrgNotFound, orgID)
+	}
+	if err != nil {
+		return Organization{}, fmt.Errorf("failed to load organization: %w", err)
+	}
+	return org, nil
+}
+
+// The instruction template data for a request's organization. If the organization can't
+// be loaded, the template still gets the org ID and date, so the agent keeps working
+// without the org details.
+func (s *MainService) instructionData(ctx context.Context, orgID uuid.UUID) InstructionData {
+	data := InstructionData{OrgID: orgID.String()}
+
+	org, err := s.orgs.GetOrganization(ctx, orgID)
+	if err != nil {
+		log.WithError(err).WithField("org", orgID).Warn("failed to load organization for instruction")
+	} else {
+		data.OrgName = org.Name
+		data.Industry = org.Settings.Industry
+		data.Timezone = org.Settings.Timezone
+		data.Features = org.Settings.Features
+	}
+
+	// The date is in the org's time zone, so "today" means the same thing to the agent
+	// as it does to the user.
+	now := time.Now()
+	if data.Timezone != "" {
+		if loc, err := time.LoadLocation(data.Timezone); err == nil {
+			now = now.In(loc)
+		} else {
+			log.WithError(err).WithField("org", orgID).Warn("invalid organization time zone")
+		}
+	}
+	data.Date = now.Format(time.DateOnly)
+	return data
+}
+
+// Returns true if the organization has the feature enabled. For use in instruction
+// templates: {{if .HasFeature "emerging_threats"}}...{{end}}
+func (d InstructionData) HasFeature(name string) bool {
+	return slices.Contains(d.Features, name)
+}
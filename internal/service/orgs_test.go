@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// An OrgDirectory with fixed organizations.
+type fakeOrgDirectory map[uuid.UUID]Organization
+
+func (d fakeOrgDirectory) GetOrganization(ctx context.Context, orgID uuid.UUID) (Organization, error) {
+	org, ok := d[orgID]
+	if !ok {
+		return Organization{}, fmt.Errorf("%w; %s", ErrOrgNotFound, orgID)
+	}
+	return org, nil
+}
+
+func TestInstructionData(t *testing.T) {
+	s := &MainService{orgs: fakeOrgDirectory{
+		testOrg: {ID: testOrg, Name: "Acme Corp", Settings: OrgSettings{
+			Industry: "Retail",
+			Timezone: "Pacific/Kiritimati",
+			Features: []string{"emerging_threats"},
+		}},
+		otherOrg: {ID: otherOrg, Name: "Globex", Settings: OrgSettings{Timezone: "Not/AZone"}},
+	}}
+	kiritimati, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Skip("time zone data isn't available")
+	}
+	unknown := uuid.MustParse("99999999-9999-9999-9999-999999999999")
+
+	tests := []struct {
+		name  string
+		orgID uuid.UUID
+		want  InstructionData
+		// The time zone the date is in.
+		loc *time.Location
+	}{
+		{
+			"org details",
+			testOrg,
+			InstructionData{OrgName: "Acme Corp", Industry: "Retail", Timezone: "Pacific/Kiritimati",
+				Features: []string{"emerging_threats"}},
+			kiritimati,
+		},
+		{"invalid time zone", otherOrg, InstructionData{OrgName: "Globex", Timezone: "Not/AZone"}, time.Local},
+		{"unknown org", unknown, InstructionData{}, time.Local},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.OrgID = tt.orgID.String()
+			// The date is checked separately, in case the test runs across midnight.
+			before := time.Now().In(tt.loc).Format(time.DateOnly)
+			data := s.instructionData(context.Background(), tt.orgID)
+			after := time.Now().In(tt.loc).Format(time.DateOnly)
+			if data.Date != before && data.Date != after {
+				t.Errorf("expected the date %s in %s, got %s", before, tt.loc, data.Date)
+			}
+
+			data.Date = ""
+			if !reflect.DeepEqual(data, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, data)
+			}
+		})
+	}
+}
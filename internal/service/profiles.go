@@ -0,0 +1,363 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// An agent profile bundles the settings Ask uses to create the agent, so new prompts and
+// models can be tried by editing the profiles file rather than redeploying. Empty fields
+// fall back to the built-in profile, which comes from the environment (see
+// AgentBackendConfig).
+//
+// The backend itself (AGENT_BACKEND) isn't part of a profile. Profiles pick the model
+// and prompt within the configured backend.
+type AgentProfile struct {
+	Name string `yaml:"name"`
+	// Model ID for the configured backend.
+	Model string `yaml:"model"`
+	// Bedrock only, see BedrockAgentConfig.FallbackModels.
+	FallbackModels []string `yaml:"fallback_models"`
+	AgentName      string   `yaml:"agent_name"`
+	// System instruction as a Go text/template. See InstructionData for the fields.
+	Instruction string `yaml:"instruction"`
+	// Names of the functions the agent may use. Empty enables every function.
+	Functions []string `yaml:"functions"`
+	// Knowledgebases the agent may search (Bedrock and Converse). Leave it out to use the
+	// Cosmos knowledgebase, or set it to [] for none.
+	Knowledgebases []ProfileKnowledgebase `yaml:"knowledgebases"`
+	// How many of the most relevant functions to give the agent, like AGENT_TOOL_TOP_K.
+	ToolTopK *int `yaml:"tool_top_k"`
+	// Tool budgets for a single question, see bricks.BedrockAgentConfig. Every backend
+	// applies them. Zero uses the defaults.
+	MaxToolRounds      int `yaml:"max_tool_rounds"`
+	MaxToolCalls       int `yaml:"max_tool_calls"`
+	MaxDurationSeconds int `yaml:"max_duration_seconds"`
+}
+
+type ProfileKnowledgebase struct {
+	ID          string `yaml:"id"`
+	Description string `yaml:"description"`
+}
+
+// The profiles file. JSON works too, since it's valid YAML.
+//
+//	default_profile: default
+//	org_profiles:
+//	  11111111-1111-1111-1111-111111111111: experimental
+//	profiles:
+//	  - name: experimental
+//	    model: us.anthropic.claude-sonnet-4-20250514-v1:0
+//	    instruction: |
+//	      You are Fox...
+type ProfilesConfig struct {
+	// Profile used when the request doesn't ask for one and the org has no default.
+	// Empty uses the built-in profile.
+	DefaultProfile string `yaml:"default_profile"`
+	// Default profile per organization ID.
+	OrgProfiles map[string]string `yaml:"org_profiles"`
+	Profiles    []AgentProfile    `yaml:"profiles"`
+}
+
+// Fields available to instruction templates. The org details come from the
+// organizations table and are empty if the org isn't there.
+type InstructionData struct {
+	OrgID    string
+	OrgName  string
+	Industry string
+	Timezone string
+	// Features the org has enabled. See HasFeature.
+	Features []string
+	// Today's date in the org's time zone, YYYY-MM-DD.
+	Date string
+}
+
+// Returned when a request asks for a profile that doesn't exist.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// The profiles file is invalid.
+var ErrInvalidProfiles = errors.New("invalid profiles")
+
+// A profile ready to use: defaults filled in and the instruction template parsed.
+type resolvedProfile struct {
+	AgentProfile
+	instruction *template.Template
+}
+
+// The profiles from one version of the file.
+type profileSet struct {
+	config   ProfilesConfig
+	profiles map[string]resolvedProfile
+	orgs     map[uuid.UUID]string
+}
+
+// Parse and check a profiles file. Each profile is resolved against the built-in one.
+// Profiles may only enable the given functions; with nil functions, the names aren't
+// checked.
+func parseProfiles(data []byte, builtin AgentProfile, functions []string) (*profileSet, error) {
+	var config ProfilesConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid profiles file: %w", err)
+	}
+
+	set := &profileSet{
+		config:   config,
+		profiles: make(map[string]resolvedProfile),
+		orgs:     make(map[uuid.UUID]string),
+	}
+	for _, profile := range config.Profiles {
+		if profile.Name == "" {
+			return nil, fmt.Errorf("%w; every profile needs a name", ErrInvalidProfiles)
+		}
+		if _, ok := set.profiles[profile.Name]; ok {
+			return nil, fmt.Errorf("%w; duplicate profile %s", ErrInvalidProfiles, profile.Name)
+		}
+		resolved, err := withDefaults(profile, builtin)
+		if err != nil {
+			return nil, err
+		}
+		set.profiles[profile.Name] = resolved
+	}
+
+	if config.DefaultProfile != "" {
+		if _, ok := set.profiles[config.DefaultProfile]; !ok {
+			return nil, fmt.Errorf("%w; default_profile %s is not defined", ErrInvalidProfiles, config.DefaultProfile)
+		}
+	}
+	for org, name := range config.OrgProfiles {
+		orgID, err := uuid.Parse(org)
+		if err != nil {
+			return nil, fmt.Errorf("%w; org_profiles key %q is not an org ID", ErrInvalidProfiles, org)
+		}
+		if _, ok := set.profiles[name]; !ok {
+			return nil, fmt.Errorf("%w; profile %s for org %s is not defined", ErrInvalidProfiles, name, org)
+		}
+		set.orgs[orgID] = name
+	}
+	if functions != nil {
+		if err := set.checkFunctions(functions); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Check that the profiles only enable the given functions. A misspelled name would
+// otherwise quietly leave the agent without that tool.
+func (set *profileSet) checkFunctions(functions []string) error {
+	for _, profile := range set.profiles {
+		for _, name := range profile.Functions {
+			if !slices.Contains(functions, name) {
+				return fmt.Errorf("%w; profile %s: unknown function %s", ErrInvalidProfiles, profile.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Functions available to instruction templates, besides the text/template builtins.
+var instructionFuncs = template.FuncMap{
+	"join": strings.Join,
+}
+
+// Fill in the empty fields of the profile from the built-in one and parse its
+// instruction template.
+func withDefaults(profile AgentProfile, builtin AgentProfile) (resolvedProfile, error) {
+	if profile.Model == "" {
+		profile.Model = builtin.Model
+		// Fallbacks are for a specific model, so they only carry over with it.
+		if profile.FallbackModels == nil {
+			profile.FallbackModels = builtin.FallbackModels
+		}
+	}
+	if profile.AgentName == "" {
+		profile.AgentName = builtin.AgentName
+	}
+	if profile.Instruction == "" {
+		profile.Instruction = builtin.Instruction
+	}
+	if profile.Knowledgebases == nil {
+		profile.Knowledgebases = builtin.Knowledgebases
+	}
+	if profile.ToolTopK == nil {
+		profile.ToolTopK = builtin.ToolTopK
+	}
+	if *profile.ToolTopK < 0 || profile.MaxToolRounds < 0 || profile.MaxToolCalls < 0 ||
+		profile.MaxDurationSeconds < 0 {
+		return resolvedProfile{}, fmt.Errorf("%w; profile %s: limits can't be negative",
+			ErrInvalidProfiles, profile.Name)
+	}
+
+	tmpl, err := template.New(profile.Name).
+		Option("missingkey=error").
+		Funcs(instructionFuncs).
+		Parse(profile.Instruction)
+	if err != nil {
+		return resolvedProfile{}, fmt.Errorf("%w; profile %s: bad instruction template: %w",
+			ErrInvalidProfiles, profile.Name, err)
+	}
+	return resolvedProfile{AgentProfile: profile, instruction: tmpl}, nil
+}
+
+// The profile used without a profiles file, from the environment and the built-in
+// instruction.
+func builtinProfile(cfg AgentBackendConfig) AgentProfile {
+	topK := cfg.ToolTopK
+	return AgentProfile{
+		Name:           "default",
+		Model:          cfg.Model,
+		FallbackModels: cfg.FallbackModels,
+		AgentName:      "Fox",
+		Instruction:    agentInstruction,
+		Knowledgebases: []ProfileKnowledgebase{
+			{ID: cosmosKnowledgebaseID, Description: cosmosKnowledgebaseDesc},
+		},
+		ToolTopK: &topK,
+	}
+}
+
+// How often the profiles file is checked for changes.
+const profileReloadInterval = 2 * time.Second
+
+// ProfileStore holds the profiles from a file and reloads them when the file changes.
+// The modification time is checked on use, at most every profileReloadInterval, so
+// there's no watcher to manage.
+//
+// A file that fails to load is logged and the previous profiles stay in use.
+type ProfileStore struct {
+	path    string
+	builtin resolvedProfile
+
+	mu        sync.Mutex
+	set       *profileSet
+	modTime   time.Time
+	lastCheck time.Time
+	// Names of the functions profiles may enable. Nil until SetFunctions.
+	functions []string
+}
+
+// Load the profiles file. Unlike reloads, the first load must succeed. With an empty path,
+// there's no file and only the built-in profile is available.
+func LoadProfileStore(path string, builtin AgentProfile) (*ProfileStore, error) {
+	resolved, err := withDefaults(builtin, builtin)
+	if err != nil {
+		return nil, err
+	}
+	ps := &ProfileStore{path: path, builtin: resolved}
+	if err := ps.load(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *ProfileStore) load() error {
+	if ps.path == "" {
+		ps.set = &profileSet{}
+		return nil
+	}
+	info, err := os.Stat(ps.path)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles: %w", err)
+	}
+	data, err := os.ReadFile(ps.path)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles: %w", err)
+	}
+	set, err := parseProfiles(data, ps.builtin.AgentProfile, ps.functions)
+	if err != nil {
+		return err
+	}
+	ps.set = set
+	ps.modTime = info.ModTime()
+	return nil
+}
+
+// Set the names of the functions that profiles may enable. The profiles are loaded
+// before the functions are registered, so the loaded ones are checked here, and every
+// reload after this is checked too.
+func (ps *ProfileStore) SetFunctions(functions []string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if err := ps.set.checkFunctions(functions); err != nil {
+		return err
+	}
+	ps.functions = functions
+	return nil
+}
+
+// Return the current profiles, reloading the file first if it has changed.
+func (ps *ProfileStore) current() *profileSet {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.path == "" || time.Since(ps.lastCheck) < profileReloadInterval {
+		return ps.set
+	}
+	ps.lastCheck = time.Now()
+
+	info, err := os.Stat(ps.path)
+	if err != nil {
+		log.WithError(err).Error("failed to check profiles file; keeping the loaded profiles")
+		return ps.set
+	}
+	if info.ModTime().Equal(ps.modTime) {
+		return ps.set
+	}
+	if err := ps.load(); err != nil {
+		log.WithError(err).Error("failed to reload profiles; keeping the loaded profiles")
+		// Don't retry until the file changes again.
+		ps.modTime = info.ModTime()
+		return ps.set
+	}
+	log.WithField("profiles", len(ps.set.profiles)).Info("reloaded agent profiles")
+	return ps.set
+}
+
+// Return the profile to use for a request. An explicit name must exist. Otherwise the
+// org's default is used, then the file's default, then the built-in profile.
+func (ps *ProfileStore) Resolve(orgID uuid.UUID, name string) (resolvedProfile, error) {
+	set := ps.current()
+	if name == "" {
+		name = set.orgs[orgID]
+	}
+	if name == "" {
+		name = set.config.DefaultProfile
+	}
+	if profile, ok := set.profiles[name]; ok {
+		return profile, nil
+	}
+	// The file may define its own "default", but if it doesn't, that's the built-in one.
+	if name == "" || name == ps.builtin.Name {
+		return ps.builtin, nil
+	}
+	return resolvedProfile{}, fmt.Errorf("%w; %s", ErrUnknownProfile, name)
+}
+
+// Render the profile's instruction for a request.
+func (p resolvedProfile) renderInstruction(data InstructionData) (string, error) {
+	var sb strings.Builder
+	if err := p.instruction.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("failed to render instruction for profile %s: %w", p.Name, err)
+	}
+	return sb.String(), nil
+}
+
+// The profile's time budget for a question. Zero uses the agent's default.
+func (p resolvedProfile) maxDuration() time.Duration {
+	return time.Duration(p.MaxDurationSeconds) * time.Second
+}
+
+// Returns true if the profile allows the function. Used to filter tool selection.
+func (p resolvedProfile) allowsFunction(name string) bool {
+	return len(p.Functions) == 0 || slices.Contains(p.Functions, name)
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+)
+
+func testBuiltinProfile() AgentProfile {
+	return builtinProfile(AgentBackendConfig{Model: "builtin-model", ToolTopK: 5})
+}
+
+const testProfiles = `
+default_profile: standard
+org_profiles:
+  11111111-1111-1111-1111-111111111111: assets-only
+profiles:
+  - name: standard
+  - name: assets-only
+    model: small-model
+    functions: [query_assets]
+    tool_top_k: 0
+    max_tool_rounds: 5
+    instruction: "Help {{.OrgName}}."
+`
+
+// Names of the functions the test profiles may enable.
+var testFunctionNames = []string{"query_assets", "search_documentation", "get_assets_overview_link"}
+
+func TestParseProfiles(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// Empty if the file is valid.
+		err string
+	}{
+		{"valid", testProfiles, ""},
+		{"empty", "", ""},
+		{"not YAML", "profiles: [", "invalid profiles file"},
+		{"no name", "profiles:\n  - model: m", "every profile needs a name"},
+		{"duplicate", "profiles:\n  - name: a\n  - name: a", "duplicate profile a"},
+		{"unknown default", "default_profile: b\nprofiles:\n  - name: a", "default_profile b is not defined"},
+		{"bad org ID", "org_profiles:\n  acme: a\nprofiles:\n  - name: a", `key "acme" is not an org ID`},
+		{
+			"unknown org profile",
+			"org_profiles:\n  11111111-1111-1111-1111-111111111111: b\nprofiles:\n  - name: a",
+			"profile b for org 11111111-1111-1111-1111-111111111111 is not defined",
+		},
+		{"negative limit", "profiles:\n  - name: a\n    max_tool_calls: -1", "limits can't be negative"},
+		{"bad template", "profiles:\n  - name: a\n    instruction: \"{{.OrgName\"", "bad instruction template"},
+		{"unknown function", "profiles:\n  - name: a\n    functions: [query_asset]", "profile a: unknown function query_asset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseProfiles([]byte(tt.data), testBuiltinProfile(), testFunctionNames)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected the file to parse, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error with %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParseProfilesDefaults(t *testing.T) {
+	set, err := parseProfiles([]byte(testProfiles), testBuiltinProfile(), nil)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	// Empty fields come from the built-in profile.
+	standard := set.profiles["standard"]
+	if standard.Model != "builtin-model" || standard.AgentName != "Fox" || *standard.ToolTopK != 5 ||
+		len(standard.Knowledgebases) != 1 {
+		t.Errorf("unexpected standard profile %+v", standard.AgentProfile)
+	}
+	assets := set.profiles["assets-only"]
+	if assets.Model != "small-model" || *assets.ToolTopK != 0 || assets.MaxToolRounds != 5 {
+		t.Errorf("unexpected assets-only profile %+v", assets.AgentProfile)
+	}
+	instruction, err := assets.renderInstruction(InstructionData{OrgName: "Acme"})
+	if err != nil || instruction != "Help Acme." {
+		t.Errorf("unexpected instruction %q (%v)", instruction, err)
+	}
+}
+
+// Write the profiles file with a modification time that's different from the last one.
+func writeProfiles(t *testing.T, path string, data string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProfileStoreResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	noDefault := strings.Replace(testProfiles, "default_profile: standard", "", 1)
+	// "default" is defined by the file in place of the built-in one.
+	ownDefault := testProfiles + "  - name: default\n    model: file-default\n"
+
+	tests := []struct {
+		name    string
+		file    string
+		orgID   uuid.UUID
+		profile string
+		want    string
+		err     error
+	}{
+		{"explicit", testProfiles, testOrg, "standard", "standard", nil},
+		{"explicit unknown", testProfiles, testOrg, "nope", "", ErrUnknownProfile},
+		{"explicit built-in", testProfiles, testOrg, "default", "builtin-model", nil},
+		{"explicit default from the file", ownDefault, otherOrg, "default", "file-default", nil},
+		{"org default", testProfiles, testOrg, "", "assets-only", nil},
+		{"file default", testProfiles, otherOrg, "", "standard", nil},
+		{"built-in", noDefault, otherOrg, "", "builtin-model", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeProfiles(t, path, tt.file, time.Now())
+			store, err := LoadProfileStore(path, testBuiltinProfile())
+			if err != nil {
+				t.Fatalf("load failed: %v", err)
+			}
+
+			profile, err := store.Resolve(tt.orgID, tt.profile)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			// The built-in and file "default" profiles are told apart by model.
+			got := profile.Name
+			if got == "default" {
+				got = profile.Model
+			}
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProfileStoreKeepsProfilesAfterBadReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	writeProfiles(t, path, testProfiles, modTime)
+	store, err := LoadProfileStore(path, testBuiltinProfile())
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	reload := func(data string) {
+		modTime = modTime.Add(time.Minute)
+		writeProfiles(t, path, data, modTime)
+		// Don't wait for the reload interval.
+		store.lastCheck = time.Time{}
+	}
+
+	reload("profiles:\n  - name: standard\n  - name: standard\n")
+	if _, err := store.Resolve(otherOrg, "assets-only"); err != nil {
+		t.Fatalf("expected the previous profiles after a bad reload, got %v", err)
+	}
+
+	reload("profiles:\n  - name: fixed\n")
+	if _, err := store.Resolve(otherOrg, "fixed"); err != nil {
+		t.Fatalf("expected the fixed file to load, got %v", err)
+	}
+	if _, err := store.Resolve(otherOrg, "assets-only"); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("expected assets-only to be gone, got %v", err)
+	}
+}
+
+func TestProfileStoreChecksFunctions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	writeProfiles(t, path, testProfiles, modTime)
+	store, err := LoadProfileStore(path, testBuiltinProfile())
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	// The profiles are loaded before the functions are known, so they're checked when
+	// the functions are set.
+	if err := store.SetFunctions([]string{"search_documentation"}); !errors.Is(err, ErrInvalidProfiles) {
+		t.Fatalf("expected ErrInvalidProfiles for query_assets, got %v", err)
+	}
+	if err := store.SetFunctions(testFunctionNames); err != nil {
+		t.Fatalf("set functions failed: %v", err)
+	}
+
+	// A reload that enables an unknown function keeps the previous profiles.
+	writeProfiles(t, path, "profiles:\n  - name: typo\n    functions: [query_asset]\n", modTime.Add(time.Minute))
+	store.lastCheck = time.Time{}
+	if _, err := store.Resolve(otherOrg, "assets-only"); err != nil {
+		t.Fatalf("expected the previous profiles after a bad reload, got %v", err)
+	}
+	if _, err := store.Resolve(otherOrg, "typo"); !errors.Is(err, ErrUnknownProfile) {
+		t.Errorf("expected the bad profile to be rejected, got %v", err)
+	}
+}
+
+func TestSelectFunctionsWithoutSelector(t *testing.T) {
+	fs := bricks.NewFunctionSet("cosmos")
+	for _, name := range []string{"query_assets", "search_documentation", "get_assets_overview_link"} {
+		fs.AddFunction(name, "", "", struct{}{}, nil)
+	}
+	s := &MainService{functions: fs}
+
+	tests := []struct {
+		name      string
+		functions []string
+		want      string
+	}{
+		{"every function", nil, "get_assets_overview_link,query_assets,search_documentation"},
+		{"profile functions", []string{"query_assets", "missing"}, "query_assets"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := resolvedProfile{AgentProfile: AgentProfile{Functions: tt.functions}}
+			var names []string
+			for name := range s.selectFunctions(t.Context(), "question", profile).Functions {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != tt.want {
+				t.Errorf("expected %s, got %v", tt.want, names)
+			}
+		})
+	}
+}
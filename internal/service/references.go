@@ -0,0 +1,218 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+)
+
+// Reference types. Knowledgebase references are recorded by the agents; the functions add
+// the others with bricks.FunctionContext.AddReference.
+const (
+	RefKnowledgebase  = bricks.ReferenceKnowledgebase
+	RefAsset          = "asset"
+	RefQuery          = "query"
+	RefOverviewLink   = "overview_link"
+	RefEmergingThreat = "emerging_threat"
+)
+
+// A documentation section. The Bedrock knowledgebase is ingested with these two metadata
+// fields (see knowledgebase/create-kb.py), and search_documentation returns the same.
+type KnowledgebaseRef struct {
+	Folder string `json:"folder"`
+	// The section header, including the leading #s.
+	Header string `json:"header"`
+}
+
+// Deduplicated by section.
+func (r KnowledgebaseRef) Reference() bricks.Reference {
+	return bricks.Reference{
+		Type: RefKnowledgebase,
+		Key:  r.Folder + "#" + r.Header,
+		Data: map[string]string{"folder": r.Folder, "header": r.Header},
+	}
+}
+
+// An asset a function returned, e.g., a row of a query_assets result.
+type AssetRef struct {
+	ID   string `json:"id"`
+	Type string `json:"type,omitempty"`
+	// Link to the asset in the UI, from tbl_assets. May be empty.
+	Link string `json:"link,omitempty"`
+}
+
+// Deduplicated by asset ID, so the same asset found by different queries is listed once.
+func (r AssetRef) Reference() bricks.Reference {
+	return bricks.Reference{
+		Type: RefAsset,
+		Key:  strings.ToLower(r.ID),
+		Data: map[string]string{"id": r.ID, "type": r.Type, "link": r.Link},
+	}
+}
+
+// A query_assets query that ran successfully.
+type QueryRef struct {
+	SQL       string `json:"sql"`
+	Rows      int    `json:"rows"`
+	Truncated bool   `json:"truncated"`
+}
+
+var sqlSpacePattern = regexp.MustCompile(`\s+`)
+
+// Deduplicated by the SQL with whitespace and a trailing semicolon ignored, since the
+// model often runs the same query again with different formatting.
+func (r QueryRef) Reference() bricks.Reference {
+	key := sqlSpacePattern.ReplaceAllString(strings.TrimSpace(r.SQL), " ")
+	key = strings.TrimSpace(strings.TrimSuffix(key, ";"))
+	return bricks.Reference{
+		Type: RefQuery,
+		Key:  key,
+		Data: map[string]string{
+			"sql":       r.SQL,
+			"rows":      strconv.Itoa(r.Rows),
+			"truncated": strconv.FormatBool(r.Truncated),
+		},
+	}
+}
+
+// A link to an asset overview page from get_assets_overview_link.
+type OverviewLinkRef struct {
+	AssetType string `json:"asset_type"`
+	URL       string `json:"url"`
+}
+
+// Deduplicated by URL; the same page with other filters is a different link.
+func (r OverviewLinkRef) Reference() bricks.Reference {
+	return bricks.Reference{
+		Type: RefOverviewLink,
+		Key:  r.URL,
+		Data: map[string]string{"asset_type": r.AssetType, "url": r.URL},
+	}
+}
+
+// An emerging threat from get_latest_emerging_threats.
+type EmergingThreatRef struct {
+	// The threat ID, e.g., et-00171.
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	CVE   string `json:"cve,omitempty"`
+}
+
+// Deduplicated by threat ID.
+func (r EmergingThreatRef) Reference() bricks.Reference {
+	return bricks.Reference{
+		Type: RefEmergingThreat,
+		Key:  r.ID,
+		Data: map[string]string{"id": r.ID, "title": r.Title, "cve": r.CVE},
+	}
+}
+
+// A reference as returned by Ask. Every reference has a title, and a URL when it can be
+// opened in the UI. The details are in the field named after the type; the others are
+// nil.
+type AskReference struct {
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	URL   string `json:"url,omitempty"`
+
+	Knowledgebase  *KnowledgebaseRef  `json:"knowledgebase,omitempty"`
+	Asset          *AssetRef          `json:"asset,omitempty"`
+	Query          *QueryRef          `json:"query,omitempty"`
+	OverviewLink   *OverviewLinkRef   `json:"overview_link,omitempty"`
+	EmergingThreat *EmergingThreatRef `json:"emerging_threat,omitempty"`
+}
+
+// The legacy form of the reference used in AskResult.Refs: "Title - URL". Returns false
+// for references without a URL, since clients show the legacy refs as links.
+func (r AskReference) legacyRef() (string, bool) {
+	if r.URL == "" {
+		return "", false
+	}
+	return fmt.Sprintf("%s - %s", r.Title, r.URL), true
+}
+
+// How many characters of the SQL a query reference title can have.
+const maxQueryTitleLength = 80
+
+// Turn a reference from the agent into an AskReference. Knowledgebase references are
+// linked to the documentation in the UI.
+//
+// Returns false for unknown types and references missing the fields they need.
+func renderReference(ref bricks.Reference, orgID uuid.UUID) (AskReference, bool) {
+	data := ref.Data
+	out := AskReference{Type: ref.Type}
+	switch ref.Type {
+	case RefKnowledgebase:
+		kb := KnowledgebaseRef{Folder: data["folder"], Header: data["header"]}
+		if kb.Folder == "" || kb.Header == "" {
+			return AskReference{}, false
+		}
+		out.Knowledgebase = &kb
+		out.Title = formatRefTitle(kb.Header)
+		out.URL = documentationURL(orgID, kb.Folder, kb.Header)
+	case RefAsset:
+		asset := AssetRef{ID: data["id"], Type: data["type"], Link: data["link"]}
+		if asset.ID == "" {
+			return AskReference{}, false
+		}
+		out.Asset = &asset
+		out.Title = "Asset " + asset.ID
+		if asset.Type != "" {
+			out.Title = fmt.Sprintf("%s (%s)", out.Title, asset.Type)
+		}
+		out.URL = asset.Link
+	case RefQuery:
+		rows, _ := strconv.Atoi(data["rows"])
+		query := QueryRef{SQL: data["sql"], Rows: rows, Truncated: data["truncated"] == "true"}
+		if query.SQL == "" {
+			return AskReference{}, false
+		}
+		out.Query = &query
+		sql := sqlSpacePattern.ReplaceAllString(strings.TrimSpace(query.SQL), " ")
+		out.Title = "Asset query: " + truncateRunes(sql, maxQueryTitleLength)
+	case RefOverviewLink:
+		link := OverviewLinkRef{AssetType: data["asset_type"], URL: data["url"]}
+		if link.URL == "" {
+			return AskReference{}, false
+		}
+		out.OverviewLink = &link
+		out.Title = "Assets overview"
+		if link.AssetType != "" {
+			out.Title = fmt.Sprintf("Assets overview (%s)", link.AssetType)
+		}
+		out.URL = link.URL
+	case RefEmergingThreat:
+		threat := EmergingThreatRef{ID: data["id"], Title: data["title"], CVE: data["cve"]}
+		if threat.ID == "" {
+			return AskReference{}, false
+		}
+		out.EmergingThreat = &threat
+		out.Title = "Emerging threat " + threat.ID
+		if threat.Title != "" {
+			out.Title += ": " + threat.Title
+		}
+	default:
+		return AskReference{}, false
+	}
+	return out, true
+}
+
+// Append the references in more that aren't in refs yet, e.g., from a follow-up query in
+// the same request.
+func mergeReferences(refs []bricks.Reference, more []bricks.Reference) []bricks.Reference {
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		seen[ref.Type+"\x00"+ref.Key] = true
+	}
+	for _, ref := range more {
+		if !seen[ref.Type+"\x00"+ref.Key] {
+			seen[ref.Type+"\x00"+ref.Key] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
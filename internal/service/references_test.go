@@ -0,0 +1,174 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func TestRenderReference(t *testing.T) {
+	// Cut at 80 characters, not bytes, so the title stays valid UTF-8.
+	longSQL := "SELECT id,\n  type FROM tbl_assets WHERE details->>'name' = '" + strings.Repeat("é", 80) + "'"
+	longTitle := "Asset query: SELECT id, type FROM tbl_assets WHERE details->>'name' = '" +
+		strings.Repeat("é", 80-len("SELECT id, type FROM tbl_assets WHERE details->>'name' = '")) + "..."
+	tests := []struct {
+		name string
+		ref  bricks.Reference
+		want AskReference
+		ok   bool
+	}{
+		{
+			"knowledgebase",
+			KnowledgebaseRef{Folder: "cosmos-documentation", Header: "## Azure Connector"}.Reference(),
+			AskReference{
+				Type:          RefKnowledgebase,
+				Title:         "Azure Connector",
+				URL:           "https://ui.api.non.usea2.bf9.io/" + testOrg.String() + "/documentation/cosmos-documentation#%23%23azure-connector",
+				Knowledgebase: &KnowledgebaseRef{Folder: "cosmos-documentation", Header: "## Azure Connector"},
+			},
+			true,
+		},
+		{"knowledgebase without a header", KnowledgebaseRef{Folder: "docs"}.Reference(), AskReference{}, false},
+		{
+			"asset",
+			AssetRef{ID: "A1B2", Type: "domain", Link: "https://example.com/a1b2"}.Reference(),
+			AskReference{
+				Type:  RefAsset,
+				Title: "Asset A1B2 (domain)",
+				URL:   "https://example.com/a1b2",
+				Asset: &AssetRef{ID: "A1B2", Type: "domain", Link: "https://example.com/a1b2"},
+			},
+			true,
+		},
+		{
+			"asset without type or link",
+			AssetRef{ID: "a1b2"}.Reference(),
+			AskReference{Type: RefAsset, Title: "Asset a1b2", Asset: &AssetRef{ID: "a1b2"}},
+			true,
+		},
+		{"asset without an ID", AssetRef{Type: "domain"}.Reference(), AskReference{}, false},
+		{
+			"query",
+			QueryRef{SQL: "SELECT *\n  FROM tbl_assets;", Rows: 12, Truncated: true}.Reference(),
+			AskReference{
+				Type:  RefQuery,
+				Title: "Asset query: SELECT * FROM tbl_assets;",
+				Query: &QueryRef{SQL: "SELECT *\n  FROM tbl_assets;", Rows: 12, Truncated: true},
+			},
+			true,
+		},
+		{
+			"long query",
+			QueryRef{SQL: longSQL, Rows: 1}.Reference(),
+			AskReference{
+				Type:  RefQuery,
+				Title: longTitle,
+				Query: &QueryRef{SQL: longSQL, Rows: 1},
+			},
+			true,
+		},
+		{"query without SQL", QueryRef{Rows: 3}.Reference(), AskReference{}, false},
+		{
+			"overview link",
+			OverviewLinkRef{AssetType: "subdomain", URL: "https://example.com/overview"}.Reference(),
+			AskReference{
+				Type:         RefOverviewLink,
+				Title:        "Assets overview (subdomain)",
+				URL:          "https://example.com/overview",
+				OverviewLink: &OverviewLinkRef{AssetType: "subdomain", URL: "https://example.com/overview"},
+			},
+			true,
+		},
+		{"overview link without a URL", OverviewLinkRef{AssetType: "port"}.Reference(), AskReference{}, false},
+		{
+			"emerging threat",
+			EmergingThreatRef{ID: "et-00171", Title: "Citrix Bleed", CVE: "CVE-2023-4966"}.Reference(),
+			AskReference{
+				Type:           RefEmergingThreat,
+				Title:          "Emerging threat et-00171: Citrix Bleed",
+				EmergingThreat: &EmergingThreatRef{ID: "et-00171", Title: "Citrix Bleed", CVE: "CVE-2023-4966"},
+			},
+			true,
+		},
+		{"emerging threat without an ID", EmergingThreatRef{Title: "Citrix Bleed"}.Reference(), AskReference{}, false},
+		{"unknown type", bricks.Reference{Type: "record", Key: "a"}, AskReference{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := renderReference(tt.ref, testOrg)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%v, got %v", tt.ok, ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReferenceKeys(t *testing.T) {
+	// The same source gives the same key, so it's listed once.
+	tests := []struct {
+		name string
+		a, b bricks.Reference
+	}{
+		{"asset ID case", AssetRef{ID: "A1B2"}.Reference(), AssetRef{ID: "a1b2", Type: "domain"}.Reference()},
+		{
+			"query formatting",
+			QueryRef{SQL: "SELECT *\n FROM tbl_assets;"}.Reference(),
+			QueryRef{SQL: "  SELECT * FROM tbl_assets", Rows: 2}.Reference(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.a.Key != tt.b.Key {
+				t.Errorf("expected the same key, got %q and %q", tt.a.Key, tt.b.Key)
+			}
+		})
+	}
+}
+
+func TestLegacyRef(t *testing.T) {
+	// Only references with a URL are listed in the legacy refs.
+	tests := []struct {
+		name string
+		ref  AskReference
+		want string
+		ok   bool
+	}{
+		{"with a URL", AskReference{Title: "Azure Connector", URL: "https://example.com/docs"}, "Azure Connector - https://example.com/docs", true},
+		{"without a URL", AskReference{Title: "Asset query: SELECT 1"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.ref.legacyRef()
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("expected %q, %v, got %q, %v", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestAssetRefs(t *testing.T) {
+	result := QueryAssetsResult{Columns: []string{"id", "type"}}
+	result.Rows = append(result.Rows, []string{"not an asset", "domain"})
+	for i := range maxAssetRefsPerQuery + 5 {
+		result.Rows = append(result.Rows, []string{fmt.Sprintf("00000000-0000-0000-0000-%012d", i), "domain"})
+	}
+
+	refs := result.AssetRefs()
+	if len(refs) != maxAssetRefsPerQuery {
+		t.Fatalf("expected %d refs, got %d", maxAssetRefsPerQuery, len(refs))
+	}
+	if refs[0].ID != "00000000-0000-0000-0000-000000000000" || refs[0].Type != "domain" {
+		t.Errorf("unexpected first ref %+v", refs[0])
+	}
+
+	aliased := QueryAssetsResult{Columns: []string{"asset_id"}, Rows: [][]string{{"00000000-0000-0000-0000-000000000001"}}}
+	if refs := aliased.AssetRefs(); len(refs) != 0 {
+		t.Errorf("expected no refs without an id column, got %v", refs)
+	}
+}
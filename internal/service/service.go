@@ -3,6 +3,7 @@
 package service
 
 import (
+	"cmp"
 	"context"
 	_ "embed"
 	"errors"
@@ -10,10 +11,10 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	brtypes "github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
 
 	"github.com/google/uuid"
@@ -42,29 +43,54 @@ type QueryContext struct {
 	Service       Service
 }
 
-// A reference points to a source of information used in generating a response.
-//
-// Currently we have Bedrock Citations stored in here as type "knowledgebase". Our service
-// formats those as a title and URL.
-type Reference struct {
-	Type string `json:"type"`
-	Ref  string `json:"ref"`
-}
-
 // Result of the Ask function. Contains the response, a session ID for making further
 // requests (which can be set initially by the caller), and any references used.
 type AskResult struct {
-	Response  string   `json:"response"`
-	Refs      []string `json:"refs"`
-	SessionID string   `json:"session_id"`
+	Response string `json:"response"`
+	// The sources with a URL used in the answer, in their legacy "Title - URL" form. See
+	// References for all of them.
+	Refs []string `json:"refs"`
+	// The same sources with their details, e.g., the asset IDs or the SQL of a query.
+	References []AskReference `json:"references"`
+	SessionID  string         `json:"session_id"`
+	// Functions the agent called while answering. Only the Bedrock backend records
+	// these currently.
+	ToolCalls []bricks.ToolCall `json:"tool_calls,omitempty"`
+	// Token usage and estimated cost of this request and the session so far.
+	Usage AskUsage `json:"usage"`
+	// Whether a content filter or guardrail intervened. One of the AskState* constants.
+	State string `json:"state"`
+	// The answer in structured form, when AskOptions.Structured is set and the agent
+	// produced a valid one. Response then holds the summary.
+	Structured *StructuredAnswer `json:"structured,omitempty"`
+}
+
+// Optional settings for an Ask request.
+type AskOptions struct {
+	// When set, receives answer text, tool activity and references while the answer is
+	// being produced. For reference events, the event Text holds the same legacy form
+	// used in AskResult.Refs, or is empty if the reference has no URL. References that
+	// can't be rendered aren't sent.
+	OnEvent bricks.StreamHandler
+	// Agent profile to use. Empty uses the org's default profile. See ProfileStore.
+	Profile string
+	// Ask the agent for a StructuredAnswer instead of free text. Answer text isn't
+	// streamed in this mode, since it's JSON; the other events are.
+	Structured bool
 }
 
 // Service interface for consumers.
 type Service interface {
-	Ask(ctx context.Context, query string, orgID uuid.UUID, authorization string, sessionID string) (AskResult, error)
-	SetFunctions(*bricks.FunctionSet)
+	Ask(ctx context.Context, query string, orgID uuid.UUID, authorization string, sessionID string, opts AskOptions) (AskResult, error)
+	SetFunctions(*bricks.FunctionSet) error
+	// Compose the prompt Ask would use for the question, without asking it.
+	DebugPrompt(ctx context.Context, query string, orgID uuid.UUID, profile string) (PromptDebug, error)
 
 	QueryAssets(ctx context.Context, orgID uuid.UUID, query string) (QueryAssetsResult, error)
+	SearchDocumentation(ctx context.Context, orgID uuid.UUID, query string) ([]DocumentationResult, error)
+	// Show a session's size and compaction digest. Returns ErrSessionNotFound for
+	// sessions of other orgs or users.
+	GetSession(ctx context.Context, orgID uuid.UUID, authorization string, sessionID string) (SessionInfo, error)
 }
 
 //go:embed agent_instructions.txt
@@ -72,10 +98,52 @@ var agentInstruction string
 
 // Main/default service implementation.
 type MainService struct {
-	// This is the complete function set available in the service. Depending on the
-	// request certain functions could be excluded for context space optimization or
-	// permission. (Not implemented in this prototype.)
+	// This is the complete function set available in the service. Each request gets the
+	// subset most relevant to the question (see toolSelector). Excluding functions by
+	// permission is not implemented in this prototype.
 	functions *bricks.FunctionSet
+
+	// Picks the functions relevant to each question. Built from functions in
+	// SetFunctions. If nil, every function is used.
+	toolSelector *bricks.ToolSelector
+
+	// Which agent backend Ask uses, loaded from the environment.
+	agentConfig AgentBackendConfig
+
+	// Model, instruction, functions and limits for the agent, picked per request.
+	profiles *ProfileStore
+
+	// Organization details for the agent instruction.
+	orgs OrgDirectory
+
+	// Searches the product documentation for search_documentation. Nil if the
+	// documentation couldn't be loaded.
+	docs bricks.Retriever
+
+	// Conversation histories for the backends that don't keep sessions on the vendor
+	// side. Agents are created per request, so the histories live here.
+	anthropicHistory *bricks.SessionHistory[bricks.AnthropicMessage]
+	openAIHistory    *bricks.SessionHistory[bricks.OpenAIMessage]
+	converseHistory  *bricks.SessionHistory[brtypes.Message]
+
+	// Token usage per session.
+	usage *usageTracker
+
+	// Every turn of every session, so context can be restored after the backend's own
+	// session state expires.
+	sessions SessionStore
+
+	// Sessions are compacted once a request uses this many input tokens. 0 disables
+	// compaction.
+	compactionTokens int64
+
+	// Content filter chains for questions and answers. See AddQuestionFilter and
+	// AddAnswerFilter.
+	questionFilters []namedFilter
+	answerFilters   []namedFilter
+
+	// Wraps every agent created by Ask. See UseAgentMiddleware.
+	agentMiddleware []bricks.AgentMiddleware
 }
 
 var ErrSelfCheckFailed = errors.New("self check failed")
@@ -88,13 +156,53 @@ func (s *MainService) getDBUrl() string {
 
 // Create the service.
 func CreateMainService() (Service, error) {
-	svc := &MainService{}
+	svc := &MainService{
+		anthropicHistory: bricks.NewSessionHistory[bricks.AnthropicMessage](),
+		openAIHistory:    bricks.NewSessionHistory[bricks.OpenAIMessage](),
+		converseHistory:  bricks.NewSessionHistory[brtypes.Message](),
+		usage:            newUsageTracker(),
+	}
 
 	// Self Test
 	if svc.getDBUrl() == "" {
 		return nil, fmt.Errorf("%w; POSTGRES_URL needs to be set to the database connection URL", ErrSelfCheckFailed)
 	}
 
+	agentConfig, err := agentBackendConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	svc.agentConfig = agentConfig
+	profiles, err := LoadProfileStore(os.Getenv("AGENT_PROFILES"), builtinProfile(agentConfig))
+	if err != nil {
+		return nil, fmt.Errorf("%w; failed to load AGENT_PROFILES: %w", ErrSelfCheckFailed, err)
+	}
+	svc.profiles = profiles
+	svc.sessions = newPGSessionStore(svc.getDBUrl())
+	svc.compactionTokens = defaultCompactionTokens
+	if tokens := os.Getenv("SESSION_COMPACTION_TOKENS"); tokens != "" {
+		n, err := strconv.ParseInt(tokens, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w; SESSION_COMPACTION_TOKENS must be a non-negative integer", ErrSelfCheckFailed)
+		}
+		svc.compactionTokens = n
+	}
+	svc.orgs = newPGOrgDirectory(svc.getDBUrl())
+
+	// Documentation search is an extra, so the service still starts without it.
+	docsPath := cmp.Or(os.Getenv("DOCS_PATH"), defaultDocsPath)
+	if docs, err := loadDocumentation(docsPath); err != nil {
+		log.WithError(err).Warn("documentation search disabled")
+	} else {
+		svc.docs = bricks.NewBM25Retriever(docs)
+		log.WithField("sections", len(docs)).Info("documentation indexed")
+	}
+	svc.AddAnswerFilter("other_org_links", otherOrgLinkFilter)
+	svc.UseAgentMiddleware(bricks.LogQueries)
+	log.WithField("backend", agentConfig.Backend).
+		WithField("model", agentConfig.Model).
+		Info("agent backend configured")
+
 	return svc, nil
 }
 
@@ -121,98 +229,181 @@ func formatRefAnchor(header string) string {
 // Ask a question. The authorization string is the user's token to be forwarded to API
 // requests if necessary.
 func (s *MainService) Ask(ctx context.Context, query string, orgID uuid.UUID,
-	authorization string, sessionID string) (AskResult, error) {
+	authorization string, sessionID string, opts AskOptions) (AskResult, error) {
 	log.WithField("org", orgID).Debug("processing ask:", query)
 
 	if sessionID == "" {
 		sessionID = uuid.New().String()
 	}
+	stored, err := s.checkSessionOwner(ctx, orgID, authorization, sessionID)
+	if err != nil {
+		return AskResult{}, err
+	}
+	agentSession := agentSessionID(orgID, sessionID)
+	profile, err := s.profiles.Resolve(orgID, opts.Profile)
+	if err != nil {
+		return AskResult{}, err
+	}
 
-	// In the future, we might want to have a dynamic function set, created each time an
-	// ask request comes in. This way, you can select what tools are most relevant and
-	// omit the rest to save context space.
-	//
-	// A good approach to selecting relevant tools is to vectorize the user input and
-	// compare against the function descriptions.
-	//
-	// In addition, we may want to set the agent system instruction or other configuration
-	// dynamically based on the request and user context. e.g., adding system instructions
-	// for complex tool selections, or defining user context information such as the
-	// organization name.
-	fs := s.functions
-
-	// Bedrock has a limit of how much text can be part of an action description. We have
-	// the "extended description" in the tool instruction section to work around this.
-	//
-	// With dynamic tool selection, only tools that are included for the query should
-	// affect the system prompt.
-	for _, fn := range fs.Functions {
-		if fn.ExtendedDescription != "" {
-			agentInstruction += fmt.Sprintf("<toolInstructions>\n%s\n</toolInstructions>", fn.ExtendedDescription)
+	query, questionState, err := runFilters(ctx, s.questionFilters, "question", orgID, query)
+	if err != nil {
+		return AskResult{}, err
+	}
+	if questionState == AskStateBlocked {
+		if opts.OnEvent != nil {
+			opts.OnEvent(bricks.StreamEvent{Type: bricks.StreamEventText, Text: query})
 		}
+		return AskResult{
+			Response:  query,
+			SessionID: sessionID,
+			Usage:     s.recordUsage(orgID, agentSession, "", bricks.Usage{}),
+			State:     AskStateBlocked,
+		}, nil
 	}
 
-	agent := bricks.NewBedrockAgent(bricks.BedrockAgentConfig{
-		// Claude 3.7 is deprecated, but using an old/cheaper model to see how robust it
-		// is.
-		Model:       "us.anthropic.claude-3-7-sonnet-20250219-v1:0",
-		Instruction: agentInstruction,
-		AgentName:   "Fox",
-		Functions:   fs,
-
-		// Link to our knowledgebase. To see how this knowledgebase is built, see the
-		// knowledgebase folder. We also have a video on it.
-		Knowledgebases: []types.KnowledgeBase{
-			{
-				Description:     aws.String("Contains documentation on the Cosmos platform, helpful for resolving user queries about platform functionality"),
-				KnowledgeBaseId: aws.String("CETGU0P5D7"),
-			},
-		},
-	})
+	// The profile, functions and instruction are put together fresh for each request.
+	setup, err := s.prepareAgent(ctx, orgID, query, profile, opts.Structured)
+	if err != nil {
+		return AskResult{}, err
+	}
+	baseAgent, err := s.newAgent(profile, setup.instruction.String(), setup.functions)
+	if err != nil {
+		return AskResult{}, fmt.Errorf("failed to create agent: %w", err)
+	}
+	agent := bricks.WithMiddleware(baseAgent, s.agentMiddleware...)
 
 	// We pass along user information via the request context which is visible when
 	// invoking tools.
-	response, err := agent.Query(WrapContextForTool(ctx, orgID, authorization, s), query, sessionID)
+	toolCtx := WrapContextForTool(ctx, orgID, authorization, s)
+
+	// Long sessions are compacted into a digest first. If the backend has lost the
+	// session (e.g., Bedrock expires it after 15 minutes), the digest and earlier turns
+	// are summarized into the question. Sessions that aren't stored only have what the
+	// backend remembers.
+	session := sessionContext{backendSession: agentSession, query: query}
+	if stored {
+		session = s.prepareSession(ctx, orgID, sessionID, query, profile)
+	}
+
+	// Agents wrapped with middleware always stream. Backends without streaming support
+	// deliver the whole answer as one text event.
+	var onEvent bricks.StreamHandler
+	if opts.OnEvent != nil {
+		onEvent = func(ev bricks.StreamEvent) {
+			if opts.Structured && ev.Type == bricks.StreamEventText {
+				return
+			}
+			if ev.Type == bricks.StreamEventReference && ev.Ref != nil {
+				ref, ok := renderReference(*ev.Ref, orgID)
+				if !ok {
+					return
+				}
+				ev.Text, _ = ref.legacyRef()
+			}
+			opts.OnEvent(ev)
+		}
+	}
+	response, err := agent.QueryStream(toolCtx, session.query, session.backendSession, onEvent)
 	if err != nil {
 		return AskResult{}, err
 	}
+	if response.BudgetExhausted != "" {
+		log.WithField("org", orgID).Warnf("ask ran out of %s budget: %s", response.BudgetExhausted, query)
+		if response.Response == "" {
+			response.Response = "Sorry, I ran out of time while looking into this. Try asking a narrower question."
+		}
+	}
 
-	// Translate refs to urls. When we ingest the knowledgebase, we are creating two
-	// custom metadata fields: "header" and "folder".
-	//
-	// "header" is the section header delimiting where the content came from.
-	// "folder" is the knowledgebase folder name.
-	//
-	// Transform these two into this format: Title - <URL>
-	//
-	// The URL format is <buaseurl>/<org_id>/documentation/<folder>#<anchor>
+	// Without budget left, there's no point asking the agent to repair its answer.
+	var structured *StructuredAnswer
+	if opts.Structured && response.BudgetExhausted == "" {
+		structured = structuredAnswer(toolCtx, agent, session.backendSession, orgID, &response)
+		if structured != nil {
+			response.Response = structured.Summary
+		}
+	}
+
+	// With streaming, the original answer text has already been sent by now. The done
+	// event carries the filtered answer and the state, which clients should use instead.
+	answer, state, err := runFilters(ctx, s.answerFilters, "answer", orgID, response.Response)
+	if err != nil {
+		return AskResult{}, err
+	}
+	response.Response = answer
+	if structured != nil {
+		if state == AskStateBlocked {
+			structured = nil
+		} else {
+			structured.Summary = answer
+		}
+	}
+	if state == AskStateOK {
+		state = questionState
+	}
+	if response.GuardrailIntervened {
+		log.WithField("org", orgID).Warn("guardrail intervened in ask: ", query)
+		state = AskStateGuardrail
+	}
+
+	references := []AskReference{}
 	var refURLs []string
-	baseUrl := "https://ui.api.non.usea2.bf9.io"
 	for _, ref := range response.Refs {
-		// For now, only handling knowledge base refs
-		if ref.Type == "knowledgebase" {
-			header := ref.Data["header"]
-			folder := ref.Data["folder"]
-			if header == "" || folder == "" {
-				continue
+		if rendered, ok := renderReference(ref, orgID); ok {
+			references = append(references, rendered)
+			if legacy, ok := rendered.legacyRef(); ok {
+				refURLs = append(refURLs, legacy)
 			}
-			url := fmt.Sprintf("%s - %s/%s/documentation/%s#%s",
-				formatRefTitle(header),
-				baseUrl,
-				orgID.String(),
-				folder,
-				formatRefAnchor(header))
-			refURLs = append(refURLs, url)
 		}
 	}
 
+	// How much context the session has now is the input of the request's largest model
+	// call, not the sum of its tool loop. Compacting isn't counted, since its model call
+	// doesn't get the session's context.
+	if stored {
+		s.saveTurn(ctx, SessionTurn{
+			OrgID:         orgID,
+			SessionID:     sessionID,
+			Question:      query,
+			Answer:        response.Response,
+			Refs:          refURLs,
+			ToolCalls:     response.ToolCalls,
+			AssetIDs:      referencedAssetIDs(references),
+			ContextTokens: response.Usage.MaxInputTokens,
+		})
+	}
+
+	// Compacting is part of the cost of the request.
+	response.Usage.Add(session.usage)
+
 	return AskResult{
-		Response:  response.Response,
-		Refs:      refURLs,
-		SessionID: sessionID,
+		Response:   response.Response,
+		Refs:       refURLs,
+		References: references,
+		SessionID:  sessionID,
+		ToolCalls:  response.ToolCalls,
+		Usage:      s.recordUsage(orgID, agentSession, cmp.Or(response.Model, profile.Model), response.Usage),
+		State:      state,
+		Structured: structured,
 	}, nil
 }
 
+// Add middleware to every agent created by Ask, e.g., for metrics or rate limiting.
+// Middleware added first is the outermost.
+func (s *MainService) UseAgentMiddleware(middleware ...bricks.AgentMiddleware) {
+	s.agentMiddleware = append(s.agentMiddleware, middleware...)
+}
+
+// Link to a documentation section in the UI, from a knowledgebase section's "folder" and
+// "header" metadata. The format is <baseurl>/<org_id>/documentation/<folder>#<anchor>.
+func documentationURL(orgID uuid.UUID, folder string, header string) string {
+	baseUrl := "https://ui.api.non.usea2.bf9.io"
+	return fmt.Sprintf("%s/%s/documentation/%s#%s",
+		baseUrl,
+		orgID.String(),
+		folder,
+		formatRefAnchor(header))
+}
+
 // Wrap a given context for a tool call, adding authorization information. This context
 // is passed through the agent to functions. Particularly useful for forwarding user
 // authentication and organization restrictions.
@@ -236,6 +427,63 @@ func MustGetQueryContext(ctx context.Context) QueryContext {
 	return qc
 }
 
-func (s *MainService) SetFunctions(fs *bricks.FunctionSet) {
+// Set the functions the agent may use. Returns an ErrInvalidProfiles error if a profile
+// enables a function that isn't in the set.
+func (s *MainService) SetFunctions(fs *bricks.FunctionSet) error {
+	if s.profiles != nil {
+		names := make([]string, 0, len(fs.Functions))
+		for name := range fs.Functions {
+			names = append(names, name)
+		}
+		if err := s.profiles.SetFunctions(names); err != nil {
+			return err
+		}
+	}
 	s.functions = fs
+
+	// The local embedder needs no network access and can't fail, but an error here
+	// shouldn't stop the service either way. Without a selector, Ask uses every tool.
+	selector, err := bricks.NewToolSelector(context.Background(), nil, fs)
+	if err != nil {
+		log.WithError(err).Error("failed to create tool selector; using all tools")
+		selector = nil
+	}
+	s.toolSelector = selector
+	return nil
+}
+
+// Return the functions to give the agent for the query: the profile's number of most
+// relevant tools among those it enables, or every enabled function if selection fails.
+// Without a selector, every enabled function is used. Never returns nil; before
+// SetFunctions there are no functions to use.
+func (s *MainService) selectFunctions(ctx context.Context, query string, profile resolvedProfile) *bricks.FunctionSet {
+	if s.functions == nil {
+		return bricks.NewFunctionSet("functions")
+	}
+	if s.toolSelector == nil {
+		if len(profile.Functions) == 0 {
+			return s.functions
+		}
+		return s.functions.Filter(profile.allowsFunction)
+	}
+	var keep func(string) bool
+	if len(profile.Functions) > 0 {
+		keep = profile.allowsFunction
+	}
+	fs, err := s.toolSelector.SelectFiltered(ctx, query, *profile.ToolTopK, keep)
+	if err != nil {
+		log.WithError(err).Warn("tool selection failed; using all enabled tools")
+		fs, _ = s.toolSelector.SelectFiltered(ctx, query, 0, keep)
+		return fs
+	}
+	if len(fs.Functions) < len(s.functions.Functions) {
+		names := make([]string, 0, len(fs.Functions))
+		for name := range fs.Functions {
+			names = append(names, name)
+		}
+		log.WithField("tools", names).
+			WithField("profile", profile.Name).
+			Debug("selected tools for ask")
+	}
+	return fs
 }
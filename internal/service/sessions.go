@@ -0,0 +1,451 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+// One question and answer in a session.
+type SessionTurn struct {
+	OrgID     uuid.UUID
+	SessionID string
+	// 1-based position in the session. Assigned by the store when the turn is appended.
+	Turn      int
+	Question  string
+	Answer    string
+	Refs      []string
+	ToolCalls []bricks.ToolCall
+	// Assets referenced in the answer. These are pinned when the session is compacted.
+	AssetIDs []string
+	// Input tokens of the request's largest model call, roughly the size of the
+	// session's context. See bricks.Usage.MaxInputTokens.
+	ContextTokens int64
+	CreatedAt     time.Time
+}
+
+// Persistent conversation history, keyed by org and session ID. The agent backends keep
+// their own session state (Bedrock on the AWS side, the others in memory), but that
+// state expires. The store keeps every turn so context can be restored afterwards.
+type SessionStore interface {
+	// Record that the session belongs to the org and token subject, if it isn't recorded
+	// yet. Returns ErrSessionForbidden if it belongs to someone else.
+	ClaimSession(ctx context.Context, orgID uuid.UUID, subject string, sessionID string) error
+	// Append a turn to the end of its session.
+	AppendTurn(ctx context.Context, turn SessionTurn) error
+	// Load the turns of a session in order. Unknown sessions return no turns.
+	LoadTurns(ctx context.Context, orgID uuid.UUID, sessionID string) ([]SessionTurn, error)
+	// Return the org and token subject that own the session. Returns ErrSessionNotFound
+	// if it hasn't been claimed.
+	SessionOwner(ctx context.Context, sessionID string) (uuid.UUID, string, error)
+	// Load the session's digest. Sessions that were never compacted return a zero
+	// SessionDigest.
+	LoadDigest(ctx context.Context, orgID uuid.UUID, sessionID string) (SessionDigest, error)
+	// Replace the session's digest.
+	SaveDigest(ctx context.Context, orgID uuid.UUID, sessionID string, digest SessionDigest) error
+}
+
+// Returned when a session ID is reused by a different org or user than the one that
+// started it.
+var ErrSessionForbidden = errors.New("session belongs to another user")
+
+// Returned when a session doesn't exist, or isn't visible to the caller.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore backed by the sessions and session_turns tables (config/3.sessions.sql).
+type pgSessionStore struct {
+	url string
+}
+
+func newPGSessionStore(url string) *pgSessionStore {
+	return &pgSessionStore{url: url}
+}
+
+func (st *pgSessionStore) ClaimSession(ctx context.Context, orgID uuid.UUID, subject string, sessionID string) error {
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	// The first request with a session ID claims it. Later ones just read the owner.
+	_, err = conn.Exec(ctx, `
+		INSERT INTO sessions (session_id, org_id, subject) VALUES ($1, $2, $3)
+		ON CONFLICT (session_id) DO NOTHING
+	`, sessionID, orgID, subject)
+	if err != nil {
+		return fmt.Errorf("failed to claim session: %w", err)
+	}
+
+	ownerOrg, ownerSubject, err := readSessionOwner(ctx, conn, sessionID)
+	if err != nil {
+		return err
+	}
+	if ownerOrg != orgID || ownerSubject != subject {
+		return fmt.Errorf("%w; session %s", ErrSessionForbidden, sessionID)
+	}
+	return nil
+}
+
+func (st *pgSessionStore) SessionOwner(ctx context.Context, sessionID string) (uuid.UUID, string, error) {
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+	return readSessionOwner(ctx, conn, sessionID)
+}
+
+func readSessionOwner(ctx context.Context, conn *pgx.Conn, sessionID string) (uuid.UUID, string, error) {
+	var ownerOrg uuid.UUID
+	var ownerSubject string
+	err := conn.QueryRow(ctx, `SELECT org_id, subject FROM sessions WHERE session_id = $1`, sessionID).
+		Scan(&ownerOrg, &ownerSubject)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, "", fmt.Errorf("%w; session %s", ErrSessionNotFound, sessionID)
+	}
+	if err != nil {
+		return uuid.Nil, "", fmt.Errorf("failed to read session owner: %w", err)
+	}
+	return ownerOrg, ownerSubject, nil
+}
+
+func (st *pgSessionStore) AppendTurn(ctx context.Context, turn SessionTurn) error {
+	// Like QueryAssets, this opens a connection per request for simplicity.
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	refs, err := json.Marshal(nonNil(turn.Refs))
+	if err != nil {
+		return fmt.Errorf("failed to encode refs: %w", err)
+	}
+	toolCalls, err := json.Marshal(nonNil(turn.ToolCalls))
+	if err != nil {
+		return fmt.Errorf("failed to encode tool calls: %w", err)
+	}
+	assetIDs, err := json.Marshal(nonNil(turn.AssetIDs))
+	if err != nil {
+		return fmt.Errorf("failed to encode asset IDs: %w", err)
+	}
+
+	// The turn number is assigned in the same statement. Two concurrent asks in the same
+	// session can still collide on the primary key; the second one fails and is logged
+	// by the caller.
+	_, err = conn.Exec(ctx, `
+		INSERT INTO session_turns (org_id, session_id, turn, question, answer, refs, tool_calls,
+			asset_ids, context_tokens)
+		SELECT $1, $2, COALESCE(MAX(turn), 0) + 1, $3, $4, $5, $6, $7, $8
+		FROM session_turns WHERE org_id = $1 AND session_id = $2
+	`, turn.OrgID, turn.SessionID, turn.Question, turn.Answer, refs, toolCalls, assetIDs, turn.ContextTokens)
+	if err != nil {
+		return fmt.Errorf("failed to insert session turn: %w", err)
+	}
+	return nil
+}
+
+func (st *pgSessionStore) LoadTurns(ctx context.Context, orgID uuid.UUID, sessionID string) ([]SessionTurn, error) {
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, `
+		SELECT turn, question, answer, refs, tool_calls, asset_ids, context_tokens, created_at
+		FROM session_turns WHERE org_id = $1 AND session_id = $2
+		ORDER BY turn
+	`, orgID, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session turns: %w", err)
+	}
+	defer rows.Close()
+
+	var turns []SessionTurn
+	for rows.Next() {
+		turn := SessionTurn{OrgID: orgID, SessionID: sessionID}
+		var refs, toolCalls, assetIDs []byte
+		err := rows.Scan(&turn.Turn, &turn.Question, &turn.Answer, &refs, &toolCalls, &assetIDs,
+			&turn.ContextTokens, &turn.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session turn: %w", err)
+		}
+		if err := json.Unmarshal(refs, &turn.Refs); err != nil {
+			return nil, fmt.Errorf("failed to decode refs: %w", err)
+		}
+		if err := json.Unmarshal(toolCalls, &turn.ToolCalls); err != nil {
+			return nil, fmt.Errorf("failed to decode tool calls: %w", err)
+		}
+		if err := json.Unmarshal(assetIDs, &turn.AssetIDs); err != nil {
+			return nil, fmt.Errorf("failed to decode asset IDs: %w", err)
+		}
+		turns = append(turns, turn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read session turns: %w", err)
+	}
+	return turns, nil
+}
+
+func (st *pgSessionStore) LoadDigest(ctx context.Context, orgID uuid.UUID, sessionID string) (SessionDigest, error) {
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return SessionDigest{}, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	var digest SessionDigest
+	var pinned []byte
+	err = conn.QueryRow(ctx, `
+		SELECT through_turn, resumed_after_turn, compactions, summary, pinned_asset_ids, updated_at
+		FROM session_digests WHERE org_id = $1 AND session_id = $2
+	`, orgID, sessionID).Scan(&digest.ThroughTurn, &digest.ResumedAfterTurn, &digest.Compactions,
+		&digest.Summary, &pinned, &digest.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return SessionDigest{}, nil
+	}
+	if err != nil {
+		return SessionDigest{}, fmt.Errorf("failed to read session digest: %w", err)
+	}
+	if err := json.Unmarshal(pinned, &digest.PinnedAssetIDs); err != nil {
+		return SessionDigest{}, fmt.Errorf("failed to decode pinned asset IDs: %w", err)
+	}
+	return digest, nil
+}
+
+func (st *pgSessionStore) SaveDigest(ctx context.Context, orgID uuid.UUID, sessionID string, digest SessionDigest) error {
+	conn, err := pgx.Connect(ctx, st.url)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	pinned, err := json.Marshal(nonNil(digest.PinnedAssetIDs))
+	if err != nil {
+		return fmt.Errorf("failed to encode pinned asset IDs: %w", err)
+	}
+	_, err = conn.Exec(ctx, `
+		INSERT INTO session_digests (org_id, session_id, through_turn, resumed_after_turn,
+			compactions, summary, pinned_asset_ids, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+		ON CONFLICT (org_id, session_id) DO UPDATE SET
+			through_turn = EXCLUDED.through_turn,
+			resumed_after_turn = EXCLUDED.resumed_after_turn,
+			compactions = EXCLUDED.compactions,
+			summary = EXCLUDED.summary,
+			pinned_asset_ids = EXCLUDED.pinned_asset_ids,
+			updated_at = EXCLUDED.updated_at
+	`, orgID, sessionID, digest.ThroughTurn, digest.ResumedAfterTurn, digest.Compactions,
+		digest.Summary, pinned)
+	if err != nil {
+		return fmt.Errorf("failed to save session digest: %w", err)
+	}
+	return nil
+}
+
+// JSON columns are arrays, so nil slices are stored as [] rather than null.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// Bedrock deletes an inline session after this long without activity. We use the
+// default, see BedrockAgent.makeBaseInput.
+const bedrockSessionTTL = 15 * time.Minute
+
+// How close to the TTL a session is treated as expired. Sending the summary to a session
+// that is still alive only costs some tokens, while missing an expired one loses the
+// context, so we err on the early side.
+const sessionExpiryMargin = time.Minute
+
+// How many of the latest turns go into a rehydration summary, and how much of each
+// answer is kept.
+const (
+	maxSummaryTurns     = 10
+	maxSummaryAnswerLen = 500
+)
+
+// The session ID given to the agent backend. Session IDs come from the caller, so they
+// are prefixed with the org ID. Even if an ID is reused across orgs, the backend sees
+// two different sessions and never mixes their history.
+//
+// Bedrock allows up to 100 characters of [0-9a-zA-Z._:-], which fits two UUIDs.
+func agentSessionID(orgID uuid.UUID, sessionID string) string {
+	return orgID.String() + ":" + sessionID
+}
+
+// Check that the session can be used by the org and the user of the token. New sessions
+// are claimed by them. Returns true if the session's turns are stored.
+//
+// Requests without a token subject can't tell who the user is, so they may only use
+// sessions that nobody claimed, and their turns aren't stored. Otherwise every tokenless
+// caller in an org would be the same user and could continue each other's sessions.
+func (s *MainService) checkSessionOwner(ctx context.Context, orgID uuid.UUID, authorization string, sessionID string) (bool, error) {
+	if s.sessions == nil {
+		return false, nil
+	}
+	subject := tokenSubject(authorization)
+	if subject != "" {
+		if err := s.sessions.ClaimSession(ctx, orgID, subject, sessionID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	_, _, err := s.sessions.SessionOwner(ctx, sessionID)
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return false, fmt.Errorf("%w; the request has no token subject", ErrSessionForbidden)
+}
+
+// Returns true if the backend no longer has the session that the stored turns belong
+// to. Bedrock sessions expire after bedrockSessionTTL. The other backends keep history
+// in memory, which is dropped after the same time without activity, and is gone after a
+// restart.
+//
+// agentSession is the namespaced ID from agentSessionID.
+func (s *MainService) sessionExpired(agentSession string, last SessionTurn, now time.Time) bool {
+	switch s.agentConfig.Backend {
+	case AgentBackendAnthropic:
+		return len(s.anthropicHistory.Get(agentSession)) == 0
+	case AgentBackendOpenAI:
+		return len(s.openAIHistory.Get(agentSession)) == 0
+	case AgentBackendConverse:
+		return len(s.converseHistory.Get(agentSession)) == 0
+	default:
+		return now.Sub(last.CreatedAt) >= bedrockSessionTTL-sessionExpiryMargin
+	}
+}
+
+// The backend session and the query to send for a request.
+type sessionContext struct {
+	// Session ID for the agent backend. It changes each time the session is compacted.
+	backendSession string
+	query          string
+	// Usage of compacting the session, if it was compacted for this request.
+	usage bricks.Usage
+}
+
+// Prepare the session for a request. If the session's context has grown past the
+// compaction threshold, its older turns are compacted into the digest first. Then, if
+// the backend session doesn't have the conversation (it expired, or it was just started
+// from a digest), the query is prefixed with the digest and a summary of the latest
+// turns so the conversation can continue where it left off.
+//
+// Failing to load the history isn't fatal; the question is asked without it.
+func (s *MainService) prepareSession(ctx context.Context, orgID uuid.UUID, sessionID string,
+	query string, profile resolvedProfile) sessionContext {
+
+	out := sessionContext{backendSession: agentSessionID(orgID, sessionID), query: query}
+	if s.sessions == nil {
+		return out
+	}
+	turns, err := s.sessions.LoadTurns(ctx, orgID, sessionID)
+	if err != nil {
+		log.WithError(err).WithField("session", sessionID).Warn("failed to load session history")
+		return out
+	}
+	if len(turns) == 0 {
+		return out
+	}
+	digest, err := s.sessions.LoadDigest(ctx, orgID, sessionID)
+	if err != nil {
+		log.WithError(err).WithField("session", sessionID).Warn("failed to load session digest")
+		digest = SessionDigest{}
+	}
+
+	if s.needsCompaction(turns, digest) {
+		compacted, usage, err := s.compactSession(ctx, orgID, sessionID, profile, turns, digest)
+		out.usage = usage
+		if err != nil {
+			log.WithError(err).WithField("session", sessionID).Warn("failed to compact session")
+		} else {
+			digest = compacted
+		}
+	}
+
+	out.backendSession = digest.backendSessionID(out.backendSession)
+	last := turns[len(turns)-1]
+	resumed := digest.Compactions > 0 && last.Turn <= digest.ResumedAfterTurn
+	if !resumed && !s.sessionExpired(out.backendSession, last, time.Now()) {
+		return out
+	}
+
+	log.WithField("org", orgID).
+		WithField("session", sessionID).
+		WithField("turns", len(turns)).
+		WithField("compactions", digest.Compactions).
+		Info("rehydrating session")
+	out.query = summarizeTurns(digest, turnsAfter(turns, digest.ThroughTurn)) + "\n\n" + query
+	return out
+}
+
+// Summarize earlier turns for the model: the digest, if the session was compacted, and
+// the turns after it. The turn summary is built from the stored text rather than by the
+// model, so rehydrating doesn't cost an extra invocation. Only the latest turns are
+// included, and long answers are truncated.
+func summarizeTurns(digest SessionDigest, turns []SessionTurn) string {
+	var sb strings.Builder
+	sb.WriteString("<conversationHistory>\n")
+	sb.WriteString("This conversation continues an earlier one.\n")
+	if digest.Summary != "" {
+		fmt.Fprintf(&sb, "<digest>\n%s\n</digest>\n", digest.Summary)
+	}
+	if len(digest.PinnedAssetIDs) > 0 {
+		fmt.Fprintf(&sb, "The user is working on these assets: %s\n", strings.Join(digest.PinnedAssetIDs, ", "))
+	}
+	if len(turns) > 0 {
+		sb.WriteString("The latest turns were:\n")
+	}
+	if len(turns) > maxSummaryTurns {
+		fmt.Fprintf(&sb, "(%d earlier turns omitted)\n", len(turns)-maxSummaryTurns)
+		turns = turns[len(turns)-maxSummaryTurns:]
+	}
+	for _, turn := range turns {
+		fmt.Fprintf(&sb, "User: %s\n", turn.Question)
+		fmt.Fprintf(&sb, "Assistant: %s\n", truncateAnswer(turn.Answer))
+		for _, call := range turn.ToolCalls {
+			fmt.Fprintf(&sb, "(called %s with %s)\n", call.Function, string(call.Params))
+		}
+	}
+	sb.WriteString("</conversationHistory>")
+	return sb.String()
+}
+
+func truncateAnswer(answer string) string {
+	return truncateRunes(strings.TrimSpace(answer), maxSummaryAnswerLen)
+}
+
+// Truncate the text to n characters, marking it with "..." if it was cut.
+func truncateRunes(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "..."
+}
+
+// Store the turn. Failures are logged; the user already has their answer.
+func (s *MainService) saveTurn(ctx context.Context, turn SessionTurn) {
+	if s.sessions == nil {
+		return
+	}
+	if err := s.sessions.AppendTurn(ctx, turn); err != nil {
+		log.WithError(err).WithField("session", turn.SessionID).Warn("failed to save session turn")
+	}
+}
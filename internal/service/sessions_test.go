@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// An in-memory SessionStore.
+type fakeSessionStore struct {
+	owners  map[string]sessionOwner
+	turns   map[string][]SessionTurn
+	digests map[string]SessionDigest
+}
+
+type sessionOwner struct {
+	org     uuid.UUID
+	subject string
+}
+
+func newFakeSessionStore() *fakeSessionStore {
+	return &fakeSessionStore{
+		owners:  make(map[string]sessionOwner),
+		turns:   make(map[string][]SessionTurn),
+		digests: make(map[string]SessionDigest),
+	}
+}
+
+func (st *fakeSessionStore) ClaimSession(ctx context.Context, orgID uuid.UUID, subject string, sessionID string) error {
+	owner, ok := st.owners[sessionID]
+	if !ok {
+		owner = sessionOwner{org: orgID, subject: subject}
+		st.owners[sessionID] = owner
+	}
+	if owner.org != orgID || owner.subject != subject {
+		return fmt.Errorf("%w; session %s", ErrSessionForbidden, sessionID)
+	}
+	return nil
+}
+
+func (st *fakeSessionStore) AppendTurn(ctx context.Context, turn SessionTurn) error {
+	turns := st.turns[turn.SessionID]
+	turn.Turn = len(turns) + 1
+	st.turns[turn.SessionID] = append(turns, turn)
+	return nil
+}
+
+func (st *fakeSessionStore) LoadTurns(ctx context.Context, orgID uuid.UUID, sessionID string) ([]SessionTurn, error) {
+	return st.turns[sessionID], nil
+}
+
+func (st *fakeSessionStore) SessionOwner(ctx context.Context, sessionID string) (uuid.UUID, string, error) {
+	owner, ok := st.owners[sessionID]
+	if !ok {
+		return uuid.Nil, "", fmt.Errorf("%w; session %s", ErrSessionNotFound, sessionID)
+	}
+	return owner.org, owner.subject, nil
+}
+
+func (st *fakeSessionStore) LoadDigest(ctx context.Context, orgID uuid.UUID, sessionID string) (SessionDigest, error) {
+	return st.digests[sessionID], nil
+}
+
+func (st *fakeSessionStore) SaveDigest(ctx context.Context, orgID uuid.UUID, sessionID string, digest SessionDigest) error {
+	st.digests[sessionID] = digest
+	return nil
+}
+
+var (
+	testOrg     = uuid.MustParse("11111111-1111-1111-1111-111111111111")
+	otherOrg    = uuid.MustParse("22222222-2222-2222-2222-222222222222")
+	testSession = "33333333-3333-3333-3333-333333333333"
+	newSession  = "44444444-4444-4444-4444-444444444444"
+	userToken   = bearerToken(`{"sub":"user-1"}`)
+	otherToken  = bearerToken(`{"sub":"user-2"}`)
+	noSubToken  = bearerToken(`{"name":"User"}`)
+)
+
+func TestCheckSessionOwner(t *testing.T) {
+	// Each request runs against a store where user-1 of testOrg already claimed
+	// testSession.
+	tests := []struct {
+		name          string
+		orgID         uuid.UUID
+		authorization string
+		sessionID     string
+		want          error
+		wantStored    bool
+	}{
+		{"claims a new session", testOrg, userToken, newSession, nil, true},
+		{"owner continues", testOrg, userToken, testSession, nil, true},
+		{"other user", testOrg, otherToken, testSession, ErrSessionForbidden, false},
+		{"other org", otherOrg, userToken, testSession, ErrSessionForbidden, false},
+		{"no token", testOrg, "", testSession, ErrSessionForbidden, false},
+		{"no subject", testOrg, noSubToken, testSession, ErrSessionForbidden, false},
+		{"no token for a new session", testOrg, "", newSession, nil, false},
+		{"no subject for a new session", testOrg, noSubToken, newSession, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeSessionStore()
+			store.owners[testSession] = sessionOwner{org: testOrg, subject: "user-1"}
+			s := &MainService{sessions: store}
+
+			stored, err := s.checkSessionOwner(context.Background(), tt.orgID, tt.authorization, tt.sessionID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if stored != tt.wantStored {
+				t.Errorf("expected stored=%v, got %v", tt.wantStored, stored)
+			}
+
+			// The owner of testSession never changes, and only stored sessions are
+			// claimed.
+			if owner := store.owners[testSession]; owner.org != testOrg || owner.subject != "user-1" {
+				t.Errorf("testSession owner changed to %+v", owner)
+			}
+			owner, claimed := store.owners[newSession]
+			if tt.sessionID == newSession && claimed != tt.wantStored {
+				t.Errorf("expected newSession claimed=%v, got owner %+v", tt.wantStored, owner)
+			}
+		})
+	}
+}
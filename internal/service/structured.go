@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// An answer in structured mode (AskOptions.Structured), for clients that render assets
+// and follow-up questions themselves instead of showing free text.
+type StructuredAnswer struct {
+	Summary   string           `json:"summary" desc:"The answer to the question, as Markdown" required:"true"`
+	Assets    []AssetReference `json:"assets" desc:"Assets the answer refers to. Empty if none." required:"true"`
+	FollowUps []string         `json:"follow_up_questions" desc:"Up to 3 questions the user might ask next" required:"true"`
+}
+
+// An asset mentioned in a structured answer.
+type AssetReference struct {
+	ID   string `json:"id" desc:"Asset ID (UUID), from the id column of tbl_assets" required:"true"`
+	Type string `json:"type" desc:"Asset type, from the type column of tbl_assets" required:"true" enum:"domain,subdomain,dns_record,ip_address,port,network,service"`
+	Link string `json:"link" desc:"Link to the asset in the UI, from the link column of tbl_assets. Empty if the asset has no link." required:"true"`
+}
+
+const maxFollowUps = 3
+
+// The output format section of the instruction in structured mode.
+func structuredOutputInstruction() string {
+	schema, _ := json.Marshal(bricks.JSONSchema(StructuredAnswer{}))
+	return "<outputFormat>\nReply with only a JSON object matching this JSON schema, with no " +
+		"other text before or after it. Only include assets you found with the tools, " +
+		"with their real IDs and links. Never make up IDs or links.\n" +
+		string(schema) + "\n</outputFormat>"
+}
+
+// Decode and check a structured answer. On top of the schema, asset IDs must be UUIDs and
+// links must point into the org's own part of the UI.
+func parseStructuredAnswer(text string, orgID uuid.UUID) (StructuredAnswer, error) {
+	var answer StructuredAnswer
+	if err := bricks.DecodeStructured(text, &answer); err != nil {
+		return StructuredAnswer{}, err
+	}
+	if strings.TrimSpace(answer.Summary) == "" {
+		return StructuredAnswer{}, fmt.Errorf("%w; $.summary must not be empty", bricks.ErrInvalidStructuredOutput)
+	}
+	linkPrefix := "https://ui.api.non.usea2.bf9.io/" + orgID.String() + "/"
+	for i, asset := range answer.Assets {
+		if _, err := uuid.Parse(asset.ID); err != nil {
+			return StructuredAnswer{}, fmt.Errorf("%w; $.assets[%d].id must be an asset ID from tbl_assets",
+				bricks.ErrInvalidStructuredOutput, i)
+		}
+		if asset.Link != "" && !strings.HasPrefix(asset.Link, linkPrefix) {
+			return StructuredAnswer{}, fmt.Errorf("%w; $.assets[%d].link must be the link column from tbl_assets",
+				bricks.ErrInvalidStructuredOutput, i)
+		}
+	}
+	if len(answer.FollowUps) > maxFollowUps {
+		answer.FollowUps = answer.FollowUps[:maxFollowUps]
+	}
+	return answer, nil
+}
+
+// Get a structured answer out of the agent's response. If it doesn't validate, the agent
+// is asked once, in the same session, to fix it. The repair's usage and tool calls are
+// added to the response.
+//
+// Returns nil if the answer still doesn't validate; the response text is then the agent's
+// last answer as is.
+func structuredAnswer(ctx context.Context, agent bricks.StreamingAgent, sessionID string,
+	orgID uuid.UUID, response *bricks.QueryResult) *StructuredAnswer {
+
+	answer, err := parseStructuredAnswer(response.Response, orgID)
+	if err == nil {
+		return &answer
+	}
+	log.WithError(err).WithField("org", orgID).Info("structured answer is invalid; asking for a repair")
+
+	repairPrompt := fmt.Sprintf("Your answer did not match the required format: %v. Reply again with "+
+		"only the corrected JSON object, following the outputFormat instructions.", err)
+	repaired, repairErr := agent.QueryStream(ctx, repairPrompt, sessionID, nil)
+	if repairErr != nil {
+		log.WithError(repairErr).WithField("org", orgID).Warn("structured answer repair failed")
+		return nil
+	}
+	response.Usage.Add(repaired.Usage)
+	response.ToolCalls = append(response.ToolCalls, repaired.ToolCalls...)
+	response.Refs = mergeReferences(response.Refs, repaired.Refs)
+
+	answer, err = parseStructuredAnswer(repaired.Response, orgID)
+	if err != nil {
+		log.WithError(err).WithField("org", orgID).Warn("structured answer is still invalid after repair")
+		response.Response = repaired.Response
+		return nil
+	}
+	return &answer
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The asset types in the structured answer schema must be the ones the agent is told
+// about in the tbl_assets schema.
+func TestAssetTypeEnumMatchesSchema(t *testing.T) {
+	desc, err := os.ReadFile("../mcp/prompt/query_assets_extended_desc.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := regexp.MustCompile(`type TEXT NOT NULL, -- Asset type, one of \[([^\]]+)\]`).FindSubmatch(desc)
+	if match == nil {
+		t.Fatal("the asset types aren't in the tbl_assets schema anymore")
+	}
+	schemaTypes := strings.ReplaceAll(string(match[1]), " ", "")
+
+	field, _ := reflect.TypeOf(AssetReference{}).FieldByName("Type")
+	if enum := field.Tag.Get("enum"); enum != schemaTypes {
+		t.Errorf("AssetReference.Type enum is %q, the schema has %q", enum, schemaTypes)
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Token usage with an estimated cost in USD. The cost is zero if the model's price isn't
+// in bricks.ModelPricing.
+type CostedUsage struct {
+	bricks.Usage
+	EstimatedCostUSD float64 `json:"estimated_cost_usd"`
+}
+
+// Usage reported for an Ask request.
+type AskUsage struct {
+	CostedUsage
+	// Totals for the session so far, including this request.
+	Session CostedUsage `json:"session"`
+}
+
+// Accumulates usage per session, so we can see what a whole conversation costs.
+//
+// Like the conversation histories, this is in memory and never pruned. That's fine for
+// the prototype, but a real deployment would want to persist it per org anyway.
+type usageTracker struct {
+	mu       sync.Mutex
+	sessions map[string]CostedUsage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		sessions: make(map[string]CostedUsage),
+	}
+}
+
+// Add the usage of a request to the session and return the new session totals.
+func (t *usageTracker) add(sessionID string, usage CostedUsage) CostedUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	total := t.sessions[sessionID]
+	total.Usage.Add(usage.Usage)
+	total.EstimatedCostUSD += usage.EstimatedCostUSD
+	t.sessions[sessionID] = total
+	return total
+}
+
+// Price the usage of an Ask request, add it to the session totals, and log it for cost
+// tracking per org. The model is the one that answered, if the agent reported it;
+// otherwise the configured model is used.
+func (s *MainService) recordUsage(orgID uuid.UUID, sessionID string, model string, usage bricks.Usage) AskUsage {
+	if model == "" {
+		model = s.agentConfig.Model
+	}
+	cost, ok := usage.EstimateCost(model)
+	if !ok && usage.Invocations > 0 {
+		log.WithField("model", model).Warn("no pricing for model; cost is reported as zero")
+	}
+
+	request := CostedUsage{Usage: usage, EstimatedCostUSD: cost}
+	session := s.usage.add(sessionID, request)
+
+	log.WithFields(log.Fields{
+		"org":                orgID,
+		"session":            sessionID,
+		"model":              model,
+		"input_tokens":       usage.InputTokens,
+		"output_tokens":      usage.OutputTokens,
+		"invocations":        usage.Invocations,
+		"estimated_cost_usd": cost,
+		"session_cost_usd":   session.EstimatedCostUSD,
+	}).Info("ask usage")
+
+	return AskUsage{CostedUsage: request, Session: session}
+}
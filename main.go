@@ -28,7 +28,11 @@ func main() {
 	}
 
 	fs := mcp.GetFunctions(svc)
-	svc.SetFunctions(fs) // That circular dependency we noted.
+	// That circular dependency we noted.
+	if err := svc.SetFunctions(fs); err != nil {
+		log.Errorf("Failed to set functions: %v", err)
+		return
+	}
 
 	mcpServer := newMCPServer(svc, fs)
 	router := setupRouter(svc, mcpServer)
@@ -0,0 +1,332 @@
+package bricks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AnthropicAgent is an agent implementation that talks to the Anthropic Messages API
+// directly. Unlike Bedrock inline agents, the Messages API has no server-side sessions or
+// orchestration, so this agent runs the tool-use loop itself and keeps the conversation
+// history on our side.
+type AnthropicAgent struct {
+	Config AnthropicAgentConfig
+}
+
+// Configuration input for an AnthropicAgent, passed to NewAnthropicAgent.
+type AnthropicAgentConfig struct {
+	// API key sent in the x-api-key header.
+	APIKey string
+	// Base URL of the API. Defaults to https://api.anthropic.com. Tests can point this to
+	// a local HTTP server.
+	BaseURL string
+	// Model ID, e.g., claude-sonnet-4-5.
+	Model string
+	// System prompt.
+	Instruction string
+	// Maximum tokens to generate per response. Defaults to 4096.
+	MaxTokens  int
+	Functions  *FunctionSet
+	HTTPClient *http.Client
+	// Conversation history keyed by session ID. If nil, the agent creates its own. Share
+	// one history between agent instances to keep sessions alive across requests.
+	History *SessionHistory[AnthropicMessage]
+	// Tool budgets for a single query, the same as BedrockAgentConfig. Zero uses the
+	// default, negative means no limit.
+	MaxToolRounds int
+	MaxToolCalls  int
+	MaxDuration   time.Duration
+}
+
+const anthropicDefaultBaseURL = "https://api.anthropic.com"
+const anthropicAPIVersion = "2023-06-01"
+
+// A message in the Messages API format. Content is a list of blocks.
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+// A content block of a message. Only the fields relevant to the block type are set.
+type AnthropicContentBlock struct {
+	// One of [text, tool_use, tool_result].
+	Type string `json:"type"`
+	// Set for text blocks.
+	Text string `json:"text,omitempty"`
+	// Set for tool_use blocks.
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// Set for tool_result blocks.
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []AnthropicMessage `json:"messages"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+}
+
+type anthropicResponse struct {
+	Content    []AnthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int64 `json:"input_tokens"`
+		OutputTokens int64 `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Create a new agent that uses the Anthropic Messages API.
+func NewAnthropicAgent(config AnthropicAgentConfig) Agent {
+	if config.BaseURL == "" {
+		config.BaseURL = anthropicDefaultBaseURL
+	}
+	if config.MaxTokens == 0 {
+		config.MaxTokens = 4096
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.History == nil {
+		config.History = NewSessionHistory[AnthropicMessage]()
+	}
+	return &AnthropicAgent{
+		Config: config,
+	}
+}
+
+// Convert the function set into the tools list of a Messages API request. The Messages
+// API has no tight limit on description length, so the extended description is included
+// in the tool description.
+func (aa *AnthropicAgent) makeTools() []anthropicTool {
+	if aa.Config.Functions == nil {
+		return nil
+	}
+	var tools []anthropicTool
+	for _, fn := range aa.Config.Functions.Functions {
+		tools = append(tools, anthropicTool{
+			Name:        fn.Name,
+			Description: fn.FullDescription(),
+			InputSchema: jsonSchemaForParams(fn.Params),
+		})
+	}
+	return tools
+}
+
+// Send one request to the Messages API.
+func (aa *AnthropicAgent) createMessage(ctx context.Context, messages []AnthropicMessage) (anthropicResponse, error) {
+	body, err := json.Marshal(anthropicRequest{
+		Model:     aa.Config.Model,
+		MaxTokens: aa.Config.MaxTokens,
+		System:    aa.Config.Instruction,
+		Messages:  messages,
+		Tools:     aa.makeTools(),
+	})
+	if err != nil {
+		return anthropicResponse{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := strings.TrimRight(aa.Config.BaseURL, "/") + "/v1/messages"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return anthropicResponse{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	req.Header.Set("x-api-key", aa.Config.APIKey)
+
+	resp, err := aa.Config.HTTPClient.Do(req)
+	if err != nil {
+		return anthropicResponse{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return anthropicResponse{}, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp anthropicErrorResponse
+		_ = json.Unmarshal(respBody, &errResp)
+		return anthropicResponse{}, fmt.Errorf("messages API returned status %d: %s %s",
+			resp.StatusCode, errResp.Error.Type, errResp.Error.Message)
+	}
+
+	var out anthropicResponse
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return anthropicResponse{}, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return out, nil
+}
+
+// Invoke the function for a tool_use block and return the tool_result block to send back.
+// Function errors are reported to the model rather than failing the query, the same as
+// the FAILURE response state in the Bedrock agent.
+func (aa *AnthropicAgent) invokeTool(ctx context.Context, block AnthropicContentBlock) AnthropicContentBlock {
+	out := AnthropicContentBlock{
+		Type:      "tool_result",
+		ToolUseID: block.ID,
+	}
+
+	if aa.Config.Functions == nil {
+		out.IsError = true
+		out.Content = fmt.Sprintf("function %s is not defined", block.Name)
+		return out
+	}
+
+	input := []byte(block.Input)
+	if len(input) == 0 {
+		input = []byte("{}")
+	}
+
+	result, err := aa.Config.Functions.Invoke(ctx, block.Name, input)
+	if err == nil {
+		out.Content, err = formatFunctionResult(result)
+	}
+	if err != nil {
+		log.Errorln("Function invocation error:", err)
+		out.IsError = true
+		if errors.Is(err, ErrInvalidArg) || errors.Is(err, ErrNoFunction) {
+			out.Content = fmt.Sprintf("function invocation failed; %v", err)
+		} else {
+			out.Content = "function invocation failed unexpectedly"
+		}
+	}
+	return out
+}
+
+// The assistant message kept in the history when the tool loop is stopped: the text of
+// the response without its tool_use blocks.
+func stoppedAnthropicMessage(content []AnthropicContentBlock) AnthropicMessage {
+	msg := AnthropicMessage{Role: "assistant"}
+	for _, block := range content {
+		if block.Type == "text" {
+			msg.Content = append(msg.Content, block)
+		}
+	}
+	if len(msg.Content) == 0 {
+		msg.Content = []AnthropicContentBlock{{Type: "text", Text: "(Stopped: the tool budget ran out.)"}}
+	}
+	return msg
+}
+
+// Query the Messages API with the given prompt. The conversation so far is loaded from
+// the session history, and the tool-use loop runs until the model stops asking for tools
+// or the tool budget runs out.
+func (aa *AnthropicAgent) Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error) {
+	messages := aa.Config.History.Get(sessionID)
+	messages = append(messages, AnthropicMessage{
+		Role: "user",
+		Content: []AnthropicContentBlock{
+			{Type: "text", Text: inputText},
+		},
+	})
+
+	// References added by the functions.
+	refs := newReferenceCollector(nil)
+	ctx = withReferenceCollector(ctx, refs)
+
+	var chunks []string
+	var usage Usage
+	budget := newToolBudget(aa.Config.MaxToolRounds, aa.Config.MaxToolCalls, aa.Config.MaxDuration)
+	exhausted := ""
+	for {
+		resp, err := aa.createMessage(ctx, messages)
+		if err != nil {
+			return QueryResult{}, fmt.Errorf("failed to invoke agent: %w", err)
+		}
+		usage.addInvocation(resp.Usage.InputTokens, resp.Usage.OutputTokens)
+
+		messages = append(messages, AnthropicMessage{
+			Role:    "assistant",
+			Content: resp.Content,
+		})
+
+		// The model may include text alongside tool calls, e.g., explaining what it is
+		// about to look up. We keep all text blocks so the answer reads the same as a
+		// Bedrock response, which is also concatenated from multiple chunks.
+		var toolUses []AnthropicContentBlock
+		for _, block := range resp.Content {
+			switch block.Type {
+			case "text":
+				chunks = append(chunks, block.Text)
+			case "tool_use":
+				toolUses = append(toolUses, block)
+			}
+		}
+
+		if resp.StopReason != "tool_use" || len(toolUses) == 0 {
+			break
+		}
+
+		// Once a budget runs out, the model gets one more turn to wrap up. If it asks
+		// for tools again anyway, we stop with whatever answer we have so far. The
+		// tool_use blocks are dropped from the history, since the API rejects a tool_use
+		// without a result.
+		if exhausted != "" {
+			log.Warnf("Agent kept calling tools after the %s budget ran out; stopping", exhausted)
+			messages[len(messages)-1] = stoppedAnthropicMessage(resp.Content)
+			break
+		}
+
+		allowed, hit := budget.startRound(len(toolUses))
+		var toolResults []AnthropicContentBlock
+		for _, block := range toolUses[:allowed] {
+			toolResults = append(toolResults, aa.invokeTool(ctx, block))
+		}
+		if hit != "" {
+			log.Warnf("Agent tool budget exhausted (%s); asking the model to wrap up", hit)
+			exhausted = hit
+			for _, block := range toolUses[allowed:] {
+				toolResults = append(toolResults, AnthropicContentBlock{
+					Type:      "tool_result",
+					ToolUseID: block.ID,
+					Content:   budgetExhaustedMessage(hit),
+					IsError:   true,
+				})
+			}
+		}
+
+		// All tool results for one assistant turn go back in a single user message.
+		messages = append(messages, AnthropicMessage{
+			Role:    "user",
+			Content: toolResults,
+		})
+	}
+
+	aa.Config.History.Set(sessionID, messages)
+
+	return QueryResult{
+		Response:        strings.Join(chunks, ""),
+		Refs:            refs.list(),
+		Usage:           usage,
+		BudgetExhausted: exhausted,
+	}, nil
+}
@@ -0,0 +1,191 @@
+package bricks_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+type EchoRequest struct {
+	Text string `json:"text" desc:"Text to echo" required:"true"`
+}
+
+func newEchoFunctions() *bricks.FunctionSet {
+	fs := bricks.NewFunctionSet("test")
+	fs.AddFunction("echo", "Echo the text back", "", EchoRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			var req EchoRequest
+			c.MustBind(&req)
+			return "echo: " + req.Text, nil
+		})
+	return fs
+}
+
+// A stand-in for the Messages API. Each request is recorded and answered with the next
+// canned response.
+type anthropicStandIn struct {
+	t         *testing.T
+	responses []string
+	requests  []map[string]any
+}
+
+func (s *anthropicStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/messages" {
+		s.t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if r.Header.Get("x-api-key") != "test-key" {
+		s.t.Errorf("missing api key header")
+	}
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.t.Fatalf("failed to decode request: %v", err)
+	}
+	s.requests = append(s.requests, body)
+	if len(s.responses) == 0 {
+		s.t.Fatalf("unexpected request #%d", len(s.requests))
+	}
+	w.Header().Set("content-type", "application/json")
+	_, _ = w.Write([]byte(s.responses[0]))
+	s.responses = s.responses[1:]
+}
+
+func TestAnthropicAgentToolLoop(t *testing.T) {
+	standIn := &anthropicStandIn{
+		t: t,
+		responses: []string{
+			`{"content":[
+				{"type":"text","text":"Let me check. "},
+				{"type":"tool_use","id":"toolu_1","name":"echo","input":{"text":"hi"}}
+			],"stop_reason":"tool_use"}`,
+			`{"content":[{"type":"text","text":"The tool said hi."}],"stop_reason":"end_turn"}`,
+			`{"content":[{"type":"text","text":"Still here."}],"stop_reason":"end_turn"}`,
+		},
+	}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	agent := bricks.NewAnthropicAgent(bricks.AnthropicAgentConfig{
+		APIKey:      "test-key",
+		BaseURL:     srv.URL,
+		Model:       "test-model",
+		Instruction: "Be helpful.",
+		Functions:   newEchoFunctions(),
+	})
+
+	result, err := agent.Query(context.Background(), "say hi", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Let me check. The tool said hi." {
+		t.Errorf("unexpected response %q", result.Response)
+	}
+
+	// The first request advertises the tool with a JSON schema built from the params.
+	tools := standIn.requests[0]["tools"].([]any)
+	tool := tools[0].(map[string]any)
+	schema := tool["input_schema"].(map[string]any)
+	if tool["name"] != "echo" || schema["type"] != "object" {
+		t.Errorf("unexpected tool definition %v", tool)
+	}
+	if standIn.requests[0]["system"] != "Be helpful." {
+		t.Errorf("unexpected system prompt %v", standIn.requests[0]["system"])
+	}
+
+	// The second request carries the tool result for the tool_use ID.
+	messages := standIn.requests[1]["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages in the follow up, got %d", len(messages))
+	}
+	toolResult := messages[2].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if toolResult["type"] != "tool_result" || toolResult["tool_use_id"] != "toolu_1" ||
+		toolResult["content"] != "echo: hi" {
+		t.Errorf("unexpected tool result %v", toolResult)
+	}
+
+	// Querying the same session again sends the earlier conversation along.
+	_, err = agent.Query(context.Background(), "are you there?", "session-1")
+	if err != nil {
+		t.Fatalf("second query failed: %v", err)
+	}
+	messages = standIn.requests[2]["messages"].([]any)
+	if len(messages) != 5 {
+		t.Errorf("expected 5 messages with history, got %d", len(messages))
+	}
+}
+
+func TestAnthropicAgentUnknownTool(t *testing.T) {
+	standIn := &anthropicStandIn{
+		t: t,
+		responses: []string{
+			`{"content":[{"type":"tool_use","id":"toolu_1","name":"missing","input":{}}],"stop_reason":"tool_use"}`,
+			`{"content":[{"type":"text","text":"Sorry."}],"stop_reason":"end_turn"}`,
+		},
+	}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	agent := bricks.NewAnthropicAgent(bricks.AnthropicAgentConfig{
+		APIKey:    "test-key",
+		BaseURL:   srv.URL,
+		Functions: newEchoFunctions(),
+	})
+
+	_, err := agent.Query(context.Background(), "call something", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	// Unknown functions are reported to the model as an error result.
+	messages := standIn.requests[1]["messages"].([]any)
+	toolResult := messages[2].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if toolResult["is_error"] != true {
+		t.Errorf("expected error tool result, got %v", toolResult)
+	}
+}
+
+func TestAnthropicAgentToolBudget(t *testing.T) {
+	toolUse := `{"content":[{"type":"tool_use","id":"toolu_%d","name":"echo","input":{"text":"again"}}],"stop_reason":"tool_use"}`
+	standIn := &anthropicStandIn{
+		t: t,
+		responses: []string{
+			fmt.Sprintf(toolUse, 1),
+			fmt.Sprintf(toolUse, 2),
+			// Asks for tools again after being told to wrap up.
+			fmt.Sprintf(toolUse, 3),
+		},
+	}
+	srv := httptest.NewServer(standIn)
+	defer srv.Close()
+
+	agent := bricks.NewAnthropicAgent(bricks.AnthropicAgentConfig{
+		APIKey:        "test-key",
+		BaseURL:       srv.URL,
+		Model:         "test-model",
+		Functions:     newEchoFunctions(),
+		MaxToolRounds: 1,
+	})
+
+	result, err := agent.Query(context.Background(), "loop", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.BudgetExhausted != bricks.BudgetToolRounds {
+		t.Errorf("expected the tool_rounds budget to be exhausted, got %q", result.BudgetExhausted)
+	}
+	if len(standIn.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(standIn.requests))
+	}
+
+	// The second round is refused with a message asking the model to wrap up.
+	messages := standIn.requests[2]["messages"].([]any)
+	refused := messages[len(messages)-1].(map[string]any)["content"].([]any)[0].(map[string]any)
+	if refused["is_error"] != true || !strings.Contains(refused["content"].(string), "Tool budget exhausted") {
+		t.Errorf("unexpected refused tool result %v", refused)
+	}
+}
@@ -3,15 +3,20 @@ package bricks
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/document"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
 )
 
@@ -23,40 +28,165 @@ type BedrockInvokeOutput = types.FunctionResult
 // before invoking it. This allows you to do flexible/dynamic configuration per query.
 type BedrockAgent struct {
 	Config BedrockAgentConfig
+
+	// Action groups built from the function sets, and the function set for each action
+	// group name. Large sets are split into several groups.
+	actionGroups []types.AgentActionGroup
+	groupSets    map[string]*FunctionSet
 }
 
 // Configuration input for a BedrockAgent, passed to NewBedrockAgent.
 type BedrockAgentConfig struct {
-	AgentName      string
-	Model          string
+	AgentName string
+	Model     string
+	// Models to try in order when Model is throttled or unavailable, after retries. Once
+	// a query falls back, it stays on the fallback model.
+	FallbackModels []string
 	Instruction    string
-	Functions      *FunctionSet
+	// Each function set is sent as its own action group, and return control is routed
+	// to the set with the matching name, so set names must be unique. Sets with more
+	// functions than Bedrock allows per group are split automatically (see
+	// FunctionSet.GetActionGroups).
+	Functions []*FunctionSet
+	// Function sets sent as OpenAPI-schema action groups instead (see
+	// FunctionSet.OpenAPIDocument). Use these for functions with nested objects, arrays of
+	// objects or more parameters than function schemas allow. Names must not clash with
+	// the sets in Functions.
+	APIFunctions   []*FunctionSet
 	Knowledgebases []types.KnowledgeBase
+	// Bedrock Guardrail applied to the question and the answer. Set both the identifier
+	// (ID or ARN) and the version (e.g., "1" or "DRAFT") to enable it.
+	GuardrailID      string
+	GuardrailVersion string
+	// How many functions from a single RETURN_CONTROL event may run at the same time.
+	// Defaults to 4.
+	MaxConcurrentInvocations int
+	// Budgets for a single query. Without them, a model stuck on something like fixing a
+	// bad SQL query can keep calling tools until the HTTP client times out. When one runs
+	// out, the model is told to wrap up with what it has. Zero uses the default, negative
+	// means no limit.
+	//
+	// Rounds of RETURN_CONTROL. Defaults to 10.
+	MaxToolRounds int
+	// Function invocations across all rounds. Defaults to 30.
+	MaxToolCalls int
+	// Wall-clock time, checked before each round of tool calls. Defaults to 2 minutes.
+	MaxDuration time.Duration
+	// Retries per InvokeInlineAgent call for throttling and transient errors, with
+	// jittered exponential backoff from RetryBaseDelay. Defaults to 3 retries and 500ms.
+	// A negative MaxRetries disables retries.
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	// Runtime client. If nil, the shared AWS client created from the default AWS config
+	// is used. Tests can set a ScriptedBedrockRuntime here.
+	Client BedrockAgentRuntime
+}
+
+const defaultMaxConcurrentInvocations = 4
+
+// The subset of the Bedrock Agent Runtime client used by the BedrockAgent. The SDK output
+// type hides its event stream, so this returns the stream reader directly. That also
+// makes the client easy to replace with a fake.
+type BedrockAgentRuntime interface {
+	InvokeInlineAgent(ctx context.Context, input *bedrockagentruntime.InvokeInlineAgentInput) (bedrockagentruntime.InlineAgentResponseStreamReader, error)
+}
+
+// Adapts the AWS client to BedrockAgentRuntime.
+type awsBedrockAgentRuntime struct {
+	client *bedrockagentruntime.Client
+}
+
+func (r awsBedrockAgentRuntime) InvokeInlineAgent(ctx context.Context,
+	input *bedrockagentruntime.InvokeInlineAgentInput) (bedrockagentruntime.InlineAgentResponseStreamReader, error) {
+	out, err := r.client.InvokeInlineAgent(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return out.GetStream(), nil
 }
 
 // AWS Client
 var bedrockAgentRuntimeClient *bedrockagentruntime.Client
+var bedrockAgentRuntimeMu sync.Mutex
+
+// Returns the AWS client singleton. Config errors are returned rather than being fatal,
+// so a bad environment fails the query instead of the process.
+func getBedrockAgentRuntime(ctx context.Context) (*bedrockagentruntime.Client, error) {
+	bedrockAgentRuntimeMu.Lock()
+	defer bedrockAgentRuntimeMu.Unlock()
 
-// Returns the AWS client singleton.
-func getBedrockAgentRuntime() *bedrockagentruntime.Client {
 	if bedrockAgentRuntimeClient == nil {
-		cfg, err := config.LoadDefaultConfig(context.TODO())
+		cfg, err := config.LoadDefaultConfig(ctx)
 		if err != nil {
-			log.Fatalf("Failed to load AWS config: %v", err)
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
 		}
 
 		client := bedrockagentruntime.NewFromConfig(cfg)
 		bedrockAgentRuntimeClient = client
 	}
 
-	return bedrockAgentRuntimeClient
+	return bedrockAgentRuntimeClient, nil
+}
+
+// Returns the configured runtime client, or the shared AWS client if none is set.
+func (ba *BedrockAgent) getClient(ctx context.Context) (BedrockAgentRuntime, error) {
+	if ba.Config.Client != nil {
+		return ba.Config.Client, nil
+	}
+	client, err := getBedrockAgentRuntime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return awsBedrockAgentRuntime{client: client}, nil
+}
+
+// Create a new agent that uses the Bedrock Agent Runtime. The function sets are checked
+// against the Bedrock limits here, so a bad tool definition fails early with an
+// ErrBedrockLimit error rather than with an opaque validation error from AWS at query
+// time.
+func NewBedrockAgent(config BedrockAgentConfig) (Agent, error) {
+	ba := &BedrockAgent{
+		Config:    config,
+		groupSets: make(map[string]*FunctionSet),
+	}
+
+	for _, fs := range config.Functions {
+		groups, err := fs.GetActionGroups()
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups {
+			if err := ba.addActionGroup(group, fs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, fs := range config.APIFunctions {
+		group, err := fs.GetAPIActionGroup()
+		if err != nil {
+			return nil, err
+		}
+		if err := ba.addActionGroup(group, fs); err != nil {
+			return nil, err
+		}
+	}
+	if len(ba.actionGroups) > bedrockMaxActionGroups {
+		return nil, fmt.Errorf("%w; %d action groups, max is %d",
+			ErrBedrockLimit, len(ba.actionGroups), bedrockMaxActionGroups)
+	}
+
+	return ba, nil
 }
 
-// Create a new agent that uses the Bedrock Agent Runtime.
-func NewBedrockAgent(config BedrockAgentConfig) Agent {
-	return &BedrockAgent{
-		Config: config,
+// Add an action group, routing return control for it to the function set.
+func (ba *BedrockAgent) addActionGroup(group types.AgentActionGroup, fs *FunctionSet) error {
+	name := aws.ToString(group.ActionGroupName)
+	if ba.groupSets[name] != nil {
+		return fmt.Errorf("%w; duplicate action group name %s", ErrInvalidArg, name)
 	}
+	ba.groupSets[name] = fs
+	ba.actionGroups = append(ba.actionGroups, group)
+	return nil
 }
 
 // Take function parameter input from Bedrock RETURN_CONTROL and marshal it into a JSON
@@ -97,6 +227,39 @@ func marshalBedrockFunctionParams(params []types.FunctionParameter) ([]byte, err
 	return jsonBytes, nil
 }
 
+// Build a knowledgebase Reference from the metadata of a retrieved knowledgebase chunk.
+// The same metadata shows up in agent citations and in Retrieve API results.
+//
+// A document can be split into several chunks, so the key is the document: its "folder"
+// and "header" metadata if it has them (see knowledgebase/create-kb.py), otherwise its
+// data source and URI.
+func knowledgebaseReference(metadata map[string]document.Interface) Reference {
+	meta := make(map[string]string)
+	for k, val := range metadata {
+		var text string
+		_ = val.UnmarshalSmithyDocument(&text)
+		meta[k] = string(text)
+	}
+
+	key := fmt.Sprintf("%s/%s",
+		meta["x-amz-bedrock-kb-data-source-id"],
+		meta["x-amz-bedrock-kb-source-uri"])
+	if meta["folder"] != "" && meta["header"] != "" {
+		key = meta["folder"] + "#" + meta["header"]
+	}
+
+	return Reference{
+		Type: ReferenceKnowledgebase,
+		Key:  key,
+		Data: meta,
+	}
+}
+
+// Returns the function set for the given action group, or nil if there isn't one.
+func (ba *BedrockAgent) findFunctionSet(actionGroup string) *FunctionSet {
+	return ba.groupSets[actionGroup]
+}
+
 // Invoke one of our functions and return the output. This is called during the
 // RETURN_CONTROL flow, i.e., when control is returned to our side from Bedrock to invoke
 // a tool.
@@ -104,7 +267,6 @@ func marshalBedrockFunctionParams(params []types.FunctionParameter) ([]byte, err
 // When an error is returned, the BedrockInvokeOutput returned will have a FAILURE
 // response state that can be sent to Bedrock.
 func (ba *BedrockAgent) invokeFunction(ctx context.Context, input BedrockInvokeInput) (BedrockInvokeOutput, error) {
-	fs := ba.Config.Functions
 	out := types.FunctionResult{
 		ActionGroup:   input.ActionGroup,
 		ResponseState: types.ResponseStateFailure,
@@ -120,39 +282,318 @@ func (ba *BedrockAgent) invokeFunction(ctx context.Context, input BedrockInvokeI
 		return out, fmt.Errorf("failed to marshal function params: %w", err)
 	}
 
-	if *input.ActionGroup != fs.Name {
-		return out, fmt.Errorf("%w; unknown action group: %s",
-			ErrInvalidArg, *input.ActionGroup)
+	text, err := ba.callFunction(ctx, *input.ActionGroup, *input.Function, bodyBytes)
+	if err != nil {
+		return out, err
+	}
+	out.ResponseState = ""
+	out.ResponseBody = map[string]types.ContentBody{
+		"TEXT": {
+			Body: aws.String(text),
+		},
 	}
 
-	result, err := fs.Invoke(ctx, *input.Function, bodyBytes)
+	return out, nil
+}
+
+// Invoke an API operation from an OpenAPI-schema action group. This is the same as
+// invokeFunction, but the function is named by the API path and the result is an
+// ApiResult with an HTTP status code.
+//
+// When an error is returned, the ApiResult returned will have a FAILURE response state
+// and an error status code.
+func (ba *BedrockAgent) invokeAPI(ctx context.Context, input types.ApiInvocationInput) (types.ApiResult, error) {
+	out := types.ApiResult{
+		ActionGroup:    input.ActionGroup,
+		ApiPath:        input.ApiPath,
+		HttpMethod:     input.HttpMethod,
+		HttpStatusCode: aws.Int32(400),
+		ResponseState:  types.ResponseStateFailure,
+	}
+
+	if input.ActionGroup == nil || input.ApiPath == nil {
+		return out, fmt.Errorf("%w; missing required params", ErrInvalidArg)
+	}
+
+	bodyBytes, err := marshalBedrockAPIParams(input)
 	if err != nil {
-		return out, fmt.Errorf("function %s.%s failed: %w",
-			*input.ActionGroup, *input.Function, err)
+		return out, fmt.Errorf("failed to marshal api params: %w", err)
 	}
 
-	switch v := result.(type) {
-	case string:
-		out.ResponseState = ""
-		out.ResponseBody = map[string]types.ContentBody{
-			"TEXT": {
-				Body: aws.String(v),
-			},
+	text, err := ba.callFunction(ctx, *input.ActionGroup, functionForAPIPath(*input.ApiPath), bodyBytes)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidArg) && !errors.Is(err, ErrNoFunction) {
+			out.HttpStatusCode = aws.Int32(500)
 		}
-	default:
-		resultBytes, err := json.Marshal(v)
-		if err != nil {
-			return out, fmt.Errorf("failed to marshal function result: %w", err)
+		return out, err
+	}
+	out.HttpStatusCode = aws.Int32(200)
+	out.ResponseState = ""
+	out.ResponseBody = map[string]types.ContentBody{
+		"TEXT": {
+			Body: aws.String(text),
+		},
+	}
+
+	return out, nil
+}
+
+// Call a function in the action group's function set and return the text result for the
+// model.
+func (ba *BedrockAgent) callFunction(ctx context.Context, actionGroup string, function string,
+	params []byte) (string, error) {
+
+	fs := ba.findFunctionSet(actionGroup)
+	if fs == nil {
+		return "", fmt.Errorf("%w; unknown action group: %s", ErrInvalidArg, actionGroup)
+	}
+
+	result, err := fs.Invoke(ctx, function, params)
+	if err != nil {
+		return "", fmt.Errorf("function %s.%s failed: %w", actionGroup, function, err)
+	}
+
+	return formatFunctionResult(result)
+}
+
+// Invoke the functions requested by one RETURN_CONTROL event and return the results in
+// the same order as the inputs.
+//
+// The invocations run concurrently, up to MaxConcurrentInvocations at a time. Questions
+// like "compare my domains and services" make several independent queries, and running
+// them one after another pays the sum of all of their latencies.
+//
+// Inputs can be function invocations or API invocations, from function-schema and
+// OpenAPI-schema action groups respectively. A ToolCall record is returned for each
+// invocation, also in input order.
+//
+// Function failures are not errors here; they are sent back to the model as FAILURE
+// results. An error is only returned for an input type we don't support, or when the
+// context is cancelled, in which case invocations that haven't started are skipped and
+// running ones see the cancelled context.
+func (ba *BedrockAgent) invokeAll(ctx context.Context, inputs []types.InvocationInputMember,
+	emit StreamHandler) ([]types.InvocationResultMember, []ToolCall, error) {
+
+	limit := ba.Config.MaxConcurrentInvocations
+	if limit <= 0 {
+		limit = defaultMaxConcurrentInvocations
+	}
+
+	for _, rawInv := range inputs {
+		switch rawInv.(type) {
+		case *types.InvocationInputMemberMemberFunctionInvocationInput,
+			*types.InvocationInputMemberMemberApiInvocationInput:
+		default:
+			return nil, nil, fmt.Errorf("%w; unsupported invocation input type %T", ErrInvalidArg, rawInv)
 		}
-		out.ResponseState = ""
-		out.ResponseBody = map[string]types.ContentBody{
-			"TEXT": {
-				Body: aws.String(string(resultBytes)),
-			},
+	}
+
+	results := make([]types.InvocationResultMember, len(inputs))
+	calls := make([]ToolCall, len(inputs))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i, rawInv := range inputs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
 		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			function := invocationFunction(rawInv)
+			emit(StreamEvent{Type: StreamEventToolStart, Function: function})
+			start := time.Now()
+
+			// Each goroutine writes only its own index, which keeps the ordering stable
+			// regardless of which invocation finishes first.
+			var err error
+			switch inv := rawInv.(type) {
+			case *types.InvocationInputMemberMemberFunctionInvocationInput:
+				var resultValue BedrockInvokeOutput
+				resultValue, err = ba.invokeFunctionSafely(ctx, inv.Value)
+				calls[i] = newBedrockToolCall(inv.Value, resultValue, err, time.Since(start))
+				results[i] = &types.InvocationResultMemberMemberFunctionResult{
+					Value: resultValue,
+				}
+			case *types.InvocationInputMemberMemberApiInvocationInput:
+				var resultValue types.ApiResult
+				resultValue, err = ba.invokeAPISafely(ctx, inv.Value)
+				calls[i] = newBedrockAPIToolCall(inv.Value, resultValue, err, time.Since(start))
+				results[i] = &types.InvocationResultMemberMemberApiResult{
+					Value: resultValue,
+				}
+			}
+			if err != nil {
+				log.Errorln("Function invocation error:", err)
+				// Fallthrough: the result contains a valid FAILURE state that is sent
+				// back to the model.
+			}
+
+			emit(StreamEvent{
+				Type:     StreamEventToolEnd,
+				Function: function,
+				Failed:   err != nil,
+			})
+		}()
 	}
+	wg.Wait()
 
-	return out, nil
+	if err := ctx.Err(); err != nil {
+		return nil, nil, fmt.Errorf("function invocations aborted: %w", err)
+	}
+	return results, calls, nil
+}
+
+// The name of the function an invocation input asks for.
+func invocationFunction(rawInv types.InvocationInputMember) string {
+	switch inv := rawInv.(type) {
+	case *types.InvocationInputMemberMemberFunctionInvocationInput:
+		return aws.ToString(inv.Value.Function)
+	case *types.InvocationInputMemberMemberApiInvocationInput:
+		return functionForAPIPath(aws.ToString(inv.Value.ApiPath))
+	}
+	return ""
+}
+
+// Build the trace record for a finished function invocation.
+func newBedrockToolCall(input BedrockInvokeInput, output BedrockInvokeOutput, err error,
+	duration time.Duration) ToolCall {
+
+	call := ToolCall{
+		ActionGroup: aws.ToString(input.ActionGroup),
+		Function:    aws.ToString(input.Function),
+		DurationMS:  duration.Milliseconds(),
+		State:       string(output.ResponseState),
+	}
+	// Params that can't be marshalled failed the invocation already, and the error says
+	// why, so they're just left out here.
+	if params, perr := marshalBedrockFunctionParams(input.Parameters); perr == nil {
+		call.Params = params
+	}
+	if body, ok := output.ResponseBody["TEXT"]; ok {
+		call.Result = truncateText(aws.ToString(body.Body), maxToolCallResultLen)
+	}
+	if err != nil {
+		call.Error = truncateText(err.Error(), maxToolCallResultLen)
+	}
+	return call
+}
+
+// Build the trace record for a finished API invocation.
+func newBedrockAPIToolCall(input types.ApiInvocationInput, output types.ApiResult, err error,
+	duration time.Duration) ToolCall {
+
+	call := ToolCall{
+		ActionGroup: aws.ToString(input.ActionGroup),
+		Function:    functionForAPIPath(aws.ToString(input.ApiPath)),
+		DurationMS:  duration.Milliseconds(),
+		State:       string(output.ResponseState),
+	}
+	if params, perr := marshalBedrockAPIParams(input); perr == nil {
+		call.Params = params
+	}
+	if body, ok := output.ResponseBody["TEXT"]; ok {
+		call.Result = truncateText(aws.ToString(body.Body), maxToolCallResultLen)
+	}
+	if err != nil {
+		call.Error = truncateText(err.Error(), maxToolCallResultLen)
+	}
+	return call
+}
+
+// Call invokeFunction, converting a panic into a FAILURE result. Invocations run in their
+// own goroutines, so a panicking handler (e.g., MustBind on bad input) would otherwise
+// take down the whole process instead of being caught by the HTTP recovery middleware.
+func (ba *BedrockAgent) invokeFunctionSafely(ctx context.Context, input BedrockInvokeInput) (out BedrockInvokeOutput, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = types.FunctionResult{
+				ActionGroup:   input.ActionGroup,
+				Function:      input.Function,
+				ResponseState: types.ResponseStateFailure,
+			}
+			err = fmt.Errorf("function %s panicked: %v\n%s",
+				aws.ToString(input.Function), r, debug.Stack())
+		}
+	}()
+	return ba.invokeFunction(ctx, input)
+}
+
+// Call invokeAPI, converting a panic into a FAILURE result, like invokeFunctionSafely.
+func (ba *BedrockAgent) invokeAPISafely(ctx context.Context, input types.ApiInvocationInput) (out types.ApiResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out = types.ApiResult{
+				ActionGroup:    input.ActionGroup,
+				ApiPath:        input.ApiPath,
+				HttpMethod:     input.HttpMethod,
+				HttpStatusCode: aws.Int32(500),
+				ResponseState:  types.ResponseStateFailure,
+			}
+			err = fmt.Errorf("function %s panicked: %v\n%s",
+				functionForAPIPath(aws.ToString(input.ApiPath)), r, debug.Stack())
+		}
+	}()
+	return ba.invokeAPI(ctx, input)
+}
+
+// Build the result sent back in place of a function call that was refused because the
+// budget ran out. The body asks the model to wrap up, since a bare FAILURE tends to be
+// retried.
+func budgetExhaustedResult(rawInv types.InvocationInputMember, budget string) types.InvocationResultMember {
+	body := map[string]types.ContentBody{
+		"TEXT": {
+			Body: aws.String(budgetExhaustedMessage(budget)),
+		},
+	}
+	if inv, ok := rawInv.(*types.InvocationInputMemberMemberApiInvocationInput); ok {
+		return &types.InvocationResultMemberMemberApiResult{Value: types.ApiResult{
+			ActionGroup:    inv.Value.ActionGroup,
+			ApiPath:        inv.Value.ApiPath,
+			HttpMethod:     inv.Value.HttpMethod,
+			HttpStatusCode: aws.Int32(429),
+			ResponseState:  types.ResponseStateFailure,
+			ResponseBody:   body,
+		}}
+	}
+
+	out := types.FunctionResult{
+		ResponseState: types.ResponseStateFailure,
+		ResponseBody:  body,
+	}
+	if inv, ok := rawInv.(*types.InvocationInputMemberMemberFunctionInvocationInput); ok {
+		out.ActionGroup = inv.Value.ActionGroup
+		out.Function = inv.Value.Function
+	}
+	return &types.InvocationResultMemberMemberFunctionResult{Value: out}
+}
+
+// Returns the model invocation metadata from a trace event, or nil if the trace isn't
+// for a model invocation. Usage is reported for the pre-processing, orchestration and
+// post-processing steps separately.
+func traceModelMetadata(trace types.Trace) *types.Metadata {
+	switch t := trace.(type) {
+	case *types.TraceMemberOrchestrationTrace:
+		if out, ok := t.Value.(*types.OrchestrationTraceMemberModelInvocationOutput); ok {
+			return out.Value.Metadata
+		}
+	case *types.TraceMemberPreProcessingTrace:
+		if out, ok := t.Value.(*types.PreProcessingTraceMemberModelInvocationOutput); ok {
+			return out.Value.Metadata
+		}
+	case *types.TraceMemberPostProcessingTrace:
+		if out, ok := t.Value.(*types.PostProcessingTraceMemberModelInvocationOutput); ok {
+			return out.Value.Metadata
+		}
+	}
+	return nil
 }
 
 // Create a base inline configuration for invoking a Bedrock Agent.
@@ -166,10 +607,16 @@ func (ba *BedrockAgent) makeBaseInput(sessionID string) bedrockagentruntime.Invo
 		Instruction:     aws.String(ba.Config.Instruction),
 		AgentName:       aws.String(ba.Config.AgentName),
 		KnowledgeBases:  ba.Config.Knowledgebases,
+		// Traces carry the token usage of each model invocation.
+		EnableTrace: aws.Bool(true),
 	}
-	if ba.Config.Functions != nil {
-		input.ActionGroups = []types.AgentActionGroup{
-			ba.Config.Functions.GetActionGroup(),
+	if len(ba.actionGroups) > 0 {
+		input.ActionGroups = ba.actionGroups
+	}
+	if ba.Config.GuardrailID != "" && ba.Config.GuardrailVersion != "" {
+		input.GuardrailConfiguration = &types.GuardrailConfigurationWithArn{
+			GuardrailIdentifier: aws.String(ba.Config.GuardrailID),
+			GuardrailVersion:    aws.String(ba.Config.GuardrailVersion),
 		}
 	}
 	return input
@@ -177,8 +624,20 @@ func (ba *BedrockAgent) makeBaseInput(sessionID string) bedrockagentruntime.Invo
 
 // Query the Bedrock Agent with the given prompt.
 func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error) {
+	return ba.QueryStream(ctx, inputText, sessionID, nil)
+}
 
-	client := getBedrockAgentRuntime()
+// Query the Bedrock Agent with the given prompt, emitting events to onEvent as the
+// response stream is consumed. onEvent may be nil.
+func (ba *BedrockAgent) QueryStream(ctx context.Context, inputText string, sessionID string,
+	onEvent StreamHandler) (QueryResult, error) {
+
+	emit := serializeHandler(onEvent)
+
+	client, err := ba.getClient(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
 
 	// We're using "inline" agents, meaning that we configure them each time we want to
 	// invoke them. This is more flexible than creating persistent agent resources in AWS
@@ -187,28 +646,61 @@ func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID s
 	// However, static agent configurations do have their use cases and can be a viable
 	// alternative.
 	input := ba.makeBaseInput(sessionID)
+	invoker := ba.newInvoker(client)
 
 	// Invoke the agent with the input text.
 	input.InputText = aws.String(inputText)
-	result, err := client.InvokeInlineAgent(ctx, &input)
+	current := &input
+	agentResponse, err := invoker.invoke(ctx, current)
 	if err != nil {
 		return QueryResult{}, fmt.Errorf("failed to invoke agent: %w", err)
 	}
+	// Whether the current stream has delivered text or return control yet.
+	delivered := false
 
 	var chunks []string
-	refs := []Reference{}
-	used_refs := make(map[string]bool)
+	// Citations and function references are collected together, without duplicates.
+	refs := newReferenceCollector(emit)
+	ctx = withReferenceCollector(ctx, refs)
+	var toolCalls []ToolCall
+	var usage Usage
+	budget := newToolBudget(ba.Config.MaxToolRounds, ba.Config.MaxToolCalls, ba.Config.MaxDuration)
+	exhausted := ""
+	intervened := false
+	// The usage and guardrail state before the current stream. A retried stream starts
+	// over from here, since the trace events of the failed attempt are sent again.
+	attemptUsage, attemptIntervened := usage, intervened
 
-	agentResponse := result.GetStream()
 	for {
 		// The response may appear in multiple events, especially longer responses.
 		ev, ok := <-agentResponse.Events()
 		if !ok {
-			if agentResponse.Err() != nil {
-				return QueryResult{}, fmt.Errorf("error receiving agent response: %w", agentResponse.Err())
+			if err := agentResponse.Err(); err != nil {
+				// A stream that fails before delivering anything (e.g., throttled) can be
+				// retried like a failed call. After that, retrying would repeat text or
+				// tool calls, so the error is returned. Only trace events can have
+				// arrived, and what they recorded is dropped so the retry doesn't count
+				// it twice.
+				if !delivered && invoker.retry(ctx, err) {
+					usage, intervened = attemptUsage, attemptIntervened
+					agentResponse.Close()
+					agentResponse, err = invoker.invoke(ctx, current)
+					if err != nil {
+						return QueryResult{}, fmt.Errorf("failed to invoke agent: %w", err)
+					}
+					continue
+				}
+				return QueryResult{}, fmt.Errorf("error receiving agent response: %w", err)
 			}
 			break
 		}
+		switch ev.(type) {
+		case *types.InlineAgentResponseStreamMemberChunk, *types.InlineAgentResponseStreamMemberReturnControl:
+			if !delivered {
+				delivered = true
+				invoker.succeeded()
+			}
+		}
 
 		switch v := ev.(type) {
 		case *types.InlineAgentResponseStreamMemberChunk:
@@ -216,6 +708,7 @@ func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID s
 
 			// We'll record all chunks and concatenate them at the end.
 			chunks = append(chunks, string(v.Value.Bytes))
+			emit(StreamEvent{Type: StreamEventText, Text: string(v.Value.Bytes)})
 
 			// In attribution, we can check for citations used. Citations are references
 			// to sources that were used for retrieval augmented generation. For example,
@@ -227,30 +720,10 @@ func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID s
 			if v.Value.Attribution != nil {
 				for _, citation := range v.Value.Attribution.Citations {
 
-					for _, ref := range citation.RetrievedReferences {
-						meta := make(map[string]string)
-						for k, val := range ref.Metadata {
-							var text string
-							_ = val.UnmarshalSmithyDocument(&text)
-							meta[k] = string(text)
-						}
-
-						// Dedup refs, in case multiple chunks are used from same source.
-						// Note this is only valid for knowledgebase metadata. If we start
-						// to support other sources, then we'd want a different
-						// deduplication strategy.
-						refKey := fmt.Sprintf("%s/%s",
-							meta["x-amz-bedrock-kb-data-source-id"],
-							meta["x-amz-bedrock-kb-source-uri"])
-						if used_refs[refKey] {
-							continue
-						}
-						used_refs[refKey] = true
-
-						refs = append(refs, Reference{
-							Type: "knowledgebase",
-							Data: meta,
-						})
+					for _, retrieved := range citation.RetrievedReferences {
+						// Duplicates are dropped, in case multiple chunks are used from
+						// the same source.
+						refs.add(knowledgebaseReference(retrieved.Metadata))
 					}
 				}
 			}
@@ -266,25 +739,35 @@ func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID s
 			// and then build a result for the model to continue with. This is basically
 			// submitted as a follow up message: e.g., the model is responding with a
 			// question, and our side is responding with an answer.
-			var results []types.InvocationResultMember
-			for _, rawInv := range v.Value.InvocationInputs {
-				switch inv := rawInv.(type) {
-				case *types.InvocationInputMemberMemberFunctionInvocationInput:
-					resultValue, err := ba.invokeFunction(ctx, inv.Value)
-					if err != nil {
-						log.Errorln("Function invocation error:", err)
-						// Fallthrough: the resultValue contains a valid FAILURE state
-						// that is sent back to the model.
-					}
-					result := types.InvocationResultMemberMemberFunctionResult{
-						Value: resultValue,
-					}
-					results = append(results, &result)
+			//
+			// Once a budget runs out, the model gets one more turn to wrap up. If it asks
+			// for tools again anyway, we stop with whatever answer we have so far.
+			if exhausted != "" {
+				log.Warnf("Agent kept calling tools after the %s budget ran out; stopping", exhausted)
+				agentResponse.Close()
+				return QueryResult{
+					Response:            strings.Join(chunks, ""),
+					Refs:                refs.list(),
+					ToolCalls:           toolCalls,
+					Usage:               usage,
+					Model:               invoker.currentModel(),
+					BudgetExhausted:     exhausted,
+					GuardrailIntervened: intervened,
+				}, nil
+			}
 
-					// We could also consider including this tool call and parameters as a
-					// Reference in the output.
-				default:
-					log.Panicln("Unsupported invocation input type")
+			inputs := v.Value.InvocationInputs
+			allowed, hit := budget.startRound(len(inputs))
+			results, calls, err := ba.invokeAll(ctx, inputs[:allowed], emit)
+			if err != nil {
+				return QueryResult{}, err
+			}
+			toolCalls = append(toolCalls, calls...)
+			if hit != "" {
+				log.Warnf("Agent tool budget exhausted (%s); asking the model to wrap up", hit)
+				exhausted = hit
+				for _, inv := range inputs[allowed:] {
+					results = append(results, budgetExhaustedResult(inv, hit))
 				}
 			}
 
@@ -294,19 +777,40 @@ func (ba *BedrockAgent) Query(ctx context.Context, inputText string, sessionID s
 				InvocationId:                   v.Value.InvocationId,
 				ReturnControlInvocationResults: results,
 			}
-			result, err := client.InvokeInlineAgent(ctx, &input)
+			agentResponse.Close()
+			current = &input
+			delivered = false
+			attemptUsage, attemptIntervened = usage, intervened
+			agentResponse, err = invoker.invoke(ctx, current)
 			if err != nil {
 				return QueryResult{}, fmt.Errorf(
-					"failed to invoke inline agent for return control: %v", err)
+					"failed to invoke inline agent for return control: %w", err)
+			}
+		case *types.InlineAgentResponseStreamMemberTrace:
+			// Traces describe the agent's steps. We look at them for usage and guardrail
+			// interventions.
+			if meta := traceModelMetadata(v.Value.Trace); meta != nil && meta.Usage != nil {
+				usage.addInvocation(
+					int64(aws.ToInt32(meta.Usage.InputTokens)),
+					int64(aws.ToInt32(meta.Usage.OutputTokens)))
+			}
+			if g, ok := v.Value.Trace.(*types.TraceMemberGuardrailTrace); ok &&
+				g.Value.Action == types.GuardrailActionIntervened {
+				log.Warnln("Guardrail intervened:", aws.ToString(g.Value.TraceId))
+				intervened = true
 			}
-			agentResponse = result.GetStream()
 		default:
-			fmt.Printf("Unexpected event type: %T\n", v)
+			log.Warnf("Unexpected event type: %T", v)
 		}
 	}
 
 	return QueryResult{
-		Response: strings.Join(chunks, ""),
-		Refs:     refs,
+		Response:            strings.Join(chunks, ""),
+		Refs:                refs.list(),
+		ToolCalls:           toolCalls,
+		Usage:               usage,
+		Model:               invoker.currentModel(),
+		BudgetExhausted:     exhausted,
+		GuardrailIntervened: intervened,
 	}, nil
 }
@@ -0,0 +1,850 @@
+package bricks_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+type FailRequest struct{}
+
+// The echo functions plus a "fail" function that always errors.
+func newBedrockTestFunctions() *bricks.FunctionSet {
+	fs := newEchoFunctions()
+	fs.AddFunction("fail", "Always fails", "", FailRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			return nil, errors.New("database is down")
+		})
+	return fs
+}
+
+func mustNewBedrockAgent(t *testing.T, config bricks.BedrockAgentConfig) bricks.Agent {
+	t.Helper()
+	agent, err := bricks.NewBedrockAgent(config)
+	if err != nil {
+		t.Fatalf("failed to create agent: %v", err)
+	}
+	return agent
+}
+
+func newScriptedAgent(t *testing.T, runtime *bricks.ScriptedBedrockRuntime) bricks.Agent {
+	return mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		AgentName:   "Test",
+		Model:       "test-model",
+		Instruction: "Be helpful.",
+		Functions:   []*bricks.FunctionSet{newBedrockTestFunctions()},
+		Client:      runtime,
+	})
+}
+
+// Return the function results sent back to the model in the given call.
+func returnedResults(t *testing.T, runtime *bricks.ScriptedBedrockRuntime, call int) []types.FunctionResult {
+	t.Helper()
+	state := runtime.Inputs[call].InlineSessionState
+	if state == nil {
+		t.Fatalf("call #%d has no session state", call)
+	}
+	var results []types.FunctionResult
+	for _, r := range state.ReturnControlInvocationResults {
+		results = append(results, r.(*types.InvocationResultMemberMemberFunctionResult).Value)
+	}
+	return results
+}
+
+func resultText(result types.FunctionResult) string {
+	return aws.ToString(result.ResponseBody["TEXT"].Body)
+}
+
+func TestBedrockAgentMultiRoundReturnControl(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "one"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-2",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "two")),
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "three"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockChunkEvent("Echoed "),
+				bricks.BedrockChunkEvent("everything."),
+			}},
+		},
+	}
+
+	result, err := newScriptedAgent(t, runtime).Query(context.Background(), "echo", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Echoed everything." {
+		t.Errorf("unexpected response %q", result.Response)
+	}
+	if len(runtime.Inputs) != 3 {
+		t.Fatalf("expected 3 invocations, got %d", len(runtime.Inputs))
+	}
+
+	if aws.ToString(runtime.Inputs[0].InputText) != "echo" {
+		t.Errorf("expected input text on the first call")
+	}
+	for _, input := range runtime.Inputs {
+		if aws.ToString(input.SessionId) != "session-1" {
+			t.Errorf("expected session ID on every call, got %q", aws.ToString(input.SessionId))
+		}
+	}
+
+	if id := aws.ToString(runtime.Inputs[2].InlineSessionState.InvocationId); id != "inv-2" {
+		t.Errorf("expected invocation ID inv-2, got %q", id)
+	}
+	results := returnedResults(t, runtime, 2)
+	if len(results) != 2 || resultText(results[0]) != "echo: two" || resultText(results[1]) != "echo: three" {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+func TestBedrockAgentDedupsReferences(t *testing.T) {
+	intro := map[string]string{
+		"x-amz-bedrock-kb-data-source-id": "ds",
+		"x-amz-bedrock-kb-source-uri":     "intro",
+		"header":                          "# Intro",
+	}
+	scanning := map[string]string{
+		"x-amz-bedrock-kb-data-source-id": "ds",
+		"x-amz-bedrock-kb-source-uri":     "scanning",
+		"header":                          "# Scanning",
+	}
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockChunkEvent("Part one. ", intro, intro),
+				bricks.BedrockChunkEvent("Part two.", scanning, intro),
+			}},
+		},
+	}
+
+	result, err := newScriptedAgent(t, runtime).Query(context.Background(), "docs?", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(result.Refs) != 2 {
+		t.Fatalf("expected 2 refs, got %d: %v", len(result.Refs), result.Refs)
+	}
+	if result.Refs[0].Data["header"] != "# Intro" || result.Refs[1].Data["header"] != "# Scanning" {
+		t.Errorf("unexpected refs %v", result.Refs)
+	}
+}
+
+func TestBedrockAgentFunctionReferences(t *testing.T) {
+	fs := bricks.NewFunctionSet("test")
+	fs.AddFunction("lookup", "Look up a record", "", EchoRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			var req EchoRequest
+			c.MustBind(&req)
+			c.AddReference(bricks.Reference{Type: "record", Key: req.Text, Data: map[string]string{"id": req.Text}})
+			return "found " + req.Text, nil
+		})
+	intro := map[string]string{"folder": "intro", "header": "# Intro"}
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "lookup", bricks.BedrockParam("text", "string", "a")),
+					bricks.BedrockFunctionInvocation("test", "lookup", bricks.BedrockParam("text", "string", "a"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-2",
+					bricks.BedrockFunctionInvocation("test", "lookup", bricks.BedrockParam("text", "string", "b"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockChunkEvent("Found them.", intro, intro),
+			}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		AgentName: "Test",
+		Model:     "test-model",
+		Functions: []*bricks.FunctionSet{fs},
+		Client:    runtime,
+	})
+
+	// The functions run concurrently, but events are delivered one at a time, so the
+	// handler doesn't need a lock.
+	var events []string
+	result, err := agent.(bricks.StreamingAgent).QueryStream(context.Background(), "find", "session-1",
+		func(ev bricks.StreamEvent) {
+			if ev.Type == bricks.StreamEventReference {
+				events = append(events, ev.Ref.Key)
+			}
+		})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	// Duplicates are dropped per type and key, whether they come from functions or
+	// citations.
+	var keys []string
+	for _, ref := range result.Refs {
+		keys = append(keys, ref.Type+":"+ref.Key)
+	}
+	if strings.Join(keys, ",") != "record:a,record:b,knowledgebase:intro## Intro" {
+		t.Errorf("unexpected refs %v", keys)
+	}
+	if len(events) != 3 {
+		t.Errorf("expected 3 reference events, got %v", events)
+	}
+}
+
+func TestBedrockAgentFunctionFailureIsSentToModel(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "fail"),
+					bricks.BedrockFunctionInvocation("other_group", "echo", bricks.BedrockParam("text", "string", "x"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockChunkEvent("Something went wrong."),
+			}},
+		},
+	}
+
+	result, err := newScriptedAgent(t, runtime).Query(context.Background(), "fail", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Something went wrong." {
+		t.Errorf("unexpected response %q", result.Response)
+	}
+
+	results := returnedResults(t, runtime, 1)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	for _, r := range results {
+		if r.ResponseState != types.ResponseStateFailure {
+			t.Errorf("expected FAILURE for %s, got %q", aws.ToString(r.Function), r.ResponseState)
+		}
+	}
+}
+
+func TestBedrockAgentInvokeErrors(t *testing.T) {
+	errThrottled := errors.New("throttled")
+	errStream := errors.New("connection reset")
+
+	cases := map[string][]bricks.ScriptedBedrockResponse{
+		"initial call": {
+			{InvokeErr: errThrottled},
+		},
+		"return control call": {
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "x"))),
+			}},
+			{InvokeErr: errThrottled},
+		},
+		"stream": {
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Partial")}, StreamErr: errStream},
+		},
+	}
+
+	for name, responses := range cases {
+		t.Run(name, func(t *testing.T) {
+			runtime := &bricks.ScriptedBedrockRuntime{Responses: responses}
+			_, err := newScriptedAgent(t, runtime).Query(context.Background(), "hi", "session-1")
+			if !errors.Is(err, errThrottled) && !errors.Is(err, errStream) {
+				t.Errorf("expected the scripted error to propagate, got %v", err)
+			}
+		})
+	}
+}
+
+type SlowRequest struct {
+	Text string `json:"text" desc:"Text to return" required:"true"`
+}
+
+func TestBedrockAgentRunsInvocationsConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+
+	fs := bricks.NewFunctionSet("test")
+	fs.AddFunction("slow", "Returns the text after a delay", "", SlowRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			var req SlowRequest
+			c.MustBind(&req)
+			mu.Lock()
+			active++
+			maxActive = max(maxActive, active)
+			mu.Unlock()
+
+			// Finish in reverse order so that stable ordering is actually tested.
+			delay := map[string]time.Duration{"a": 60, "b": 40, "c": 20, "d": 0}[req.Text]
+			time.Sleep(delay * time.Millisecond)
+
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return req.Text, nil
+		})
+
+	var invocations []types.FunctionInvocationInput
+	for _, text := range []string{"a", "b", "c", "d"} {
+		invocations = append(invocations,
+			bricks.BedrockFunctionInvocation("test", "slow", bricks.BedrockParam("text", "string", text)))
+	}
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockReturnControlEvent("inv-1", invocations...)}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Model:                    "test-model",
+		Functions:                []*bricks.FunctionSet{fs},
+		MaxConcurrentInvocations: 2,
+		Client:                   runtime,
+	})
+
+	if _, err := agent.Query(context.Background(), "compare", "session-1"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if maxActive != 2 {
+		t.Errorf("expected 2 concurrent invocations, got %d", maxActive)
+	}
+
+	results := returnedResults(t, runtime, 1)
+	var texts []string
+	for _, r := range results {
+		texts = append(texts, resultText(r))
+	}
+	if len(texts) != 4 || texts[0] != "a" || texts[1] != "b" || texts[2] != "c" || texts[3] != "d" {
+		t.Errorf("expected results in invocation order, got %v", texts)
+	}
+}
+
+func TestBedrockAgentCancelAbortsInvocations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := bricks.NewFunctionSet("test")
+	fs.AddFunction("block", "Blocks until cancelled", "", FailRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			cancel()
+			<-c.Done()
+			return nil, c.Err()
+		})
+
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "block"),
+					bricks.BedrockFunctionInvocation("test", "block")),
+			}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Not reached.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Model:     "test-model",
+		Functions: []*bricks.FunctionSet{fs},
+		Client:    runtime,
+	})
+
+	_, err := agent.Query(ctx, "block", "session-1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if len(runtime.Inputs) != 1 {
+		t.Errorf("expected no follow up call after cancelling, got %d calls", len(runtime.Inputs))
+	}
+}
+
+// A return control event asking to echo each of the given texts.
+func echoRound(id string, texts ...string) bricks.ScriptedBedrockResponse {
+	var invocations []types.FunctionInvocationInput
+	for _, text := range texts {
+		invocations = append(invocations,
+			bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", text)))
+	}
+	return bricks.ScriptedBedrockResponse{Events: []types.InlineAgentResponseStream{
+		bricks.BedrockReturnControlEvent(id, invocations...),
+	}}
+}
+
+func TestBedrockAgentToolBudgets(t *testing.T) {
+	wrapUp := bricks.ScriptedBedrockResponse{Events: []types.InlineAgentResponseStream{
+		bricks.BedrockChunkEvent("Here is what I found."),
+	}}
+
+	t.Run("rounds", func(t *testing.T) {
+		runtime := &bricks.ScriptedBedrockRuntime{Responses: []bricks.ScriptedBedrockResponse{
+			echoRound("inv-1", "a"), echoRound("inv-2", "b"), echoRound("inv-3", "c"), wrapUp,
+		}}
+		agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+			Functions: []*bricks.FunctionSet{newEchoFunctions()}, MaxToolRounds: 2, Client: runtime,
+		})
+		result, err := agent.Query(context.Background(), "loop", "session-1")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if result.BudgetExhausted != bricks.BudgetToolRounds || result.Response != "Here is what I found." {
+			t.Errorf("unexpected result %+v", result)
+		}
+		refused := returnedResults(t, runtime, 3)
+		if len(refused) != 1 || refused[0].ResponseState != types.ResponseStateFailure ||
+			!strings.Contains(resultText(refused[0]), "budget exhausted") {
+			t.Errorf("expected a budget exhausted result, got %v", refused)
+		}
+	})
+
+	t.Run("calls", func(t *testing.T) {
+		runtime := &bricks.ScriptedBedrockRuntime{Responses: []bricks.ScriptedBedrockResponse{
+			echoRound("inv-1", "a", "b", "c"), wrapUp,
+		}}
+		agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+			Functions: []*bricks.FunctionSet{newEchoFunctions()}, MaxToolCalls: 2, Client: runtime,
+		})
+		result, err := agent.Query(context.Background(), "loop", "session-1")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if result.BudgetExhausted != bricks.BudgetToolCalls {
+			t.Errorf("expected the tool call budget to be hit, got %q", result.BudgetExhausted)
+		}
+		results := returnedResults(t, runtime, 1)
+		if len(results) != 3 || resultText(results[1]) != "echo: b" ||
+			results[2].ResponseState != types.ResponseStateFailure {
+			t.Errorf("expected two calls to run and the third refused, got %v", results)
+		}
+	})
+
+	t.Run("duration", func(t *testing.T) {
+		runtime := &bricks.ScriptedBedrockRuntime{Responses: []bricks.ScriptedBedrockResponse{
+			echoRound("inv-1", "a"), wrapUp,
+		}}
+		agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+			Functions: []*bricks.FunctionSet{newEchoFunctions()}, MaxDuration: time.Nanosecond, Client: runtime,
+		})
+		time.Sleep(time.Millisecond)
+		result, err := agent.Query(context.Background(), "loop", "session-1")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if result.BudgetExhausted != bricks.BudgetDuration {
+			t.Errorf("expected the duration budget to be hit, got %q", result.BudgetExhausted)
+		}
+	})
+
+	t.Run("ignored wrap up", func(t *testing.T) {
+		runtime := &bricks.ScriptedBedrockRuntime{Responses: []bricks.ScriptedBedrockResponse{
+			echoRound("inv-1", "a"), echoRound("inv-2", "b"), echoRound("inv-3", "c"),
+		}}
+		agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+			Functions: []*bricks.FunctionSet{newEchoFunctions()}, MaxToolRounds: -1, MaxToolCalls: 1, Client: runtime,
+		})
+		result, err := agent.Query(context.Background(), "loop", "session-1")
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		if result.BudgetExhausted != bricks.BudgetToolCalls || len(runtime.Inputs) != 3 {
+			t.Errorf("expected to stop after the wrap up turn, got %+v after %d calls", result, len(runtime.Inputs))
+		}
+	})
+}
+
+func TestBedrockAgentRecordsToolCalls(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			echoRound("inv-1", "one", long),
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-2", bricks.BedrockFunctionInvocation("test", "fail")),
+			}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+
+	result, err := newScriptedAgent(t, runtime).Query(context.Background(), "trace", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	calls := result.ToolCalls
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 tool calls, got %d", len(calls))
+	}
+
+	if calls[0].ActionGroup != "test" || calls[0].Function != "echo" ||
+		string(calls[0].Params) != `{"text":"one"}` || calls[0].Result != "echo: one" ||
+		calls[0].State != "" || calls[0].Error != "" {
+		t.Errorf("unexpected first call %+v", calls[0])
+	}
+	if len(calls[1].Result) > 2100 || !strings.HasSuffix(calls[1].Result, "(truncated)") {
+		t.Errorf("expected a truncated result, got %d bytes", len(calls[1].Result))
+	}
+	if calls[2].Function != "fail" || calls[2].State != string(types.ResponseStateFailure) ||
+		!strings.Contains(calls[2].Error, "database is down") {
+		t.Errorf("unexpected failed call %+v", calls[2])
+	}
+}
+
+func TestBedrockAgentUsage(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockUsageTraceEvent(1000, 50),
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "x"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockUsageTraceEvent(1200, 300),
+				bricks.BedrockChunkEvent("Done."),
+			}},
+		},
+	}
+
+	result, err := newScriptedAgent(t, runtime).Query(context.Background(), "usage", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if !aws.ToBool(runtime.Inputs[0].EnableTrace) {
+		t.Errorf("expected traces to be enabled")
+	}
+	want := bricks.Usage{InputTokens: 2200, OutputTokens: 350, Invocations: 2, MaxInputTokens: 1200}
+	if result.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, result.Usage)
+	}
+
+	// Inference profile prefixes are stripped for the price lookup.
+	cost, ok := result.Usage.EstimateCost("us.anthropic.claude-3-7-sonnet-20250219-v1:0")
+	if !ok || cost < 0.01185 || cost > 0.01186 {
+		t.Errorf("unexpected cost %v (known=%v)", cost, ok)
+	}
+	if _, ok := result.Usage.EstimateCost("unknown-model"); ok {
+		t.Errorf("expected no price for an unknown model")
+	}
+}
+
+func TestBedrockAgentRoutesByActionGroup(t *testing.T) {
+	threats := bricks.NewFunctionSet("threats")
+	threats.AddFunction("echo", "Echo with a different prefix", "", EchoRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			var req EchoRequest
+			c.MustBind(&req)
+			return "threats: " + req.Text, nil
+		})
+
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("threats", "echo", bricks.BedrockParam("text", "string", "a")),
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "b"))),
+			}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Functions: []*bricks.FunctionSet{newEchoFunctions(), threats},
+		Client:    runtime,
+	})
+
+	if _, err := agent.Query(context.Background(), "route", "session-1"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	groups := runtime.Inputs[0].ActionGroups
+	if len(groups) != 2 || aws.ToString(groups[0].ActionGroupName) != "test" ||
+		aws.ToString(groups[1].ActionGroupName) != "threats" {
+		t.Errorf("expected an action group per function set, got %d", len(groups))
+	}
+	results := returnedResults(t, runtime, 1)
+	if len(results) != 2 || resultText(results[0]) != "threats: a" || resultText(results[1]) != "echo: b" {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+type ManyParamsRequest struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	C string `json:"c"`
+	D string `json:"d"`
+	E string `json:"e"`
+	F string `json:"f"`
+}
+
+type TaggedRequest struct {
+	Query  string `json:"query,omitempty" desc:"The query" required:"true"`
+	Limit  int    `json:"limit,omitempty"`
+	Hidden string `json:"-"`
+}
+
+type NestedRequest struct {
+	Filter struct{ Name string } `json:"filter"`
+}
+
+func TestBedrockAgentSplitsLargeFunctionSets(t *testing.T) {
+	fs := bricks.NewFunctionSet("big")
+	for i := range 23 {
+		name := fmt.Sprintf("fn_%02d", i)
+		fs.AddFunction(name, "Returns its name", "", FailRequest{},
+			func(c bricks.FunctionContext) (any, error) { return name, nil })
+	}
+
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1", bricks.BedrockFunctionInvocation("big_3", "fn_22")),
+			}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Functions: []*bricks.FunctionSet{fs},
+		Client:    runtime,
+	})
+	if _, err := agent.Query(context.Background(), "big", "session-1"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	groups := runtime.Inputs[0].ActionGroups
+	var names []string
+	var sizes []int
+	for _, g := range groups {
+		names = append(names, aws.ToString(g.ActionGroupName))
+		sizes = append(sizes, len(g.FunctionSchema.(*types.FunctionSchemaMemberFunctions).Value))
+	}
+	if fmt.Sprint(names) != "[big big_2 big_3]" || fmt.Sprint(sizes) != "[11 11 1]" {
+		t.Errorf("unexpected split %v %v", names, sizes)
+	}
+	if results := returnedResults(t, runtime, 1); resultText(results[0]) != "fn_22" {
+		t.Errorf("expected the call to route to the split group, got %v", results)
+	}
+}
+
+func TestNewBedrockAgentChecksLimits(t *testing.T) {
+	handler := func(c bricks.FunctionContext) (any, error) { return nil, nil }
+	cases := map[string]func(fs *bricks.FunctionSet){
+		"name": func(fs *bricks.FunctionSet) {
+			fs.AddFunction("bad name", "Has a space", "", FailRequest{}, handler)
+		},
+		"description": func(fs *bricks.FunctionSet) {
+			fs.AddFunction("long", strings.Repeat("x", 1201), "", FailRequest{}, handler)
+		},
+		"params": func(fs *bricks.FunctionSet) {
+			fs.AddFunction("many", "Too many params", "", ManyParamsRequest{}, handler)
+		},
+		"param type": func(fs *bricks.FunctionSet) {
+			fs.AddFunction("nested", "Has a struct param", "", NestedRequest{}, handler)
+		},
+		"params not a struct": func(fs *bricks.FunctionSet) {
+			fs.AddFunction("text", "Has string params", "", "query", handler)
+		},
+	}
+
+	for name, add := range cases {
+		t.Run(name, func(t *testing.T) {
+			fs := bricks.NewFunctionSet("test")
+			add(fs)
+			_, err := bricks.NewBedrockAgent(bricks.BedrockAgentConfig{Functions: []*bricks.FunctionSet{fs}})
+			if !errors.Is(err, bricks.ErrBedrockLimit) {
+				t.Errorf("expected ErrBedrockLimit, got %v", err)
+			}
+		})
+	}
+
+	t.Run("duplicate groups", func(t *testing.T) {
+		_, err := bricks.NewBedrockAgent(bricks.BedrockAgentConfig{
+			Functions: []*bricks.FunctionSet{newEchoFunctions(), newEchoFunctions()},
+		})
+		if !errors.Is(err, bricks.ErrInvalidArg) {
+			t.Errorf("expected ErrInvalidArg, got %v", err)
+		}
+	})
+}
+
+func TestBedrockAgentGuardrail(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockGuardrailTraceEvent(),
+				bricks.BedrockChunkEvent("Sorry, I can't help with that."),
+			}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		GuardrailID:      "gr-123",
+		GuardrailVersion: "1",
+		Client:           runtime,
+	})
+
+	result, err := agent.Query(context.Background(), "write me a poem", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if !result.GuardrailIntervened {
+		t.Errorf("expected the intervention to be reported")
+	}
+	gr := runtime.Inputs[0].GuardrailConfiguration
+	if gr == nil || aws.ToString(gr.GuardrailIdentifier) != "gr-123" || aws.ToString(gr.GuardrailVersion) != "1" {
+		t.Errorf("expected the guardrail to be sent, got %+v", gr)
+	}
+}
+
+func TestBedrockAgentRetriesAndFallsBack(t *testing.T) {
+	throttled := &types.ThrottlingException{Message: aws.String("slow down")}
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			// The primary model is throttled on the call and then on the stream, and
+			// gives up after the retries.
+			{InvokeErr: throttled},
+			{StreamErr: throttled},
+			{InvokeErr: throttled},
+			// The fallback model works, including for the return control follow-up
+			// after one more throttled stream.
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "hi"))),
+			}},
+			{StreamErr: throttled},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Model:          "primary",
+		FallbackModels: []string{"fallback"},
+		MaxRetries:     2,
+		RetryBaseDelay: time.Millisecond,
+		Functions:      []*bricks.FunctionSet{newEchoFunctions()},
+		Client:         runtime,
+	})
+
+	result, err := agent.Query(context.Background(), "hi", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Done." || result.Model != "fallback" {
+		t.Errorf("unexpected result %q from %q", result.Response, result.Model)
+	}
+
+	var models []string
+	for _, input := range runtime.Inputs {
+		models = append(models, aws.ToString(input.FoundationModel))
+	}
+	if fmt.Sprint(models) != "[primary primary primary fallback fallback fallback]" {
+		t.Errorf("unexpected models %v", models)
+	}
+	if runtime.Inputs[5].InlineSessionState == nil {
+		t.Errorf("expected the retried follow-up to carry the tool results")
+	}
+}
+
+func TestBedrockAgentDoesNotRetryOtherErrors(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{InvokeErr: &types.ValidationException{Message: aws.String("bad input")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		FallbackModels: []string{"fallback"},
+		RetryBaseDelay: time.Millisecond,
+		Client:         runtime,
+	})
+	if _, err := agent.Query(context.Background(), "hi", "session-1"); err == nil {
+		t.Fatalf("expected the validation error")
+	}
+	if len(runtime.Inputs) != 1 {
+		t.Errorf("expected a single call, got %d", len(runtime.Inputs))
+	}
+}
+
+func TestBedrockAgentRetryDropsFailedAttemptUsage(t *testing.T) {
+	throttled := &types.ThrottlingException{Message: aws.String("slow down")}
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockUsageTraceEvent(100, 10),
+				bricks.BedrockReturnControlEvent("inv-1",
+					bricks.BedrockFunctionInvocation("test", "echo", bricks.BedrockParam("text", "string", "hi"))),
+			}},
+			// The follow-up stream fails after its trace events arrived, and is retried.
+			{
+				Events: []types.InlineAgentResponseStream{
+					bricks.BedrockUsageTraceEvent(200, 20),
+					bricks.BedrockGuardrailTraceEvent(),
+				},
+				StreamErr: throttled,
+			},
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockUsageTraceEvent(200, 20),
+				bricks.BedrockChunkEvent("Done."),
+			}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Model:          "test-model",
+		MaxRetries:     1,
+		RetryBaseDelay: time.Millisecond,
+		Functions:      []*bricks.FunctionSet{newEchoFunctions()},
+		Client:         runtime,
+	})
+
+	result, err := agent.Query(context.Background(), "hi", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Done." || len(runtime.Inputs) != 3 {
+		t.Fatalf("unexpected result %q after %d calls", result.Response, len(runtime.Inputs))
+	}
+	want := bricks.Usage{InputTokens: 300, OutputTokens: 30, Invocations: 2, MaxInputTokens: 200}
+	if result.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, result.Usage)
+	}
+	if result.GuardrailIntervened {
+		t.Errorf("the failed attempt's guardrail trace shouldn't count")
+	}
+}
+
+func TestBedrockAgentFunctionDefinitions(t *testing.T) {
+	// Descriptions are limited by characters, not bytes, and tag options aren't part of
+	// the parameter names.
+	fs := bricks.NewFunctionSet("tagged")
+	fs.AddFunction("search", strings.Repeat("é", 1200), "", TaggedRequest{},
+		func(c bricks.FunctionContext) (any, error) { return nil, nil })
+
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Done.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		Functions: []*bricks.FunctionSet{fs},
+		Client:    runtime,
+	})
+	if _, err := agent.Query(context.Background(), "search", "session-1"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+
+	defs := runtime.Inputs[0].ActionGroups[0].FunctionSchema.(*types.FunctionSchemaMemberFunctions).Value
+	params := defs[0].Parameters
+	var names []string
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[limit query]" {
+		t.Fatalf("unexpected parameters %v", names)
+	}
+	if params["query"].Type != types.ParameterTypeString || !aws.ToBool(params["query"].Required) ||
+		params["limit"].Type != types.ParameterTypeInteger {
+		t.Errorf("unexpected parameter details %+v", params)
+	}
+}
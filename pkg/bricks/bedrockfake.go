@@ -0,0 +1,212 @@
+package bricks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// ScriptedBedrockRuntime is a fake BedrockAgentRuntime that replays a script of
+// responses, one per InvokeInlineAgent call. It lets the agent loop (return control,
+// citations, failures) be exercised without AWS access, e.g.:
+//
+//	runtime := &bricks.ScriptedBedrockRuntime{
+//		Responses: []bricks.ScriptedBedrockResponse{
+//			{Events: []types.InlineAgentResponseStream{
+//				bricks.BedrockReturnControlEvent("inv-1",
+//					bricks.BedrockFunctionInvocation("bishopfox", "query_assets",
+//						bricks.BedrockParam("query", "string", "SELECT 1"))),
+//			}},
+//			{Events: []types.InlineAgentResponseStream{
+//				bricks.BedrockChunkEvent("You have 1 asset."),
+//			}},
+//		},
+//	}
+//	agent, err := bricks.NewBedrockAgent(bricks.BedrockAgentConfig{Client: runtime, ...})
+type ScriptedBedrockRuntime struct {
+	mu sync.Mutex
+	// Responses in the order they are returned.
+	Responses []ScriptedBedrockResponse
+	// Inputs received so far, in order. Useful for checking what was sent back to the
+	// model during return control.
+	Inputs []*bedrockagentruntime.InvokeInlineAgentInput
+}
+
+// One scripted reply to InvokeInlineAgent.
+type ScriptedBedrockResponse struct {
+	// Returned from InvokeInlineAgent itself, e.g., a throttling error.
+	InvokeErr error
+	// Events delivered on the response stream.
+	Events []types.InlineAgentResponseStream
+	// Reported by the stream after all events were delivered, e.g., a dropped connection.
+	StreamErr error
+}
+
+// Return the next scripted response. Errors if the script has run out.
+func (f *ScriptedBedrockRuntime) InvokeInlineAgent(ctx context.Context,
+	input *bedrockagentruntime.InvokeInlineAgentInput) (bedrockagentruntime.InlineAgentResponseStreamReader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.Inputs = append(f.Inputs, input)
+	if len(f.Responses) == 0 {
+		return nil, fmt.Errorf("scripted bedrock runtime: no response left for call #%d", len(f.Inputs))
+	}
+	resp := f.Responses[0]
+	f.Responses = f.Responses[1:]
+
+	if resp.InvokeErr != nil {
+		return nil, resp.InvokeErr
+	}
+
+	events := make(chan types.InlineAgentResponseStream, len(resp.Events))
+	for _, ev := range resp.Events {
+		events <- ev
+	}
+	close(events)
+	return &scriptedBedrockStream{events: events, err: resp.StreamErr}, nil
+}
+
+// A stream that has already received all of its events.
+type scriptedBedrockStream struct {
+	events chan types.InlineAgentResponseStream
+	err    error
+}
+
+func (s *scriptedBedrockStream) Events() <-chan types.InlineAgentResponseStream { return s.events }
+func (s *scriptedBedrockStream) Close() error                                   { return nil }
+func (s *scriptedBedrockStream) Err() error                                     { return s.err }
+
+// Create a chunk event with the given text. Each citation is the metadata of a retrieved
+// knowledgebase reference, e.g., {"header": "# Intro", "folder": "docs"}.
+func BedrockChunkEvent(text string, citations ...map[string]string) types.InlineAgentResponseStream {
+	payload := types.InlineAgentPayloadPart{
+		Bytes: []byte(text),
+	}
+	if len(citations) > 0 {
+		var refs []types.RetrievedReference
+		for _, citation := range citations {
+			meta := make(map[string]document.Interface)
+			for k, v := range citation {
+				meta[k] = document.NewLazyDocument(v)
+			}
+			refs = append(refs, types.RetrievedReference{Metadata: meta})
+		}
+		payload.Attribution = &types.Attribution{
+			Citations: []types.Citation{{RetrievedReferences: refs}},
+		}
+	}
+	return &types.InlineAgentResponseStreamMemberChunk{Value: payload}
+}
+
+// Create a RETURN_CONTROL event asking for the given function invocations.
+func BedrockReturnControlEvent(invocationID string, invocations ...types.FunctionInvocationInput) types.InlineAgentResponseStream {
+	var inputs []types.InvocationInputMember
+	for _, inv := range invocations {
+		inputs = append(inputs, &types.InvocationInputMemberMemberFunctionInvocationInput{Value: inv})
+	}
+	return &types.InlineAgentResponseStreamMemberReturnControl{
+		Value: types.InlineAgentReturnControlPayload{
+			InvocationId:     aws.String(invocationID),
+			InvocationInputs: inputs,
+		},
+	}
+}
+
+// Create a function invocation input for a RETURN_CONTROL event.
+func BedrockFunctionInvocation(actionGroup string, function string, params ...types.FunctionParameter) types.FunctionInvocationInput {
+	return types.FunctionInvocationInput{
+		ActionGroup: aws.String(actionGroup),
+		Function:    aws.String(function),
+		Parameters:  params,
+	}
+}
+
+// Create a function parameter. The type is a Bedrock parameter type, e.g., "string" or
+// "integer", and the value is always sent as a string, the same as Bedrock does.
+func BedrockParam(name string, paramType string, value string) types.FunctionParameter {
+	return types.FunctionParameter{
+		Name:  aws.String(name),
+		Type:  aws.String(paramType),
+		Value: aws.String(value),
+	}
+}
+
+// Create a RETURN_CONTROL event asking for API invocations from an OpenAPI-schema action
+// group.
+func BedrockAPIReturnControlEvent(invocationID string, invocations ...types.ApiInvocationInput) types.InlineAgentResponseStream {
+	var inputs []types.InvocationInputMember
+	for _, inv := range invocations {
+		inputs = append(inputs, &types.InvocationInputMemberMemberApiInvocationInput{Value: inv})
+	}
+	return &types.InlineAgentResponseStreamMemberReturnControl{
+		Value: types.InlineAgentReturnControlPayload{
+			InvocationId:     aws.String(invocationID),
+			InvocationInputs: inputs,
+		},
+	}
+}
+
+// Create an API invocation input for the function, with the params in a JSON request
+// body as Bedrock sends them for the OpenAPI document from FunctionSet.OpenAPIDocument.
+func BedrockAPIInvocation(actionGroup string, function string, params ...types.Parameter) types.ApiInvocationInput {
+	return types.ApiInvocationInput{
+		ActionGroup: aws.String(actionGroup),
+		ApiPath:     aws.String("/" + function),
+		HttpMethod:  aws.String("POST"),
+		RequestBody: &types.ApiRequestBody{
+			Content: map[string]types.PropertyParameters{
+				"application/json": {Properties: params},
+			},
+		},
+	}
+}
+
+// Create a request body parameter for an API invocation. Arrays and objects are given as
+// JSON strings.
+func BedrockAPIParam(name string, paramType string, value string) types.Parameter {
+	return types.Parameter{
+		Name:  aws.String(name),
+		Type:  aws.String(paramType),
+		Value: aws.String(value),
+	}
+}
+
+// Create a trace event reporting a guardrail intervention.
+func BedrockGuardrailTraceEvent() types.InlineAgentResponseStream {
+	return &types.InlineAgentResponseStreamMemberTrace{
+		Value: types.InlineAgentTracePart{
+			Trace: &types.TraceMemberGuardrailTrace{
+				Value: types.GuardrailTrace{
+					Action:  types.GuardrailActionIntervened,
+					TraceId: aws.String("guardrail-trace"),
+				},
+			},
+		},
+	}
+}
+
+// Create a trace event reporting the token usage of one orchestration model invocation.
+func BedrockUsageTraceEvent(inputTokens int32, outputTokens int32) types.InlineAgentResponseStream {
+	return &types.InlineAgentResponseStreamMemberTrace{
+		Value: types.InlineAgentTracePart{
+			Trace: &types.TraceMemberOrchestrationTrace{
+				Value: &types.OrchestrationTraceMemberModelInvocationOutput{
+					Value: types.OrchestrationModelInvocationOutput{
+						Metadata: &types.Metadata{
+							Usage: &types.Usage{
+								InputTokens:  aws.Int32(inputTokens),
+								OutputTokens: aws.Int32(outputTokens),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package bricks
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// Bedrock Agent limits for function-based action groups. The SDK doesn't check these, so
+// a function set that breaks them is only rejected when the agent is invoked, with a
+// validation error that doesn't say much. See the Bedrock quotas and the
+// FunctionDefinition API reference.
+const (
+	bedrockMaxFunctionsPerGroup      = 11
+	bedrockMaxActionGroups           = 20
+	bedrockMaxParamsPerFunction      = 5
+	bedrockMaxFunctionDescriptionLen = 1200
+	bedrockMaxParamDescriptionLen    = 500
+)
+
+// Names of action groups, functions and parameters.
+var bedrockNamePattern = regexp.MustCompile(`^([0-9a-zA-Z][_-]?){1,100}$`)
+
+// A function set breaks one of the Bedrock Agent limits.
+var ErrBedrockLimit = errors.New("bedrock limit exceeded")
+
+// Check a function definition against the Bedrock limits.
+func validateBedrockFunction(setName string, def types.FunctionDefinition) error {
+	name := aws.ToString(def.Name)
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%w; function %s.%s: %s", ErrBedrockLimit, setName, name,
+			fmt.Sprintf(format, args...))
+	}
+
+	if !bedrockNamePattern.MatchString(name) {
+		return fail("name must match %s", bedrockNamePattern)
+	}
+	if n := utf8.RuneCountInString(aws.ToString(def.Description)); n == 0 || n > bedrockMaxFunctionDescriptionLen {
+		return fail("description is %d characters, must be 1 to %d; put the rest in the extended description",
+			n, bedrockMaxFunctionDescriptionLen)
+	}
+	if len(def.Parameters) > bedrockMaxParamsPerFunction {
+		return fail("has %d parameters, max is %d", len(def.Parameters), bedrockMaxParamsPerFunction)
+	}
+	for param, detail := range def.Parameters {
+		if !bedrockNamePattern.MatchString(param) {
+			return fail("parameter %q: name must match %s", param, bedrockNamePattern)
+		}
+		if n := utf8.RuneCountInString(aws.ToString(detail.Description)); n > bedrockMaxParamDescriptionLen {
+			return fail("parameter %s: description is %d characters, max is %d",
+				param, n, bedrockMaxParamDescriptionLen)
+		}
+	}
+	return nil
+}
+
+// Convert the function set into Bedrock Agent action groups, checking it against the
+// Bedrock limits. In the future this could be expanded to detect what functions are
+// actually relevant to the user's query, and only use that subset of functions to
+// optimize performance. Too many actions can easily confuse the model on what its
+// purpose is.
+//
+// Bedrock Agents are limited to a max of 11 actions per group. Sets with more functions
+// than fit in one group are split into several groups named <name>, <name>_2, <name>_3
+// and so on, with functions assigned in name order so the split is stable between
+// requests.
+//
+// Limits that can't be worked around, like a description that is too long or a parameter
+// type Bedrock can't describe, are returned as an ErrBedrockLimit error naming the
+// function.
+func (fs *FunctionSet) GetActionGroups() ([]types.AgentActionGroup, error) {
+	if !bedrockNamePattern.MatchString(fs.Name) {
+		return nil, fmt.Errorf("%w; function set %q: name must match %s",
+			ErrBedrockLimit, fs.Name, bedrockNamePattern)
+	}
+
+	names := make([]string, 0, len(fs.Functions))
+	for name := range fs.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	var defs []types.FunctionDefinition
+	for _, name := range names {
+		def, err := createBedrockFunctionDefinition(fs.Name, fs.Functions[name])
+		if err == nil {
+			err = validateBedrockFunction(fs.Name, def)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		defs = append(defs, def)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	var groups []types.AgentActionGroup
+	for start := 0; start < len(defs); start += bedrockMaxFunctionsPerGroup {
+		end := min(start+bedrockMaxFunctionsPerGroup, len(defs))
+		groupName := fs.Name
+		if start > 0 {
+			groupName = fmt.Sprintf("%s_%d", fs.Name, start/bedrockMaxFunctionsPerGroup+1)
+		}
+		groups = append(groups, newBedrockActionGroup(groupName, defs[start:end]))
+	}
+	return groups, nil
+}
+
+// Create a RETURN_CONTROL action group with the given functions.
+func newBedrockActionGroup(name string, functions []types.FunctionDefinition) types.AgentActionGroup {
+	return types.AgentActionGroup{
+		ActionGroupName: aws.String(name),
+		FunctionSchema: &types.FunctionSchemaMemberFunctions{
+			Value: functions,
+		},
+		ActionGroupExecutor: &types.ActionGroupExecutorMemberCustomControl{
+			Value: types.CustomControlMethodReturnControl,
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package bricks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultMaxRetries = 3
+const defaultRetryBaseDelay = 500 * time.Millisecond
+const maxRetryDelay = 10 * time.Second
+
+// Returns true if the error is worth trying again: throttling, server-side failures and
+// dropped connections. The SDK retries the HTTP request itself, but not errors that
+// arrive on the event stream, which is where Bedrock reports most throttling for agents.
+func isRetryableBedrockError(err error) bool {
+	var throttling *types.ThrottlingException
+	var quota *types.ServiceQuotaExceededException
+	var internal *types.InternalServerException
+	var badGateway *types.BadGatewayException
+	var dependency *types.DependencyFailedException
+	var notReady *types.ModelNotReadyException
+	var netErr net.Error
+	switch {
+	case errors.As(err, &throttling), errors.As(err, &quota), errors.As(err, &internal),
+		errors.As(err, &badGateway), errors.As(err, &dependency), errors.As(err, &notReady):
+		return true
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	}
+	return false
+}
+
+// Returns true if the error means the model can't serve us right now, so a fallback
+// model should be tried.
+func isModelUnavailableError(err error) bool {
+	var throttling *types.ThrottlingException
+	var quota *types.ServiceQuotaExceededException
+	var notReady *types.ModelNotReadyException
+	return errors.As(err, &throttling) || errors.As(err, &quota) || errors.As(err, &notReady)
+}
+
+// The delay before retry number attempt (0-based): exponential backoff from the base
+// delay, with jitter so that concurrent requests throttled together don't all retry at
+// the same moment.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := min(base<<attempt, maxRetryDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+// Retries and model fallback for the InvokeInlineAgent calls of a single query. The
+// model switch sticks for the rest of the query, including return control follow-ups.
+type bedrockInvoker struct {
+	client     BedrockAgentRuntime
+	models     []string
+	model      int
+	maxRetries int
+	baseDelay  time.Duration
+	// Retries made since the last successful response.
+	attempt int
+}
+
+func (ba *BedrockAgent) newInvoker(client BedrockAgentRuntime) *bedrockInvoker {
+	return &bedrockInvoker{
+		client:     client,
+		models:     append([]string{ba.Config.Model}, ba.Config.FallbackModels...),
+		maxRetries: max(budgetOrDefault(ba.Config.MaxRetries, defaultMaxRetries), 0),
+		baseDelay:  budgetOrDefault(ba.Config.RetryBaseDelay, defaultRetryBaseDelay),
+	}
+}
+
+// The model currently in use.
+func (inv *bedrockInvoker) currentModel() string {
+	return inv.models[inv.model]
+}
+
+// Call InvokeInlineAgent with the current model, retrying and falling back as needed.
+func (inv *bedrockInvoker) invoke(ctx context.Context,
+	input *bedrockagentruntime.InvokeInlineAgentInput) (bedrockagentruntime.InlineAgentResponseStreamReader, error) {
+	for {
+		// Each attempt gets its own copy, so the caller's input isn't changed.
+		attemptInput := *input
+		attemptInput.FoundationModel = aws.String(inv.currentModel())
+		stream, err := inv.client.InvokeInlineAgent(ctx, &attemptInput)
+		if err == nil {
+			return stream, nil
+		}
+		if !inv.retry(ctx, err) {
+			return nil, err
+		}
+	}
+}
+
+// Decide whether to try again after an error, and wait before doing so. Retryable errors
+// are retried with the same model up to maxRetries times. After that, if the model is
+// throttled or unavailable, the next fallback model is used if there is one.
+//
+// Returns false if the error should be returned to the caller.
+func (inv *bedrockInvoker) retry(ctx context.Context, err error) bool {
+	if isRetryableBedrockError(err) && inv.attempt < inv.maxRetries {
+		delay := retryDelay(inv.baseDelay, inv.attempt)
+		inv.attempt++
+		log.WithError(err).
+			WithField("model", inv.currentModel()).
+			WithField("attempt", inv.attempt).
+			Warnf("Retryable agent error; retrying in %v", delay)
+		select {
+		case <-time.After(delay):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if isModelUnavailableError(err) && inv.model+1 < len(inv.models) {
+		inv.model++
+		inv.attempt = 0
+		log.WithError(err).
+			WithField("model", inv.currentModel()).
+			Warn("Model unavailable; falling back")
+		return ctx.Err() == nil
+	}
+	return false
+}
+
+// Record a successful response, resetting the retry count.
+func (inv *bedrockInvoker) succeeded() {
+	inv.attempt = 0
+}
@@ -0,0 +1,72 @@
+package bricks
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default tool budgets for a single query, used by every agent that runs a tool loop.
+// Without them, a model stuck on something like fixing a bad SQL query can keep calling
+// tools until the HTTP client times out.
+const defaultMaxToolRounds = 10
+const defaultMaxToolCalls = 30
+const defaultMaxDuration = 2 * time.Minute
+
+// Returns the configured value, or the default if it's zero.
+func budgetOrDefault[T int | time.Duration](value T, def T) T {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// Tracks the tool budgets of a single query.
+type toolBudget struct {
+	maxRounds   int
+	maxCalls    int
+	maxDuration time.Duration
+	deadline    time.Time
+	rounds      int
+	calls       int
+}
+
+// Create the budget for a query from the agent's limits. Zero uses the default, negative
+// means no limit.
+func newToolBudget(maxRounds int, maxCalls int, maxDuration time.Duration) *toolBudget {
+	b := &toolBudget{
+		maxRounds:   budgetOrDefault(maxRounds, defaultMaxToolRounds),
+		maxCalls:    budgetOrDefault(maxCalls, defaultMaxToolCalls),
+		maxDuration: budgetOrDefault(maxDuration, defaultMaxDuration),
+	}
+	if b.maxDuration > 0 {
+		b.deadline = time.Now().Add(b.maxDuration)
+	}
+	return b
+}
+
+// Start a round of the given number of tool calls. Returns how many of the calls may
+// run, and which budget was hit if not all of them can.
+func (b *toolBudget) startRound(calls int) (int, string) {
+	if b.maxRounds > 0 && b.rounds >= b.maxRounds {
+		return 0, BudgetToolRounds
+	}
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return 0, BudgetDuration
+	}
+	b.rounds++
+
+	allowed, exhausted := calls, ""
+	if b.maxCalls > 0 && b.calls+calls > b.maxCalls {
+		allowed, exhausted = max(b.maxCalls-b.calls, 0), BudgetToolCalls
+	}
+	b.calls += allowed
+	return allowed, exhausted
+}
+
+// The result text sent back in place of a function call that was refused because the
+// budget ran out. It asks the model to wrap up, since a bare failure tends to be retried.
+func budgetExhaustedMessage(budget string) string {
+	return fmt.Sprintf("Tool budget exhausted (%s). No more tools can be called for this "+
+		"question. Answer now with the information you already have, and mention anything "+
+		"you could not look up.", budget)
+}
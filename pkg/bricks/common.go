@@ -1,6 +1,7 @@
 // Package bricks provides utilities for querying AI agents with tool support. For
 // example, we have a BedrockAgent implementation that leverages action groups and the
-// Bedrock Agent Runtime to satisfy queries.
+// Bedrock Agent Runtime to satisfy queries, and an AnthropicAgent that runs the tool-use
+// loop itself against the Anthropic Messages API.
 //
 // In addition, we have an MCP binder to expose functions as MCP tools via the mcp-go
 // library.
@@ -8,27 +9,93 @@ package bricks
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sync"
+	"unicode/utf8"
 )
 
 var ErrInvalidArg = fmt.Errorf("invalid argument")
 
 // "References" link back to what sources were used while answering a query. Bedrock calls
 // them "citations" in its responses when it references knowledgebases or other resources.
+//
+// The agents record knowledgebase references themselves. Functions can add other types,
+// e.g., the records they looked up, with FunctionContext.AddReference.
 type Reference struct {
-	// One of [knowledgebase] (only one reference type implemented currently.
+	// The kind of source, e.g., ReferenceKnowledgebase. Each type has its own Data
+	// fields, and the application decides how to show it.
 	Type string `json:"type"`
+	// Identifies the source within its type, so the same source is only listed once per
+	// answer, e.g., a document section or a record ID.
+	Key string `json:"key"`
 	// The reference data, e.g., this could contain a URL, Bedrock knowledgebase ID, etc.
 	// Freeform key-value store.
-	Data map[string]string
+	Data map[string]string `json:"data"`
 }
 
 // Result of an agent query. Includes the text response and any references used.
 type QueryResult struct {
 	Response string
 	Refs     []Reference
+	// Every function invocation made while answering, in order.
+	ToolCalls []ToolCall
+	// Model token usage across every invocation made while answering.
+	Usage Usage
+	// The model that answered, if the agent can switch models (e.g., Bedrock fallback
+	// models). Empty means the configured model.
+	Model string
+	// If the agent ran out of tool budget while answering, which limit was hit. One of
+	// the Budget* constants, or empty if the query finished within budget.
+	BudgetExhausted string
+	// True if a guardrail blocked or masked the input or the response. The response is
+	// then the guardrail's blocked message rather than an answer. Only the Bedrock agent
+	// supports guardrails.
+	GuardrailIntervened bool
+}
+
+// A record of one function invocation made while answering a query. This is for
+// debugging and for showing users what the answer is based on, e.g., the SQL that was
+// run.
+type ToolCall struct {
+	ActionGroup string `json:"action_group"`
+	Function    string `json:"function"`
+	// Parameters the model passed, as a JSON object.
+	Params json.RawMessage `json:"params"`
+	// How long the function took to run.
+	DurationMS int64 `json:"duration_ms"`
+	// Response state sent back to the model. Empty on success, otherwise e.g. FAILURE.
+	State string `json:"state,omitempty"`
+	// The result text sent to the model, truncated to keep traces small.
+	Result string `json:"result,omitempty"`
+	// The error if the function failed. This isn't shown to the model.
+	Error string `json:"error,omitempty"`
 }
 
+// Results longer than this are truncated in ToolCall records.
+const maxToolCallResultLen = 2000
+
+// Truncate the text to at most n bytes without splitting a UTF-8 sequence.
+func truncateText(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n] + "... (truncated)"
+}
+
+// Tool budgets that can be exhausted during a query. See QueryResult.BudgetExhausted.
+const (
+	// Too many rounds of tool calls.
+	BudgetToolRounds = "tool_rounds"
+	// Too many tool calls in total.
+	BudgetToolCalls = "tool_calls"
+	// The query took too long.
+	BudgetDuration = "duration"
+)
+
 type Agent interface {
 	// Query the agent with the input text. The session ID should be a unique string that
 	// can be issued again later to continue the same session.
@@ -38,3 +105,58 @@ type Agent interface {
 	// calls. Or a SessionHandle interface if we need to be more flexible.
 	Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error)
 }
+
+// Types of StreamEvent.
+const (
+	// A piece of the answer text.
+	StreamEventText = "text"
+	// The model asked for a function to be invoked, and it is starting.
+	StreamEventToolStart = "tool_start"
+	// A function invocation finished.
+	StreamEventToolEnd = "tool_end"
+	// A reference was used in the answer.
+	StreamEventReference = "reference"
+)
+
+// An event emitted while an answer is being produced. Only the fields relevant to the
+// event type are set.
+type StreamEvent struct {
+	Type string `json:"type"`
+	// Text delta for text events. Consumers may also put a display form of the reference
+	// here for reference events.
+	Text string `json:"text,omitempty"`
+	// Function name for tool events.
+	Function string `json:"function,omitempty"`
+	// For tool_end events, true if the function failed.
+	Failed bool `json:"failed,omitempty"`
+	// For reference events, the reference that was used.
+	Ref *Reference `json:"ref,omitempty"`
+}
+
+// Receives stream events. The agents deliver events one at a time, even when functions
+// run concurrently, so handlers don't need their own locking. They should not block for
+// long, since the agent is waiting on them.
+type StreamHandler func(StreamEvent)
+
+// Wrap the handler so that events are delivered one at a time. Functions can run
+// concurrently and emit tool and reference events from their own goroutines. Returns a
+// no-op handler if onEvent is nil.
+func serializeHandler(onEvent StreamHandler) StreamHandler {
+	if onEvent == nil {
+		return func(StreamEvent) {}
+	}
+	var mu sync.Mutex
+	return func(ev StreamEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		onEvent(ev)
+	}
+}
+
+// A StreamingAgent can report progress while a query is running, rather than only
+// returning the joined answer at the end. The final QueryResult is still returned once
+// the query completes.
+type StreamingAgent interface {
+	Agent
+	QueryStream(ctx context.Context, inputText string, sessionID string, onEvent StreamHandler) (QueryResult, error)
+}
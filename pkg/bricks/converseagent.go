@@ -0,0 +1,512 @@
+package bricks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	agenttypes "github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// ConverseAgent is an agent implementation on top of the Bedrock Runtime ConverseStream
+// API. Compared to inline agents, Converse takes plain JSON schemas for tools (nested
+// objects, arrays, no 11 action limit), and there is no hidden orchestration: this agent
+// runs the tool loop itself and keeps the message history on our side.
+//
+// Converse has no knowledgebase integration, so configured knowledgebases are offered to
+// the model as a search_knowledgebase tool backed by the Retrieve API. Retrieved chunks
+// produce the same "knowledgebase" references as BedrockAgent citations.
+type ConverseAgent struct {
+	Config ConverseAgentConfig
+}
+
+// Configuration input for a ConverseAgent, passed to NewConverseAgent.
+type ConverseAgentConfig struct {
+	// Model ID or inference profile, e.g., us.anthropic.claude-3-7-sonnet-20250219-v1:0.
+	Model string
+	// System prompt.
+	Instruction string
+	Functions   *FunctionSet
+	// Knowledgebases searched by the search_knowledgebase tool.
+	Knowledgebases []ConverseKnowledgebase
+	// Maximum tokens to generate per response. Zero uses the model default.
+	MaxTokens int32
+	// Runtime client. If nil, a shared client is created from the default AWS config.
+	Client ConverseRuntime
+	// Client for knowledgebase retrieval. If nil, the Bedrock Agent Runtime client is
+	// used.
+	Retriever KnowledgebaseRetriever
+	// Conversation history keyed by session ID. If nil, the agent creates its own. Share
+	// one history between agent instances to keep sessions alive across requests.
+	History *SessionHistory[types.Message]
+	// Tool budgets for a single query, the same as BedrockAgentConfig. Zero uses the
+	// default, negative means no limit.
+	MaxToolRounds int
+	MaxToolCalls  int
+	MaxDuration   time.Duration
+}
+
+// A knowledgebase that the ConverseAgent can search.
+type ConverseKnowledgebase struct {
+	ID string
+	// Shown to the model in the search tool description.
+	Description string
+}
+
+// The subset of the Bedrock Runtime client used by the ConverseAgent. The SDK output
+// type hides its event stream, so this returns the stream reader directly.
+type ConverseRuntime interface {
+	ConverseStream(ctx context.Context, input *bedrockruntime.ConverseStreamInput) (bedrockruntime.ConverseStreamOutputReader, error)
+}
+
+// The subset of the Bedrock Agent Runtime client used to search knowledgebases.
+type KnowledgebaseRetriever interface {
+	Retrieve(ctx context.Context, params *bedrockagentruntime.RetrieveInput,
+		optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveOutput, error)
+}
+
+// Adapts the AWS client to ConverseRuntime.
+type awsConverseRuntime struct {
+	client *bedrockruntime.Client
+}
+
+func (r awsConverseRuntime) ConverseStream(ctx context.Context,
+	input *bedrockruntime.ConverseStreamInput) (bedrockruntime.ConverseStreamOutputReader, error) {
+	out, err := r.client.ConverseStream(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return out.GetStream(), nil
+}
+
+// Name of the built-in tool for knowledgebase search. It takes precedence over a function
+// with the same name.
+const converseKnowledgebaseTool = "search_knowledgebase"
+
+type converseKnowledgebaseParams struct {
+	Query string `json:"query" desc:"What to search for, phrased as a question or keywords" required:"true"`
+}
+
+// Create a new agent that uses the Bedrock Runtime ConverseStream API.
+func NewConverseAgent(config ConverseAgentConfig) Agent {
+	if config.History == nil {
+		config.History = NewSessionHistory[types.Message]()
+	}
+	return &ConverseAgent{
+		Config: config,
+	}
+}
+
+// The shared Bedrock Runtime client, created on first use. Loading the AWS config reads
+// files and may call the credential providers, so it's done once, not per query.
+var bedrockRuntimeClient *bedrockruntime.Client
+var bedrockRuntimeMu sync.Mutex
+
+// Returns the shared Bedrock Runtime client, creating it from the default AWS config on
+// first use.
+func getBedrockRuntime(ctx context.Context) (*bedrockruntime.Client, error) {
+	bedrockRuntimeMu.Lock()
+	defer bedrockRuntimeMu.Unlock()
+
+	if bedrockRuntimeClient == nil {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		bedrockRuntimeClient = bedrockruntime.NewFromConfig(cfg)
+	}
+
+	return bedrockRuntimeClient, nil
+}
+
+// Returns the configured runtime client, or the shared AWS client if none is set.
+func (ca *ConverseAgent) getClient(ctx context.Context) (ConverseRuntime, error) {
+	if ca.Config.Client != nil {
+		return ca.Config.Client, nil
+	}
+	client, err := getBedrockRuntime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return awsConverseRuntime{client: client}, nil
+}
+
+// Build the toolConfig from the function set and knowledgebases. Returns nil when there
+// are no tools, since Converse rejects an empty tool list.
+func (ca *ConverseAgent) makeToolConfig() *types.ToolConfiguration {
+	var tools []types.Tool
+
+	if ca.Config.Functions != nil {
+		for _, fn := range ca.Config.Functions.Functions {
+			if fn.Name == converseKnowledgebaseTool && len(ca.Config.Knowledgebases) > 0 {
+				continue
+			}
+			tools = append(tools, &types.ToolMemberToolSpec{
+				Value: types.ToolSpecification{
+					Name:        aws.String(fn.Name),
+					Description: aws.String(fn.FullDescription()),
+					InputSchema: &types.ToolInputSchemaMemberJson{
+						Value: document.NewLazyDocument(jsonSchemaForParams(fn.Params)),
+					},
+				},
+			})
+		}
+	}
+
+	if len(ca.Config.Knowledgebases) > 0 {
+		desc := "Search the documentation knowledgebases. Returns the most relevant sections. Available knowledgebases:"
+		for _, kb := range ca.Config.Knowledgebases {
+			desc += "\n- " + kb.Description
+		}
+		tools = append(tools, &types.ToolMemberToolSpec{
+			Value: types.ToolSpecification{
+				Name:        aws.String(converseKnowledgebaseTool),
+				Description: aws.String(desc),
+				InputSchema: &types.ToolInputSchemaMemberJson{
+					Value: document.NewLazyDocument(jsonSchemaForParams(converseKnowledgebaseParams{})),
+				},
+			},
+		})
+	}
+
+	if len(tools) == 0 {
+		return nil
+	}
+	return &types.ToolConfiguration{Tools: tools}
+}
+
+// Content block being assembled from stream deltas.
+type converseBlockBuilder struct {
+	text    strings.Builder
+	toolUse *types.ToolUseBlockStart
+	input   strings.Builder
+}
+
+// Consume one ConverseStream response and assemble the assistant message from it. Text
+// deltas are emitted as they arrive, and the token usage is added to usage.
+func (ca *ConverseAgent) readStream(stream bedrockruntime.ConverseStreamOutputReader,
+	emit StreamHandler, usage *Usage) (types.Message, types.StopReason, error) {
+	defer stream.Close()
+
+	blocks := map[int32]*converseBlockBuilder{}
+	getBlock := func(index *int32) *converseBlockBuilder {
+		i := aws.ToInt32(index)
+		if blocks[i] == nil {
+			blocks[i] = &converseBlockBuilder{}
+		}
+		return blocks[i]
+	}
+
+	var stopReason types.StopReason
+	for ev := range stream.Events() {
+		switch v := ev.(type) {
+		case *types.ConverseStreamOutputMemberContentBlockStart:
+			if start, ok := v.Value.Start.(*types.ContentBlockStartMemberToolUse); ok {
+				getBlock(v.Value.ContentBlockIndex).toolUse = &start.Value
+			}
+		case *types.ConverseStreamOutputMemberContentBlockDelta:
+			block := getBlock(v.Value.ContentBlockIndex)
+			switch delta := v.Value.Delta.(type) {
+			case *types.ContentBlockDeltaMemberText:
+				block.text.WriteString(delta.Value)
+				emit(StreamEvent{Type: StreamEventText, Text: delta.Value})
+			case *types.ContentBlockDeltaMemberToolUse:
+				block.input.WriteString(aws.ToString(delta.Value.Input))
+			}
+		case *types.ConverseStreamOutputMemberMessageStop:
+			stopReason = v.Value.StopReason
+		case *types.ConverseStreamOutputMemberMetadata:
+			if u := v.Value.Usage; u != nil {
+				usage.addInvocation(int64(aws.ToInt32(u.InputTokens)), int64(aws.ToInt32(u.OutputTokens)))
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return types.Message{}, "", fmt.Errorf("error receiving converse response: %w", err)
+	}
+
+	indexes := make([]int32, 0, len(blocks))
+	for i := range blocks {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+
+	msg := types.Message{Role: types.ConversationRoleAssistant}
+	for _, i := range indexes {
+		block := blocks[i]
+		if block.toolUse != nil {
+			// The input arrives as a JSON string in pieces. The message history needs it
+			// as a document.
+			input := map[string]any{}
+			if block.input.Len() > 0 {
+				if err := json.Unmarshal([]byte(block.input.String()), &input); err != nil {
+					return types.Message{}, "", fmt.Errorf("invalid tool input from model: %w", err)
+				}
+			}
+			msg.Content = append(msg.Content, &types.ContentBlockMemberToolUse{
+				Value: types.ToolUseBlock{
+					ToolUseId: block.toolUse.ToolUseId,
+					Name:      block.toolUse.Name,
+					Input:     document.NewLazyDocument(input),
+				},
+			})
+		} else if block.text.Len() > 0 {
+			msg.Content = append(msg.Content, &types.ContentBlockMemberText{Value: block.text.String()})
+		}
+	}
+
+	return msg, stopReason, nil
+}
+
+// Search the configured knowledgebases and format the results for the model. New
+// references are passed to addRef.
+func (ca *ConverseAgent) searchKnowledgebases(ctx context.Context, input []byte,
+	addRef func(Reference)) (string, error) {
+
+	var params converseKnowledgebaseParams
+	if err := json.Unmarshal(input, &params); err != nil || params.Query == "" {
+		return "", fmt.Errorf("%w; query is required", ErrInvalidArg)
+	}
+
+	retriever := ca.Config.Retriever
+	if retriever == nil {
+		client, err := getBedrockAgentRuntime(ctx)
+		if err != nil {
+			return "", err
+		}
+		retriever = client
+	}
+
+	var results []string
+	for _, kb := range ca.Config.Knowledgebases {
+		out, err := retriever.Retrieve(ctx, &bedrockagentruntime.RetrieveInput{
+			KnowledgeBaseId: aws.String(kb.ID),
+			RetrievalQuery:  &agenttypes.KnowledgeBaseQuery{Text: aws.String(params.Query)},
+		})
+		if err != nil {
+			return "", fmt.Errorf("knowledgebase %s retrieval failed: %w", kb.ID, err)
+		}
+		for _, result := range out.RetrievalResults {
+			if result.Content == nil || result.Content.Text == nil {
+				continue
+			}
+			addRef(knowledgebaseReference(result.Metadata))
+			results = append(results, fmt.Sprintf("<result>\n%s\n</result>", *result.Content.Text))
+		}
+	}
+
+	if len(results) == 0 {
+		return "No relevant documentation was found.", nil
+	}
+	return strings.Join(results, "\n"), nil
+}
+
+// Invoke the function (or knowledgebase search) for a toolUse block and return the
+// toolResult block to send back. Failures are reported to the model with an error status
+// rather than failing the query.
+func (ca *ConverseAgent) invokeTool(ctx context.Context, toolUse types.ToolUseBlock,
+	addRef func(Reference)) (types.ToolResultBlock, error) {
+
+	out := types.ToolResultBlock{
+		ToolUseId: toolUse.ToolUseId,
+		Status:    types.ToolResultStatusError,
+	}
+	name := aws.ToString(toolUse.Name)
+
+	input := []byte("{}")
+	if toolUse.Input != nil {
+		var err error
+		input, err = toolUse.Input.MarshalSmithyDocument()
+		if err != nil {
+			return out, fmt.Errorf("failed to marshal tool input: %w", err)
+		}
+	}
+
+	var text string
+	var err error
+	if name == converseKnowledgebaseTool && len(ca.Config.Knowledgebases) > 0 {
+		text, err = ca.searchKnowledgebases(ctx, input, addRef)
+	} else if ca.Config.Functions == nil {
+		err = fmt.Errorf("%w; function %s is not defined", ErrNoFunction, name)
+	} else {
+		var result any
+		result, err = ca.Config.Functions.Invoke(ctx, name, input)
+		if err == nil {
+			text, err = formatFunctionResult(result)
+		}
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrInvalidArg) || errors.Is(err, ErrNoFunction) {
+			text = fmt.Sprintf("function invocation failed; %v", err)
+		} else {
+			text = "function invocation failed unexpectedly"
+		}
+	} else {
+		out.Status = types.ToolResultStatusSuccess
+	}
+	out.Content = []types.ToolResultContentBlock{
+		&types.ToolResultContentBlockMemberText{Value: text},
+	}
+	return out, err
+}
+
+// The assistant message kept in the history when the tool loop is stopped: the message
+// without its toolUse blocks.
+func stoppedConverseMessage(msg types.Message) types.Message {
+	out := types.Message{Role: msg.Role}
+	for _, block := range msg.Content {
+		if _, ok := block.(*types.ContentBlockMemberToolUse); !ok {
+			out.Content = append(out.Content, block)
+		}
+	}
+	if len(out.Content) == 0 {
+		out.Content = []types.ContentBlock{
+			&types.ContentBlockMemberText{Value: "(Stopped: the tool budget ran out.)"},
+		}
+	}
+	return out
+}
+
+// Query the model with the given prompt.
+func (ca *ConverseAgent) Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error) {
+	return ca.QueryStream(ctx, inputText, sessionID, nil)
+}
+
+// Query the model with the given prompt, emitting events as the response streams in. The
+// tool-use loop runs until the model stops asking for tools or the tool budget runs out.
+// onEvent may be nil.
+func (ca *ConverseAgent) QueryStream(ctx context.Context, inputText string, sessionID string,
+	onEvent StreamHandler) (QueryResult, error) {
+
+	emit := serializeHandler(onEvent)
+
+	client, err := ca.getClient(ctx)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	// Knowledgebase results and function references are collected together, without
+	// duplicates.
+	refs := newReferenceCollector(emit)
+	addRef := refs.add
+	ctx = withReferenceCollector(ctx, refs)
+
+	messages := ca.Config.History.Get(sessionID)
+	messages = append(messages, types.Message{
+		Role:    types.ConversationRoleUser,
+		Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: inputText}},
+	})
+
+	var chunks []string
+	var usage Usage
+	toolConfig := ca.makeToolConfig()
+	budget := newToolBudget(ca.Config.MaxToolRounds, ca.Config.MaxToolCalls, ca.Config.MaxDuration)
+	exhausted := ""
+	for {
+		input := bedrockruntime.ConverseStreamInput{
+			ModelId:    aws.String(ca.Config.Model),
+			Messages:   messages,
+			ToolConfig: toolConfig,
+		}
+		if ca.Config.Instruction != "" {
+			input.System = []types.SystemContentBlock{
+				&types.SystemContentBlockMemberText{Value: ca.Config.Instruction},
+			}
+		}
+		if ca.Config.MaxTokens > 0 {
+			input.InferenceConfig = &types.InferenceConfiguration{
+				MaxTokens: aws.Int32(ca.Config.MaxTokens),
+			}
+		}
+
+		stream, err := client.ConverseStream(ctx, &input)
+		if err != nil {
+			return QueryResult{}, fmt.Errorf("failed to invoke converse: %w", err)
+		}
+		msg, stopReason, err := ca.readStream(stream, emit, &usage)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		messages = append(messages, msg)
+
+		var toolUses []types.ToolUseBlock
+		for _, block := range msg.Content {
+			switch v := block.(type) {
+			case *types.ContentBlockMemberText:
+				chunks = append(chunks, v.Value)
+			case *types.ContentBlockMemberToolUse:
+				toolUses = append(toolUses, v.Value)
+			}
+		}
+
+		if stopReason != types.StopReasonToolUse || len(toolUses) == 0 {
+			break
+		}
+
+		// Once a budget runs out, the model gets one more turn to wrap up. If it asks
+		// for tools again anyway, we stop with whatever answer we have so far. The
+		// toolUse blocks are dropped from the history, since Converse rejects a toolUse
+		// without a result.
+		if exhausted != "" {
+			log.Warnf("Agent kept calling tools after the %s budget ran out; stopping", exhausted)
+			messages[len(messages)-1] = stoppedConverseMessage(msg)
+			break
+		}
+
+		allowed, hit := budget.startRound(len(toolUses))
+		var toolResults []types.ContentBlock
+		for _, toolUse := range toolUses[:allowed] {
+			function := aws.ToString(toolUse.Name)
+			emit(StreamEvent{Type: StreamEventToolStart, Function: function})
+			result, err := ca.invokeTool(ctx, toolUse, addRef)
+			if err != nil {
+				log.Errorln("Function invocation error:", err)
+			}
+			emit(StreamEvent{Type: StreamEventToolEnd, Function: function, Failed: err != nil})
+			toolResults = append(toolResults, &types.ContentBlockMemberToolResult{Value: result})
+		}
+		if hit != "" {
+			log.Warnf("Agent tool budget exhausted (%s); asking the model to wrap up", hit)
+			exhausted = hit
+			for _, toolUse := range toolUses[allowed:] {
+				toolResults = append(toolResults, &types.ContentBlockMemberToolResult{
+					Value: types.ToolResultBlock{
+						ToolUseId: toolUse.ToolUseId,
+						Status:    types.ToolResultStatusError,
+						Content: []types.ToolResultContentBlock{
+							&types.ToolResultContentBlockMemberText{Value: budgetExhaustedMessage(hit)},
+						},
+					},
+				})
+			}
+		}
+
+		messages = append(messages, types.Message{
+			Role:    types.ConversationRoleUser,
+			Content: toolResults,
+		})
+	}
+
+	ca.Config.History.Set(sessionID, messages)
+
+	return QueryResult{
+		Response:        strings.Join(chunks, ""),
+		Refs:            refs.list(),
+		Usage:           usage,
+		BudgetExhausted: exhausted,
+	}, nil
+}
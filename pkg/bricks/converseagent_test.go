@@ -0,0 +1,217 @@
+package bricks_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	agentdocument "github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/document"
+	agenttypes "github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+type fakeConverseStream struct {
+	events chan types.ConverseStreamOutput
+}
+
+func (s *fakeConverseStream) Events() <-chan types.ConverseStreamOutput { return s.events }
+func (s *fakeConverseStream) Close() error                              { return nil }
+func (s *fakeConverseStream) Err() error                                { return nil }
+
+// Replays one scripted response per ConverseStream call and records the inputs.
+type fakeConverseRuntime struct {
+	responses [][]types.ConverseStreamOutput
+	inputs    []*bedrockruntime.ConverseStreamInput
+}
+
+func (f *fakeConverseRuntime) ConverseStream(ctx context.Context,
+	input *bedrockruntime.ConverseStreamInput) (bedrockruntime.ConverseStreamOutputReader, error) {
+	f.inputs = append(f.inputs, input)
+	events := make(chan types.ConverseStreamOutput, len(f.responses[0]))
+	for _, ev := range f.responses[0] {
+		events <- ev
+	}
+	close(events)
+	f.responses = f.responses[1:]
+	return &fakeConverseStream{events: events}, nil
+}
+
+type fakeRetriever struct{}
+
+func (fakeRetriever) Retrieve(ctx context.Context, params *bedrockagentruntime.RetrieveInput,
+	optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveOutput, error) {
+	result := agenttypes.KnowledgeBaseRetrievalResult{
+		Content: &agenttypes.RetrievalResultContent{Text: aws.String("Connect Azure like this.")},
+		Metadata: map[string]agentdocument.Interface{
+			"x-amz-bedrock-kb-source-uri": agentdocument.NewLazyDocument("azure"),
+			"header":                      agentdocument.NewLazyDocument("# Azure"),
+			"folder":                      agentdocument.NewLazyDocument("cosmos-documentation"),
+		},
+	}
+	// The same chunk twice, to check deduplication.
+	return &bedrockagentruntime.RetrieveOutput{
+		RetrievalResults: []agenttypes.KnowledgeBaseRetrievalResult{result, result},
+	}, nil
+}
+
+func textDelta(index int32, text string) types.ConverseStreamOutput {
+	return &types.ConverseStreamOutputMemberContentBlockDelta{Value: types.ContentBlockDeltaEvent{
+		ContentBlockIndex: aws.Int32(index),
+		Delta:             &types.ContentBlockDeltaMemberText{Value: text},
+	}}
+}
+
+func toolUse(index int32, id string, name string, inputParts ...string) []types.ConverseStreamOutput {
+	events := []types.ConverseStreamOutput{
+		&types.ConverseStreamOutputMemberContentBlockStart{Value: types.ContentBlockStartEvent{
+			ContentBlockIndex: aws.Int32(index),
+			Start: &types.ContentBlockStartMemberToolUse{Value: types.ToolUseBlockStart{
+				ToolUseId: aws.String(id),
+				Name:      aws.String(name),
+			}},
+		}},
+	}
+	for _, part := range inputParts {
+		events = append(events, &types.ConverseStreamOutputMemberContentBlockDelta{Value: types.ContentBlockDeltaEvent{
+			ContentBlockIndex: aws.Int32(index),
+			Delta:             &types.ContentBlockDeltaMemberToolUse{Value: types.ToolUseBlockDelta{Input: aws.String(part)}},
+		}})
+	}
+	return events
+}
+
+func messageStop(reason types.StopReason) types.ConverseStreamOutput {
+	return &types.ConverseStreamOutputMemberMessageStop{Value: types.MessageStopEvent{StopReason: reason}}
+}
+
+func TestConverseAgentToolsAndKnowledgebase(t *testing.T) {
+	var first []types.ConverseStreamOutput
+	first = append(first, textDelta(0, "Checking. "))
+	first = append(first, toolUse(1, "tool-1", "echo", `{"te`, `xt":"hi"}`)...)
+	first = append(first, toolUse(2, "tool-2", "search_knowledgebase", `{"query":"azure"}`)...)
+	first = append(first, messageStop(types.StopReasonToolUse))
+
+	runtime := &fakeConverseRuntime{
+		responses: [][]types.ConverseStreamOutput{
+			first,
+			{textDelta(0, "All "), textDelta(0, "done."), messageStop(types.StopReasonEndTurn)},
+		},
+	}
+
+	agent := bricks.NewConverseAgent(bricks.ConverseAgentConfig{
+		Model:       "test-model",
+		Instruction: "Be helpful.",
+		Functions:   newEchoFunctions(),
+		Knowledgebases: []bricks.ConverseKnowledgebase{
+			{ID: "KB1", Description: "Cosmos documentation"},
+		},
+		Client:    runtime,
+		Retriever: fakeRetriever{},
+	})
+
+	var textEvents int
+	result, err := agent.(bricks.StreamingAgent).QueryStream(context.Background(), "hello", "s1",
+		func(ev bricks.StreamEvent) {
+			if ev.Type == bricks.StreamEventText {
+				textEvents++
+			}
+		})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Checking. All done." {
+		t.Errorf("unexpected response %q", result.Response)
+	}
+	if textEvents != 3 {
+		t.Errorf("expected 3 text events, got %d", textEvents)
+	}
+	if len(result.Refs) != 1 || result.Refs[0].Type != "knowledgebase" ||
+		result.Refs[0].Data["header"] != "# Azure" {
+		t.Errorf("unexpected refs %v", result.Refs)
+	}
+
+	if len(runtime.inputs[0].ToolConfig.Tools) != 2 {
+		t.Errorf("expected echo and search_knowledgebase tools, got %d", len(runtime.inputs[0].ToolConfig.Tools))
+	}
+
+	// The follow up carries both tool results in a single user message.
+	messages := runtime.inputs[1].Messages
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages in the follow up, got %d", len(messages))
+	}
+	var results []types.ToolResultBlock
+	for _, block := range messages[2].Content {
+		results = append(results, block.(*types.ContentBlockMemberToolResult).Value)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 tool results, got %d", len(results))
+	}
+	echo := results[0].Content[0].(*types.ToolResultContentBlockMemberText).Value
+	if aws.ToString(results[0].ToolUseId) != "tool-1" || echo != "echo: hi" ||
+		results[0].Status != types.ToolResultStatusSuccess {
+		t.Errorf("unexpected echo result %v %q", results[0], echo)
+	}
+}
+
+func TestConverseAgentToolBudget(t *testing.T) {
+	var first []types.ConverseStreamOutput
+	first = append(first, toolUse(0, "tool-1", "echo", `{"text":"one"}`)...)
+	first = append(first, toolUse(1, "tool-2", "echo", `{"text":"two"}`)...)
+	first = append(first, messageStop(types.StopReasonToolUse))
+
+	// Asks for tools again after being told to wrap up.
+	second := append(toolUse(0, "tool-3", "echo", `{"text":"three"}`), messageStop(types.StopReasonToolUse))
+
+	runtime := &fakeConverseRuntime{responses: [][]types.ConverseStreamOutput{first, second}}
+	agent := bricks.NewConverseAgent(bricks.ConverseAgentConfig{
+		Model:        "test-model",
+		Functions:    newEchoFunctions(),
+		Client:       runtime,
+		MaxToolCalls: 1,
+	})
+
+	result, err := agent.Query(context.Background(), "loop", "s1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.BudgetExhausted != bricks.BudgetToolCalls {
+		t.Errorf("expected the tool_calls budget to be exhausted, got %q", result.BudgetExhausted)
+	}
+	if len(runtime.inputs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(runtime.inputs))
+	}
+
+	// The first call runs and the second is refused with a message asking the model to
+	// wrap up.
+	messages := runtime.inputs[1].Messages
+	var results []types.ToolResultBlock
+	for _, block := range messages[len(messages)-1].Content {
+		results = append(results, block.(*types.ContentBlockMemberToolResult).Value)
+	}
+	if len(results) != 2 || results[0].Status != types.ToolResultStatusSuccess {
+		t.Fatalf("unexpected tool results %v", results)
+	}
+	refused := results[1].Content[0].(*types.ToolResultContentBlockMemberText).Value
+	if aws.ToString(results[1].ToolUseId) != "tool-2" || results[1].Status != types.ToolResultStatusError ||
+		!strings.Contains(refused, "Tool budget exhausted") {
+		t.Errorf("unexpected refused tool result %v %q", results[1], refused)
+	}
+
+	// The unanswered tool call isn't kept in the history, so the next query is valid.
+	runtime.responses = [][]types.ConverseStreamOutput{
+		{textDelta(0, "Hello."), messageStop(types.StopReasonEndTurn)},
+	}
+	if _, err := agent.Query(context.Background(), "next", "s1"); err != nil {
+		t.Fatalf("next query failed: %v", err)
+	}
+	history := runtime.inputs[2].Messages
+	for _, block := range history[len(history)-2].Content {
+		if _, ok := block.(*types.ContentBlockMemberToolUse); ok {
+			t.Errorf("the stopped message still has a toolUse block")
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package bricks
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// An Embedder turns text into vectors for similarity search. Vectors from the same
+// Embedder must have the same length, and are compared with cosine similarity.
+//
+// A hosted embedding model (e.g., Titan embeddings on Bedrock) can implement this for
+// better matching. HashedTFIDFEmbedder is a local, deterministic implementation that
+// needs no network access, which also makes it suitable for tests.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// HashedTFIDFEmbedder embeds text as TF-IDF weighted term counts, with terms hashed into
+// a fixed number of dimensions. Document frequencies come from the corpus given to
+// NewHashedTFIDFEmbedder, so terms that appear in every document (e.g., "asset" in a set
+// of asset tools) count for less than distinctive ones.
+type HashedTFIDFEmbedder struct {
+	dims int
+	idf  map[string]float64
+	// IDF for terms that aren't in the corpus. These are treated as the rarest terms.
+	unknownIDF float64
+}
+
+const defaultEmbeddingDims = 512
+
+// Create a HashedTFIDFEmbedder with document frequencies from the corpus. dims is the
+// vector length; zero uses a default of 512.
+func NewHashedTFIDFEmbedder(corpus []string, dims int) *HashedTFIDFEmbedder {
+	if dims <= 0 {
+		dims = defaultEmbeddingDims
+	}
+
+	df := make(map[string]int)
+	for _, doc := range corpus {
+		seen := make(map[string]bool)
+		for _, term := range tokenize(doc) {
+			if !seen[term] {
+				seen[term] = true
+				df[term]++
+			}
+		}
+	}
+
+	// Smoothed IDF, the same as scikit-learn's default.
+	n := float64(len(corpus))
+	idf := make(map[string]float64, len(df))
+	for term, count := range df {
+		idf[term] = math.Log((1+n)/(1+float64(count))) + 1
+	}
+
+	return &HashedTFIDFEmbedder{
+		dims:       dims,
+		idf:        idf,
+		unknownIDF: math.Log(1+n) + 1,
+	}
+}
+
+// Embed the texts. Never fails.
+func (e *HashedTFIDFEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, len(texts))
+	for i, text := range texts {
+		out[i] = e.embed(text)
+	}
+	return out, nil
+}
+
+func (e *HashedTFIDFEmbedder) embed(text string) []float32 {
+	tf := make(map[string]int)
+	for _, term := range tokenize(text) {
+		tf[term]++
+	}
+
+	vec := make([]float32, e.dims)
+	for term, count := range tf {
+		idf, ok := e.idf[term]
+		if !ok {
+			idf = e.unknownIDF
+		}
+		h := fnv.New32a()
+		h.Write([]byte(term))
+		vec[h.Sum32()%uint32(e.dims)] += float32(float64(count) * idf)
+	}
+	normalize(vec)
+	return vec
+}
+
+// Words that say nothing about which tool is relevant.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "can": true, "do": true, "for": true, "from": true, "how": true,
+	"i": true, "in": true, "is": true, "it": true, "me": true, "my": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true,
+	"use": true, "what": true, "which": true, "with": true, "you": true, "your": true,
+}
+
+// Split text into lowercase terms, dropping punctuation and stop words. A trailing "s" is
+// stripped so that "domains" matches "domain".
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if stopWords[word] {
+			continue
+		}
+		if len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+			word = word[:len(word)-1]
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// Scale the vector to unit length, so a dot product is the cosine similarity.
+func normalize(vec []float32) {
+	var sum float64
+	for _, v := range vec {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vec {
+		vec[i] /= norm
+	}
+}
+
+// Cosine similarity of two vectors. Returns 0 if either is all zeros.
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
@@ -27,6 +27,16 @@ type Function struct {
 	Handler FunctionHandler
 }
 
+// Return the description with the extended description appended. Vendors without a tight
+// limit on tool description length can use this instead of moving the extended
+// description into the system prompt.
+func (fn Function) FullDescription() string {
+	if fn.ExtendedDescription == "" {
+		return fn.Description
+	}
+	return fn.Description + "\n\n" + fn.ExtendedDescription
+}
+
 // Signature for callable functions via the model context.
 type FunctionHandler func(FunctionContext) (any, error)
 
@@ -36,6 +46,9 @@ type FunctionSet struct {
 	// underscores.
 	Name      string
 	Functions map[string]Function
+
+	// Wraps every handler called through Invoke. See Use.
+	middleware []FunctionMiddleware
 }
 
 // Create a new function set with the given name.
@@ -46,77 +59,61 @@ func NewFunctionSet(name string) *FunctionSet {
 	}
 }
 
-// Convert the given function information into a Bedrock function definition.
-func createBedrockFunctionDefinition(fn Function) types.FunctionDefinition {
+// Convert the given function information into a Bedrock function definition. Params
+// that Bedrock can't describe, like a nested struct, are returned as an ErrBedrockLimit
+// error naming the function.
+func createBedrockFunctionDefinition(setName string, fn Function) (types.FunctionDefinition, error) {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("%w; function %s.%s: %s", ErrBedrockLimit, setName, fn.Name,
+			fmt.Sprintf(format, args...))
+	}
+
 	var def types.FunctionDefinition
 	def.Name = &fn.Name
 	def.Description = &fn.Description
 	def.Parameters = make(map[string]types.ParameterDetail)
 	t := reflect.TypeOf(fn.Params)
+	if t == nil {
+		return def, nil
+	}
 	if t.Kind() != reflect.Struct {
-		panic("T must be a struct")
+		return types.FunctionDefinition{}, fail("params must be a struct, got %s", t.Kind())
 	}
 
 	for i := range t.NumField() {
 		field := t.Field(i)
-		fieldType := field.Type.Kind()
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+
 		var paramType types.ParameterType
-		if fieldType == reflect.String {
+		switch field.Type.Kind() {
+		case reflect.String:
 			paramType = types.ParameterTypeString
-		} else if fieldType == reflect.Int || fieldType == reflect.Int32 || fieldType == reflect.Int64 {
+		case reflect.Int, reflect.Int32, reflect.Int64:
 			paramType = types.ParameterTypeInteger
-		} else if fieldType == reflect.Bool {
+		case reflect.Bool:
 			paramType = types.ParameterTypeBoolean
-		} else if fieldType == reflect.Float64 {
+		case reflect.Float64:
 			paramType = types.ParameterTypeNumber
-		} else if fieldType == reflect.Slice {
-			if field.Type.Elem().Kind() == reflect.String {
-				paramType = types.ParameterTypeArray
-			} else {
-				panic("unsupported field type for " + field.Name + ": only []string is supported")
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				return types.FunctionDefinition{}, fail("parameter %s: only []string is supported for lists", name)
 			}
-		} else {
-			panic("unsupported field type: " + fieldType.String())
+			paramType = types.ParameterTypeArray
+		default:
+			return types.FunctionDefinition{}, fail("parameter %s: unsupported type %s", name, field.Type)
 		}
 
-		paramDetail := types.ParameterDetail{
+		def.Parameters[name] = types.ParameterDetail{
 			Description: aws.String(field.Tag.Get("desc")),
 			Required:    aws.Bool(field.Tag.Get("required") == "true"),
 			Type:        paramType,
 		}
-
-		name := field.Tag.Get("json")
-
-		def.Parameters[name] = paramDetail
 	}
 
-	return def
-}
-
-// Convert the function set into a Bedrock Agent Action Group configuration. In the future
-// this could be expanded to detect what functions are actually relevant to the user's
-// query, and only use that subset of functions to optimize performance.
-//
-// Bedrock Agents are limited to a max of 11 actions. Too many actions can easily confuse
-// the model on what its purpose is.
-func (fs *FunctionSet) GetActionGroup() types.AgentActionGroup {
-	var functions []types.FunctionDefinition
-	for _, function := range fs.Functions {
-		def := createBedrockFunctionDefinition(function)
-		functions = append(functions, def)
-	}
-
-	actionGroup := types.AgentActionGroup{
-		ActionGroupName: aws.String(fs.Name),
-		FunctionSchema: &types.FunctionSchemaMemberFunctions{
-			Value: functions,
-		},
-		ActionGroupExecutor: &types.ActionGroupExecutorMemberCustomControl{
-			Value: types.CustomControlMethodReturnControl,
-		},
-	}
-
-	return actionGroup
+	return def, nil
 }
 
 // Add a function. The name and description describe the function to the model. The params
@@ -135,6 +132,19 @@ func (fs *FunctionSet) AddFunction(name string, description string,
 	fs.Functions[name] = fn
 }
 
+// Return a set with only the functions that keep returns true for. The set has the same
+// name and middleware.
+func (fs *FunctionSet) Filter(keep func(name string) bool) *FunctionSet {
+	filtered := NewFunctionSet(fs.Name)
+	filtered.middleware = fs.middleware
+	for name, fn := range fs.Functions {
+		if keep(name) {
+			filtered.Functions[name] = fn
+		}
+	}
+	return filtered
+}
+
 // Error if the function or group doesn't exist.
 var ErrNoFunction = errors.New("no function found")
 
@@ -145,10 +155,28 @@ func (fs *FunctionSet) Invoke(ctx context.Context, function string, input []byte
 		return nil, fmt.Errorf("%w; function %s is not defined", ErrNoFunction, function)
 	}
 
-	// Call the handler. We pass the input into a FunctionContext which the functions can
-	// use to bind parameters.
+	// Call the handler, wrapped in the set's middleware. We pass the input into a
+	// FunctionContext which the functions can use to bind parameters.
+	handler := fn.Handler
+	for i := len(fs.middleware) - 1; i >= 0; i-- {
+		handler = fs.middleware[i](handler)
+	}
 	fct := FunctionContextFromJSON(ctx, input)
-	return fn.Handler(fct)
+	fct.Function = function
+	return handler(fct)
+}
+
+// Convert a function result into the text that is sent back to the model. Strings are
+// used as-is and anything else is marshalled to JSON.
+func formatFunctionResult(result any) (string, error) {
+	if v, ok := result.(string); ok {
+		return v, nil
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal function result: %w", err)
+	}
+	return string(resultBytes), nil
 }
 
 // FunctionContext carries user data and call parameters for a function invocation. Maybe
@@ -156,6 +184,8 @@ func (fs *FunctionSet) Invoke(ctx context.Context, function string, input []byte
 type FunctionContext struct {
 	context.Context
 	Input []byte
+	// Name of the function being invoked.
+	Function string
 }
 
 // Wrap the given JSON input in a FunctionContext for passing to handlers.
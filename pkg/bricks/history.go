@@ -0,0 +1,93 @@
+package bricks
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a session is kept without activity by default. The same as Bedrock's default
+// idle timeout, so sessions expire the same way with every backend.
+const DefaultSessionHistoryTTL = 15 * time.Minute
+
+// SessionHistory keeps conversation messages keyed by session ID. Bedrock keeps session
+// state on the AWS side, but most other vendors are stateless and expect the caller to
+// send the full conversation with every request. Agents for those vendors store their
+// messages here between queries.
+//
+// The history is in-memory only. It is safe for concurrent use, and it can be shared
+// between agent instances (e.g., when an agent is created per request) so that sessions
+// survive the agent that created them. Sessions that aren't used for TTL are dropped.
+type SessionHistory[M any] struct {
+	// Sessions not read or written for this long are forgotten. Zero keeps them until
+	// they are deleted. Set it before the history is used.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]sessionMessages[M]
+}
+
+type sessionMessages[M any] struct {
+	msgs     []M
+	lastUsed time.Time
+}
+
+// Create an empty session history that drops sessions after DefaultSessionHistoryTTL.
+func NewSessionHistory[M any]() *SessionHistory[M] {
+	return &SessionHistory[M]{
+		TTL:      DefaultSessionHistoryTTL,
+		sessions: make(map[string]sessionMessages[M]),
+	}
+}
+
+// Return a copy of the messages recorded for the session. Unknown and expired sessions
+// return an empty slice.
+func (h *SessionHistory[M]) Get(sessionID string) []M {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	session, ok := h.sessions[sessionID]
+	if !ok {
+		return []M{}
+	}
+	if h.expired(session, now) {
+		delete(h.sessions, sessionID)
+		return []M{}
+	}
+	session.lastUsed = now
+	h.sessions[sessionID] = session
+	out := make([]M, len(session.msgs))
+	copy(out, session.msgs)
+	return out
+}
+
+// Replace the messages recorded for the session. Expired sessions are dropped here, so
+// the history doesn't grow with every session ever started.
+func (h *SessionHistory[M]) Set(sessionID string, msgs []M) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for id, session := range h.sessions {
+		if h.expired(session, now) {
+			delete(h.sessions, id)
+		}
+	}
+	h.sessions[sessionID] = sessionMessages[M]{msgs: msgs, lastUsed: now}
+}
+
+// Forget a session.
+func (h *SessionHistory[M]) Delete(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, sessionID)
+}
+
+// Return the number of sessions kept, including expired ones that weren't dropped yet.
+func (h *SessionHistory[M]) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+func (h *SessionHistory[M]) expired(session sessionMessages[M], now time.Time) bool {
+	return h.TTL > 0 && now.Sub(session.lastUsed) >= h.TTL
+}
@@ -0,0 +1,45 @@
+package bricks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func TestSessionHistoryExpires(t *testing.T) {
+	history := bricks.NewSessionHistory[string]()
+	history.TTL = 200 * time.Millisecond
+
+	history.Set("stale", []string{"hello"})
+	history.Set("active", []string{"hi"})
+	time.Sleep(120 * time.Millisecond)
+	if msgs := history.Get("active"); len(msgs) != 1 {
+		t.Fatalf("expected the active session, got %v", msgs)
+	}
+	time.Sleep(120 * time.Millisecond)
+
+	// Using a session keeps it, and setting one drops the others that expired.
+	if msgs := history.Get("active"); len(msgs) != 1 {
+		t.Errorf("expected the active session to be kept, got %v", msgs)
+	}
+	history.Set("new", []string{"hey"})
+	if history.Len() != 2 {
+		t.Errorf("expected the stale session to be dropped, have %d sessions", history.Len())
+	}
+	if msgs := history.Get("stale"); len(msgs) != 0 {
+		t.Errorf("expected the stale session to be gone, got %v", msgs)
+	}
+}
+
+func TestSessionHistoryWithoutTTL(t *testing.T) {
+	history := bricks.NewSessionHistory[string]()
+	history.TTL = 0
+
+	history.Set("session", []string{"hello"})
+	time.Sleep(10 * time.Millisecond)
+	history.Set("other", nil)
+	if msgs := history.Get("session"); len(msgs) != 1 {
+		t.Errorf("expected the session to be kept, got %v", msgs)
+	}
+}
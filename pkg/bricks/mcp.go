@@ -59,11 +59,7 @@ func BindFunctionsToMCPServer(fs *FunctionSet, s *server.MCPServer) error {
 			}
 		}
 
-		fullDesc := fn.Description
-		if fn.ExtendedDescription != "" {
-			fullDesc += "\n\n" + fn.ExtendedDescription
-		}
-		toolOpts = append(toolOpts, mcp.WithDescription(fullDesc))
+		toolOpts = append(toolOpts, mcp.WithDescription(fn.FullDescription()))
 		tool := mcp.NewTool(fn.Name, toolOpts...)
 
 		s.AddTool(tool, func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
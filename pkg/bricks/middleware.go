@@ -0,0 +1,102 @@
+package bricks
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Handles a query, the same as StreamingAgent.QueryStream. onEvent may be nil.
+type QueryHandler func(ctx context.Context, inputText string, sessionID string, onEvent StreamHandler) (QueryResult, error)
+
+// AgentMiddleware wraps the query handling of an agent, the same way mcp-go's
+// ToolHandlerMiddleware wraps tool handlers. Use it for behavior that doesn't depend on
+// the vendor, such as logging, metrics, rate limiting, caching or redaction. Middleware
+// can change the input, the events, or the result, or answer without calling next.
+type AgentMiddleware func(next QueryHandler) QueryHandler
+
+// An agent wrapped with middleware. See WithMiddleware.
+type middlewareAgent struct {
+	handler QueryHandler
+}
+
+// Wrap an agent with middleware. The first middleware is the outermost, i.e., it sees the
+// query first and the result last.
+//
+// The returned agent always streams. If the wrapped agent doesn't, its whole answer is
+// emitted as a single text event once it's done.
+func WithMiddleware(agent Agent, middleware ...AgentMiddleware) StreamingAgent {
+	handler := func(ctx context.Context, inputText string, sessionID string, onEvent StreamHandler) (QueryResult, error) {
+		if streamer, ok := agent.(StreamingAgent); ok {
+			return streamer.QueryStream(ctx, inputText, sessionID, onEvent)
+		}
+		result, err := agent.Query(ctx, inputText, sessionID)
+		if err == nil && onEvent != nil {
+			onEvent(StreamEvent{Type: StreamEventText, Text: result.Response})
+		}
+		return result, err
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return &middlewareAgent{handler: handler}
+}
+
+func (ma *middlewareAgent) Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error) {
+	return ma.handler(ctx, inputText, sessionID, nil)
+}
+
+func (ma *middlewareAgent) QueryStream(ctx context.Context, inputText string, sessionID string,
+	onEvent StreamHandler) (QueryResult, error) {
+	return ma.handler(ctx, inputText, sessionID, onEvent)
+}
+
+// Middleware that logs each query with its duration, tool calls and token usage.
+func LogQueries(next QueryHandler) QueryHandler {
+	return func(ctx context.Context, inputText string, sessionID string, onEvent StreamHandler) (QueryResult, error) {
+		start := time.Now()
+		result, err := next(ctx, inputText, sessionID, onEvent)
+		entry := log.WithFields(log.Fields{
+			"session":       sessionID,
+			"duration_ms":   time.Since(start).Milliseconds(),
+			"tool_calls":    len(result.ToolCalls),
+			"input_tokens":  result.Usage.InputTokens,
+			"output_tokens": result.Usage.OutputTokens,
+		})
+		if err != nil {
+			entry.WithError(err).Warn("agent query failed")
+		} else {
+			entry.Debug("agent query finished")
+		}
+		return result, err
+	}
+}
+
+// FunctionMiddleware wraps every handler invoked through FunctionSet.Invoke. Bedrock
+// return control, the other agents' tool loops and MCP tool calls all go through Invoke,
+// so the behavior is the same no matter how the function is called. The function name
+// is in FunctionContext.Function.
+type FunctionMiddleware func(next FunctionHandler) FunctionHandler
+
+// Add middleware to every function in the set. Middleware added first is the outermost.
+func (fs *FunctionSet) Use(middleware ...FunctionMiddleware) {
+	fs.middleware = append(fs.middleware, middleware...)
+}
+
+// Middleware that logs each function call with its duration and error.
+func LogFunctionCalls(next FunctionHandler) FunctionHandler {
+	return func(c FunctionContext) (any, error) {
+		start := time.Now()
+		result, err := next(c)
+		entry := log.WithField("function", c.Function).
+			WithField("duration_ms", time.Since(start).Milliseconds())
+		if err != nil {
+			entry.WithError(err).Warn("function call failed")
+		} else {
+			entry.Debug("function call finished")
+		}
+		return result, err
+	}
+}
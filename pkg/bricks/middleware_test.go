@@ -0,0 +1,80 @@
+package bricks_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+// An agent without streaming support that answers with its input.
+type echoAgent struct{}
+
+func (echoAgent) Query(ctx context.Context, inputText string, sessionID string) (bricks.QueryResult, error) {
+	return bricks.QueryResult{Response: "you said: " + inputText}, nil
+}
+
+func TestAgentMiddlewareOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) bricks.AgentMiddleware {
+		return func(next bricks.QueryHandler) bricks.QueryHandler {
+			return func(ctx context.Context, inputText string, sessionID string, onEvent bricks.StreamHandler) (bricks.QueryResult, error) {
+				order = append(order, name)
+				result, err := next(ctx, inputText+" "+name, sessionID, onEvent)
+				result.Response = strings.ToUpper(name) + "(" + result.Response + ")"
+				return result, err
+			}
+		}
+	}
+
+	agent := bricks.WithMiddleware(echoAgent{}, tag("a"), tag("b"))
+	var events []string
+	result, err := agent.QueryStream(context.Background(), "hi", "session-1", func(ev bricks.StreamEvent) {
+		events = append(events, ev.Text)
+	})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if fmt.Sprint(order) != "[a b]" || result.Response != "A(B(you said: hi a b))" {
+		t.Errorf("unexpected order %v and response %q", order, result.Response)
+	}
+	// The non-streaming agent's answer arrives as one text event.
+	if fmt.Sprint(events) != "[you said: hi a b]" {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+func TestFunctionMiddlewareWrapsInvoke(t *testing.T) {
+	fs := newEchoFunctions()
+	var calls []string
+	fs.Use(func(next bricks.FunctionHandler) bricks.FunctionHandler {
+		return func(c bricks.FunctionContext) (any, error) {
+			calls = append(calls, c.Function)
+			result, err := next(c)
+			return fmt.Sprintf("[%v]", result), err
+		}
+	})
+
+	result, err := fs.Invoke(context.Background(), "echo", []byte(`{"text":"hi"}`))
+	if err != nil {
+		t.Fatalf("invoke failed: %v", err)
+	}
+	if result != "[echo: hi]" || fmt.Sprint(calls) != "[echo]" {
+		t.Errorf("unexpected result %v, calls %v", result, calls)
+	}
+
+	// Subsets picked by the tool selector keep the middleware.
+	fs.AddFunction("other", "Another function", "", EchoRequest{},
+		func(c bricks.FunctionContext) (any, error) { return "other", nil })
+	selector, err := bricks.NewToolSelector(context.Background(), nil, fs)
+	if err != nil {
+		t.Fatalf("failed to create selector: %v", err)
+	}
+	subset, _ := selector.Select(context.Background(), "echo the text", 1)
+	result, _ = subset.Invoke(context.Background(), "echo", []byte(`{"text":"again"}`))
+	if result != "[echo: again]" {
+		t.Errorf("expected the subset to keep the middleware, got %v", result)
+	}
+}
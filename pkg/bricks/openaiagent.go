@@ -0,0 +1,296 @@
+package bricks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenAICompatAgent is an agent implementation for OpenAI-compatible chat completions
+// endpoints. Most self-hosted model servers (vLLM, Ollama, llama.cpp server) expose this
+// API, which makes it useful for development and air-gapped deployments.
+//
+// Like the AnthropicAgent, the chat completions API is stateless, so this agent runs the
+// tool loop itself and keeps the conversation history on our side.
+type OpenAICompatAgent struct {
+	Config OpenAICompatAgentConfig
+}
+
+// Configuration input for an OpenAICompatAgent, passed to NewOpenAICompatAgent.
+type OpenAICompatAgentConfig struct {
+	// Base URL of the API including the version prefix, e.g., http://localhost:11434/v1
+	// for Ollama or http://localhost:8000/v1 for vLLM. Requests go to
+	// <BaseURL>/chat/completions.
+	BaseURL string
+	// Optional API key sent as a bearer token. Many self-hosted servers don't need one.
+	APIKey string
+	// Model name as known to the server.
+	Model string
+	// System prompt.
+	Instruction string
+	Functions   *FunctionSet
+	HTTPClient  *http.Client
+	// Conversation history keyed by session ID. If nil, the agent creates its own. Share
+	// one history between agent instances to keep sessions alive across requests.
+	History *SessionHistory[OpenAIMessage]
+	// Tool budgets for a single query, the same as BedrockAgentConfig. Zero uses the
+	// default, negative means no limit.
+	MaxToolRounds int
+	MaxToolCalls  int
+	MaxDuration   time.Duration
+}
+
+// A chat message in the chat completions format.
+type OpenAIMessage struct {
+	// One of [system, user, assistant, tool].
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Set on assistant messages that request tool calls.
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
+	// Set on tool messages, pointing back to the tool call being answered.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// A tool call requested by the model.
+type OpenAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name string `json:"name"`
+		// The arguments are a JSON document encoded as a string.
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+type openAIRequest struct {
+	Model    string          `json:"model"`
+	Messages []OpenAIMessage `json:"messages"`
+	Tools    []openAITool    `json:"tools,omitempty"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message      OpenAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	// Some servers leave this out, in which case the usage is reported as zero.
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// Create a new agent that uses an OpenAI-compatible chat completions endpoint.
+func NewOpenAICompatAgent(config OpenAICompatAgentConfig) Agent {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.History == nil {
+		config.History = NewSessionHistory[OpenAIMessage]()
+	}
+	return &OpenAICompatAgent{
+		Config: config,
+	}
+}
+
+// Convert the function set into the tools list of a chat completions request.
+func (oa *OpenAICompatAgent) makeTools() []openAITool {
+	if oa.Config.Functions == nil {
+		return nil
+	}
+	var tools []openAITool
+	for _, fn := range oa.Config.Functions.Functions {
+		var tool openAITool
+		tool.Type = "function"
+		tool.Function.Name = fn.Name
+		tool.Function.Description = fn.FullDescription()
+		tool.Function.Parameters = jsonSchemaForParams(fn.Params)
+		tools = append(tools, tool)
+	}
+	return tools
+}
+
+// Send one request to the chat completions endpoint and return the first choice with the
+// request's token usage.
+func (oa *OpenAICompatAgent) createCompletion(ctx context.Context, messages []OpenAIMessage) (OpenAIMessage, Usage, error) {
+	body, err := json.Marshal(openAIRequest{
+		Model:    oa.Config.Model,
+		Messages: messages,
+		Tools:    oa.makeTools(),
+	})
+	if err != nil {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	url := strings.TrimRight(oa.Config.BaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if oa.Config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+oa.Config.APIKey)
+	}
+
+	resp, err := oa.Config.HTTPClient.Do(req)
+	if err != nil {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("chat completions returned status %d: %s",
+			resp.StatusCode, string(respBody))
+	}
+
+	var out openAIResponse
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if len(out.Choices) == 0 {
+		return OpenAIMessage{}, Usage{}, fmt.Errorf("chat completions returned no choices")
+	}
+	var usage Usage
+	usage.addInvocation(out.Usage.PromptTokens, out.Usage.CompletionTokens)
+	return out.Choices[0].Message, usage, nil
+}
+
+// Invoke the function for a tool call and return the tool message to send back. Function
+// errors are reported to the model rather than failing the query.
+func (oa *OpenAICompatAgent) invokeTool(ctx context.Context, call OpenAIToolCall) OpenAIMessage {
+	out := OpenAIMessage{
+		Role:       "tool",
+		ToolCallID: call.ID,
+	}
+
+	if oa.Config.Functions == nil {
+		out.Content = fmt.Sprintf("(Error) function %s is not defined", call.Function.Name)
+		return out
+	}
+
+	// Smaller models sometimes send an empty string for parameterless functions.
+	input := []byte(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		input = []byte("{}")
+	}
+
+	result, err := oa.Config.Functions.Invoke(ctx, call.Function.Name, input)
+	if err == nil {
+		out.Content, err = formatFunctionResult(result)
+	}
+	if err != nil {
+		log.Errorln("Function invocation error:", err)
+		// The tool message has no error flag like Anthropic's is_error, so the failure
+		// is described in the content.
+		if errors.Is(err, ErrInvalidArg) || errors.Is(err, ErrNoFunction) {
+			out.Content = fmt.Sprintf("(Error) function invocation failed; %v", err)
+		} else {
+			out.Content = "(Error) function invocation failed unexpectedly"
+		}
+	}
+	return out
+}
+
+// Query the chat completions endpoint with the given prompt. The conversation so far is
+// loaded from the session history, and tool calls are answered until the model responds
+// without requesting any more or the tool budget runs out.
+func (oa *OpenAICompatAgent) Query(ctx context.Context, inputText string, sessionID string) (QueryResult, error) {
+	messages := oa.Config.History.Get(sessionID)
+	messages = append(messages, OpenAIMessage{
+		Role:    "user",
+		Content: inputText,
+	})
+
+	// References added by the functions.
+	refs := newReferenceCollector(nil)
+	ctx = withReferenceCollector(ctx, refs)
+
+	var chunks []string
+	var usage Usage
+	budget := newToolBudget(oa.Config.MaxToolRounds, oa.Config.MaxToolCalls, oa.Config.MaxDuration)
+	exhausted := ""
+	for {
+		// The system prompt is not stored in the history so that it can change between
+		// queries (e.g., different tool instructions per request).
+		request := append([]OpenAIMessage{{Role: "system", Content: oa.Config.Instruction}}, messages...)
+		msg, callUsage, err := oa.createCompletion(ctx, request)
+		if err != nil {
+			return QueryResult{}, fmt.Errorf("failed to invoke agent: %w", err)
+		}
+		usage.Add(callUsage)
+
+		msg.Role = "assistant"
+		if msg.Content != "" {
+			chunks = append(chunks, msg.Content)
+		}
+
+		// Some servers report finish_reason "stop" even when tool calls are present, so
+		// we go by the tool calls alone.
+		if len(msg.ToolCalls) == 0 {
+			messages = append(messages, msg)
+			break
+		}
+
+		// Once a budget runs out, the model gets one more turn to wrap up. If it asks
+		// for tools again anyway, we stop with whatever answer we have so far. The tool
+		// calls are left out of the history, since servers reject tool calls without
+		// results.
+		if exhausted != "" {
+			log.Warnf("Agent kept calling tools after the %s budget ran out; stopping", exhausted)
+			msg.ToolCalls = nil
+			if msg.Content == "" {
+				msg.Content = "(Stopped: the tool budget ran out.)"
+			}
+			messages = append(messages, msg)
+			break
+		}
+		messages = append(messages, msg)
+
+		allowed, hit := budget.startRound(len(msg.ToolCalls))
+		for _, call := range msg.ToolCalls[:allowed] {
+			messages = append(messages, oa.invokeTool(ctx, call))
+		}
+		if hit != "" {
+			log.Warnf("Agent tool budget exhausted (%s); asking the model to wrap up", hit)
+			exhausted = hit
+			for _, call := range msg.ToolCalls[allowed:] {
+				messages = append(messages, OpenAIMessage{
+					Role:       "tool",
+					ToolCallID: call.ID,
+					Content:    "(Error) " + budgetExhaustedMessage(hit),
+				})
+			}
+		}
+	}
+
+	oa.Config.History.Set(sessionID, messages)
+
+	return QueryResult{
+		Response:        strings.Join(chunks, ""),
+		Refs:            refs.list(),
+		Usage:           usage,
+		BudgetExhausted: exhausted,
+	}, nil
+}
@@ -0,0 +1,134 @@
+package bricks_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func TestOpenAICompatAgentMultiRoundToolCalls(t *testing.T) {
+	responses := []string{
+		`{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[
+			{"id":"call_1","type":"function","function":{"name":"echo","arguments":"{\"text\":\"one\"}"}},
+			{"id":"call_2","type":"function","function":{"name":"echo","arguments":"{\"text\":\"two\"}"}}
+		]},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[{"message":{"role":"assistant","content":"","tool_calls":[
+			{"id":"call_3","type":"function","function":{"name":"echo","arguments":"{\"text\":\"three\"}"}}
+		]},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[{"message":{"role":"assistant","content":"Done."},"finish_reason":"stop"}]}`,
+	}
+	var requests []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(responses[0]))
+		responses = responses[1:]
+	}))
+	defer srv.Close()
+
+	agent := bricks.NewOpenAICompatAgent(bricks.OpenAICompatAgentConfig{
+		BaseURL:     srv.URL + "/v1",
+		Model:       "test-model",
+		Instruction: "Be helpful.",
+		Functions:   newEchoFunctions(),
+	})
+
+	result, err := agent.Query(context.Background(), "echo a few things", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.Response != "Done." {
+		t.Errorf("unexpected response %q", result.Response)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	tool := requests[0]["tools"].([]any)[0].(map[string]any)["function"].(map[string]any)
+	if tool["name"] != "echo" || tool["parameters"].(map[string]any)["type"] != "object" {
+		t.Errorf("unexpected tool definition %v", tool)
+	}
+
+	// system, user, assistant (2 calls), tool, tool
+	messages := requests[1]["messages"].([]any)
+	if len(messages) != 5 {
+		t.Fatalf("expected 5 messages in the second request, got %d", len(messages))
+	}
+	for i, expected := range []string{"echo: one", "echo: two"} {
+		msg := messages[3+i].(map[string]any)
+		if msg["role"] != "tool" || msg["content"] != expected {
+			t.Errorf("unexpected tool message %v", msg)
+		}
+	}
+
+	messages = requests[2]["messages"].([]any)
+	last := messages[len(messages)-1].(map[string]any)
+	if last["tool_call_id"] != "call_3" || last["content"] != "echo: three" {
+		t.Errorf("unexpected tool message %v", last)
+	}
+}
+
+func TestOpenAICompatAgentToolBudget(t *testing.T) {
+	toolCalls := `{"choices":[{"message":{"role":"assistant","content":null,"tool_calls":[
+		{"id":"call_1","type":"function","function":{"name":"echo","arguments":"{\"text\":\"one\"}"}},
+		{"id":"call_2","type":"function","function":{"name":"echo","arguments":"{\"text\":\"two\"}"}}
+	]},"finish_reason":"tool_calls"}]}`
+	responses := []string{toolCalls, toolCalls}
+	var requests []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		requests = append(requests, body)
+		if len(responses) == 0 {
+			t.Fatalf("unexpected request #%d", len(requests))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(responses[0]))
+		responses = responses[1:]
+	}))
+	defer srv.Close()
+
+	agent := bricks.NewOpenAICompatAgent(bricks.OpenAICompatAgentConfig{
+		BaseURL:      srv.URL + "/v1",
+		Model:        "test-model",
+		Functions:    newEchoFunctions(),
+		MaxToolCalls: 1,
+	})
+
+	result, err := agent.Query(context.Background(), "echo", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if result.BudgetExhausted != bricks.BudgetToolCalls {
+		t.Errorf("expected the tool_calls budget to be exhausted, got %q", result.BudgetExhausted)
+	}
+	// The model asked for tools again after being told to wrap up, so the loop stopped.
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	// Only the first call ran; the second was refused.
+	messages := requests[1]["messages"].([]any)
+	first := messages[3].(map[string]any)
+	refused := messages[4].(map[string]any)
+	if first["content"] != "echo: one" {
+		t.Errorf("unexpected tool message %v", first)
+	}
+	if refused["tool_call_id"] != "call_2" || !strings.Contains(refused["content"].(string), "Tool budget exhausted") {
+		t.Errorf("unexpected refused tool message %v", refused)
+	}
+}
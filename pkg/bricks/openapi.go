@@ -0,0 +1,182 @@
+package bricks
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// Function schemas only support flat parameters of basic types, with at most 5 of them.
+// OpenAPI-schema action groups don't have those limits, so functions with nested objects,
+// arrays of objects or more parameters can be exposed to Bedrock this way instead.
+//
+// Each function becomes a POST operation at /<function name>, with the Params struct as
+// the JSON request body. The function result is returned as the response body.
+
+// Build an OpenAPI 3.0 document for the function set.
+func (fs *FunctionSet) OpenAPIDocument() map[string]any {
+	names := make([]string, 0, len(fs.Functions))
+	for name := range fs.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	paths := map[string]any{}
+	for _, name := range names {
+		fn := fs.Functions[name]
+		paths[openAPIPath(name)] = map[string]any{
+			"post": map[string]any{
+				"operationId": name,
+				"description": fn.Description,
+				"requestBody": map[string]any{
+					"required": true,
+					"content": map[string]any{
+						"application/json": map[string]any{
+							"schema": jsonSchemaForParams(fn.Params),
+						},
+					},
+				},
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "Result of the function.",
+						"content": map[string]any{
+							"text/plain": map[string]any{
+								"schema": map[string]any{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.0",
+		"info": map[string]any{
+			"title":   fs.Name,
+			"version": "1.0.0",
+		},
+		"paths": paths,
+	}
+}
+
+// The API path for a function.
+func openAPIPath(function string) string {
+	return "/" + function
+}
+
+// The function for an API path, the reverse of openAPIPath.
+func functionForAPIPath(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// Convert the function set into a single Bedrock action group with an OpenAPI schema.
+// Unlike GetActionGroups, the set isn't split, since the per-group function limit only
+// applies to function schemas.
+func (fs *FunctionSet) GetAPIActionGroup() (types.AgentActionGroup, error) {
+	if !bedrockNamePattern.MatchString(fs.Name) {
+		return types.AgentActionGroup{}, fmt.Errorf("%w; function set %q: name must match %s",
+			ErrBedrockLimit, fs.Name, bedrockNamePattern)
+	}
+
+	for name := range fs.Functions {
+		if !bedrockNamePattern.MatchString(name) {
+			return types.AgentActionGroup{}, fmt.Errorf("%w; function %s.%s: name must match %s",
+				ErrBedrockLimit, fs.Name, name, bedrockNamePattern)
+		}
+	}
+
+	doc, err := json.Marshal(fs.OpenAPIDocument())
+	if err != nil {
+		return types.AgentActionGroup{}, fmt.Errorf("failed to marshal OpenAPI document: %w", err)
+	}
+
+	return types.AgentActionGroup{
+		ActionGroupName: aws.String(fs.Name),
+		ApiSchema: &types.APISchemaMemberPayload{
+			Value: string(doc),
+		},
+		ActionGroupExecutor: &types.ActionGroupExecutorMemberCustomControl{
+			Value: types.CustomControlMethodReturnControl,
+		},
+	}, nil
+}
+
+// Take the parameters and request body of an API invocation from Bedrock RETURN_CONTROL
+// and marshal them into a JSON object, the same as marshalBedrockFunctionParams.
+//
+// Bedrock sends every value as a string with a type name. Arrays and objects are
+// normally JSON, but the model sometimes writes arrays as [a, b] without quotes, so
+// those are split on commas instead.
+func marshalBedrockAPIParams(input types.ApiInvocationInput) ([]byte, error) {
+	var params []types.Parameter
+	for _, p := range input.Parameters {
+		params = append(params, types.Parameter{Name: p.Name, Type: p.Type, Value: p.Value})
+	}
+	if input.RequestBody != nil {
+		// We only declare JSON bodies, but there's nothing else to pick if the model
+		// used another content type.
+		for _, content := range input.RequestBody.Content {
+			params = append(params, content.Properties...)
+		}
+	}
+
+	jsonMap := make(map[string]any)
+	for _, param := range params {
+		if param.Value == nil || param.Name == nil {
+			return nil, fmt.Errorf("%w; fields must not be nil, name=%v value=%v",
+				ErrInvalidArg, param.Name, param.Value)
+		}
+		jsonMap[*param.Name] = convertBedrockAPIValue(aws.ToString(param.Type), *param.Value)
+	}
+
+	jsonBytes, err := json.Marshal(jsonMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal api params; %w", err)
+	}
+	return jsonBytes, nil
+}
+
+// Convert a string value from Bedrock to the JSON value for its OpenAPI type. Values that
+// don't parse are passed through as strings, and the handler's bind reports the error.
+func convertBedrockAPIValue(paramType string, value string) any {
+	switch paramType {
+	case "integer":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case "array":
+		var v []any
+		if err := json.Unmarshal([]byte(value), &v); err == nil {
+			return v
+		}
+		inner := strings.TrimSpace(value)
+		inner = strings.TrimSuffix(strings.TrimPrefix(inner, "["), "]")
+		items := []any{}
+		for _, item := range strings.Split(inner, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, strings.Trim(item, `"'`))
+			}
+		}
+		return items
+	case "object":
+		var v map[string]any
+		if err := json.Unmarshal([]byte(value), &v); err == nil {
+			return v
+		}
+	}
+	return value
+}
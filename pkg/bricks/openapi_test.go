@@ -0,0 +1,148 @@
+package bricks_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+type PortRange struct {
+	From int `json:"from" required:"true"`
+	To   int `json:"to"`
+}
+
+type ScanRequest struct {
+	Hosts  []string    `json:"hosts" desc:"Hosts to scan" required:"true"`
+	Ports  []PortRange `json:"ports" desc:"Port ranges"`
+	Policy struct {
+		Aggressive bool `json:"aggressive"`
+	} `json:"policy"`
+}
+
+func newScanFunctions() *bricks.FunctionSet {
+	fs := bricks.NewFunctionSet("scans")
+	fs.AddFunction("scan", "Scan hosts", "", ScanRequest{},
+		func(c bricks.FunctionContext) (any, error) {
+			var req ScanRequest
+			c.MustBind(&req)
+			return fmt.Sprintf("%v %v %v", req.Hosts, req.Ports, req.Policy.Aggressive), nil
+		})
+	return fs
+}
+
+func TestOpenAPIDocumentDescribesNestedParams(t *testing.T) {
+	doc := newScanFunctions().OpenAPIDocument()
+	// Round trip through JSON to check the document the way Bedrock sees it.
+	data, _ := json.Marshal(doc)
+	var parsed struct {
+		Paths map[string]struct {
+			Post struct {
+				OperationID string `json:"operationId"`
+				RequestBody struct {
+					Content map[string]struct {
+						Schema struct {
+							Properties map[string]map[string]any `json:"properties"`
+							Required   []string                  `json:"required"`
+						} `json:"schema"`
+					} `json:"content"`
+				} `json:"requestBody"`
+			} `json:"post"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("failed to parse document: %v", err)
+	}
+
+	op := parsed.Paths["/scan"].Post
+	if op.OperationID != "scan" {
+		t.Fatalf("expected a /scan operation, got %s", data)
+	}
+	schema := op.RequestBody.Content["application/json"].Schema
+	ports := schema.Properties["ports"]
+	items, _ := ports["items"].(map[string]any)
+	if ports["type"] != "array" || items["type"] != "object" {
+		t.Errorf("expected ports to be an array of objects, got %v", ports)
+	}
+	if schema.Properties["policy"]["type"] != "object" {
+		t.Errorf("expected policy to be an object, got %v", schema.Properties["policy"])
+	}
+	if fmt.Sprint(schema.Required) != "[hosts]" {
+		t.Errorf("expected hosts to be required, got %v", schema.Required)
+	}
+}
+
+func TestBedrockAgentAPIInvocations(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				bricks.BedrockAPIReturnControlEvent("inv-1",
+					bricks.BedrockAPIInvocation("scans", "scan",
+						bricks.BedrockAPIParam("hosts", "array", "[a.com, b.com]"),
+						bricks.BedrockAPIParam("ports", "array", `[{"from": 80, "to": 443}]`),
+						bricks.BedrockAPIParam("policy", "object", `{"aggressive": true}`)),
+					bricks.BedrockAPIInvocation("scans", "missing")),
+			}},
+			{Events: []types.InlineAgentResponseStream{bricks.BedrockChunkEvent("Scanned.")}},
+		},
+	}
+	agent := mustNewBedrockAgent(t, bricks.BedrockAgentConfig{
+		APIFunctions: []*bricks.FunctionSet{newScanFunctions()},
+		Client:       runtime,
+	})
+
+	result, err := agent.Query(context.Background(), "scan", "session-1")
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if _, ok := runtime.Inputs[0].ActionGroups[0].ApiSchema.(*types.APISchemaMemberPayload); !ok {
+		t.Errorf("expected an OpenAPI schema action group")
+	}
+
+	var results []types.ApiResult
+	for _, r := range runtime.Inputs[1].InlineSessionState.ReturnControlInvocationResults {
+		results = append(results, r.(*types.InvocationResultMemberMemberApiResult).Value)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if body := aws.ToString(results[0].ResponseBody["TEXT"].Body); body != "[a.com b.com] [{80 443}] true" {
+		t.Errorf("unexpected result %q", body)
+	}
+	if aws.ToInt32(results[0].HttpStatusCode) != 200 || aws.ToString(results[0].ApiPath) != "/scan" {
+		t.Errorf("expected a 200 for /scan, got %d %s",
+			aws.ToInt32(results[0].HttpStatusCode), aws.ToString(results[0].ApiPath))
+	}
+	if results[1].ResponseState != types.ResponseStateFailure || aws.ToInt32(results[1].HttpStatusCode) != 400 {
+		t.Errorf("expected a 400 FAILURE for an unknown function, got %v %d",
+			results[1].ResponseState, aws.ToInt32(results[1].HttpStatusCode))
+	}
+
+	if len(result.ToolCalls) != 2 || result.ToolCalls[0].Function != "scan" || result.ToolCalls[1].Error == "" {
+		t.Errorf("unexpected tool calls %+v", result.ToolCalls)
+	}
+}
+
+func TestBedrockAgentRejectsUnsupportedInvocations(t *testing.T) {
+	runtime := &bricks.ScriptedBedrockRuntime{
+		Responses: []bricks.ScriptedBedrockResponse{
+			{Events: []types.InlineAgentResponseStream{
+				&types.InlineAgentResponseStreamMemberReturnControl{
+					Value: types.InlineAgentReturnControlPayload{
+						InvocationId:     aws.String("inv-1"),
+						InvocationInputs: []types.InvocationInputMember{&types.UnknownUnionMember{Tag: "new"}},
+					},
+				},
+			}},
+		},
+	}
+
+	_, err := newScriptedAgent(t, runtime).Query(context.Background(), "hi", "session-1")
+	if err == nil {
+		t.Fatalf("expected an error for an unsupported invocation input")
+	}
+}
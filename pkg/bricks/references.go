@@ -0,0 +1,71 @@
+package bricks
+
+import (
+	"context"
+	"sync"
+)
+
+// Reference type recorded by the agents for knowledgebase citations and search results.
+// Other types come from functions (see FunctionContext.AddReference) and are up to the
+// application.
+const ReferenceKnowledgebase = "knowledgebase"
+
+// Collects the references of one query without duplicates, in the order they were first
+// seen. References with the same Type and Key are the same source. Functions can run
+// concurrently, so adding is synchronized.
+type referenceCollector struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	refs []Reference
+	emit StreamHandler
+}
+
+// Create a collector that emits a reference event for each new reference. emit may be
+// nil.
+func newReferenceCollector(emit StreamHandler) *referenceCollector {
+	return &referenceCollector{
+		seen: make(map[string]bool),
+		refs: []Reference{},
+		emit: emit,
+	}
+}
+
+// Add the reference if it's new.
+func (rc *referenceCollector) add(ref Reference) {
+	rc.mu.Lock()
+	key := ref.Type + "\x00" + ref.Key
+	if rc.seen[key] {
+		rc.mu.Unlock()
+		return
+	}
+	rc.seen[key] = true
+	rc.refs = append(rc.refs, ref)
+	rc.mu.Unlock()
+
+	if rc.emit != nil {
+		rc.emit(StreamEvent{Type: StreamEventReference, Ref: &ref})
+	}
+}
+
+// The references collected so far.
+func (rc *referenceCollector) list() []Reference {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Reference{}, rc.refs...)
+}
+
+type referenceCollectorKey struct{}
+
+// Return a context whose function invocations add their references to the collector.
+func withReferenceCollector(ctx context.Context, rc *referenceCollector) context.Context {
+	return context.WithValue(ctx, referenceCollectorKey{}, rc)
+}
+
+// Record a source the function used, to be returned with the agent's answer. Duplicates
+// (same Type and Key) are dropped. Does nothing when the function isn't called by an
+// agent, e.g., for MCP tool calls.
+func (c *FunctionContext) AddReference(ref Reference) {
+	if rc, ok := c.Value(referenceCollectorKey{}).(*referenceCollector); ok {
+		rc.add(ref)
+	}
+}
@@ -0,0 +1,109 @@
+package bricks
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+// A document that can be retrieved, e.g., one section of the product documentation.
+type Document struct {
+	ID   string
+	Text string
+	// Freeform metadata, like Reference.Data. For the documentation, this holds the
+	// "header" and "folder" used to build links, the same as the Bedrock knowledgebase.
+	Metadata map[string]string
+}
+
+// A document and how well it matches a query. Higher scores are better; the scale
+// depends on the Retriever.
+type RetrievedDocument struct {
+	Document
+	Score float64
+}
+
+// A Retriever finds the documents most relevant to a query. It's the local counterpart of
+// a Bedrock knowledgebase, for clients that can't use one (e.g., MCP clients). A hosted
+// search service or a vector store can implement this too.
+type Retriever interface {
+	// Return up to k documents that match the query, best first. Documents that don't
+	// match at all aren't returned.
+	Retrieve(ctx context.Context, query string, k int) ([]RetrievedDocument, error)
+}
+
+// BM25 tuning. These are the usual defaults.
+const bm25K1 = 1.2
+const bm25B = 0.75
+
+// BM25Retriever ranks documents with Okapi BM25 over the terms from tokenize. The index
+// is built in memory once, which is fine for a few hundred documentation sections.
+type BM25Retriever struct {
+	docs       []Document
+	termCounts []map[string]int
+	lengths    []int
+	avgLength  float64
+	docFreqs   map[string]int
+}
+
+// Index the documents.
+func NewBM25Retriever(docs []Document) *BM25Retriever {
+	r := &BM25Retriever{
+		docs:       docs,
+		termCounts: make([]map[string]int, len(docs)),
+		lengths:    make([]int, len(docs)),
+		docFreqs:   make(map[string]int),
+	}
+	total := 0
+	for i, doc := range docs {
+		counts := make(map[string]int)
+		terms := tokenize(doc.Text)
+		for _, term := range terms {
+			counts[term]++
+		}
+		for term := range counts {
+			r.docFreqs[term]++
+		}
+		r.termCounts[i] = counts
+		r.lengths[i] = len(terms)
+		total += len(terms)
+	}
+	if len(docs) > 0 {
+		r.avgLength = float64(total) / float64(len(docs))
+	}
+	return r
+}
+
+// Return the k best matching documents. Never fails.
+func (r *BM25Retriever) Retrieve(ctx context.Context, query string, k int) ([]RetrievedDocument, error) {
+	terms := tokenize(query)
+	var results []RetrievedDocument
+	for i, doc := range r.docs {
+		score := r.score(i, terms)
+		if score > 0 {
+			results = append(results, RetrievedDocument{Document: doc, Score: score})
+		}
+	}
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].Score > results[b].Score
+	})
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// The BM25 score of document i for the query terms.
+func (r *BM25Retriever) score(i int, terms []string) float64 {
+	var score float64
+	lengthNorm := 1 - bm25B + bm25B*float64(r.lengths[i])/max(r.avgLength, 1)
+	for _, term := range terms {
+		tf := float64(r.termCounts[i][term])
+		if tf == 0 {
+			continue
+		}
+		df := float64(r.docFreqs[term])
+		idf := math.Log(1 + (float64(len(r.docs))-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*lengthNorm)
+	}
+	return score
+}
@@ -0,0 +1,30 @@
+package bricks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func TestBM25RetrieverRanksMatchingSections(t *testing.T) {
+	retriever := bricks.NewBM25Retriever([]bricks.Document{
+		{ID: "azure", Text: "# Azure Connector Setup\nCreate a managed identity and federated credentials in Azure."},
+		{ID: "aws", Text: "# AWS Connector Setup\nCreate an IAM role that Cosmos can assume."},
+		{ID: "sso", Text: "# Single Sign-On\nConfigure SAML with your identity provider."},
+	})
+
+	results, err := retriever.Retrieve(context.Background(), "How do I set up the Azure connector?", 2)
+	if err != nil {
+		t.Fatalf("retrieve failed: %v", err)
+	}
+	if len(results) != 2 || results[0].ID != "azure" || results[1].ID != "aws" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	// Documents without any query term aren't returned.
+	results, _ = retriever.Retrieve(context.Background(), "kubernetes", 5)
+	if len(results) != 0 {
+		t.Errorf("expected no results, got %+v", results)
+	}
+}
@@ -0,0 +1,92 @@
+package bricks
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Build a JSON schema object for a function's Params struct. Vendors that accept plain
+// JSON schema for tool inputs (Anthropic, OpenAI, etc.) can use this directly, unlike
+// Bedrock action groups which have their own flattened parameter format.
+//
+// The same struct tags are used as everywhere else:
+//   - json: Name of the property.
+//   - desc: Description of the property.
+//   - required: "true" to mark the property as required.
+//   - enum: Comma-separated list of the allowed values of a string property.
+func jsonSchemaForParams(params any) map[string]any {
+	t := reflect.TypeOf(params)
+	if t == nil {
+		return map[string]any{
+			"type":       "object",
+			"properties": map[string]any{},
+		}
+	}
+	return jsonSchemaForType(t, "")
+}
+
+// Return the JSON name of a struct field according to its json tag. Returns an empty
+// string when the field should not be exposed.
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	return name
+}
+
+// Reflect over a Go type and return a JSON schema for it. Structs become objects with
+// properties, slices become arrays, and the basic types map to their JSON counterparts.
+// Unsupported types panic, since that is a programming error in the function definition
+// rather than a runtime failure.
+func jsonSchemaForType(t reflect.Type, desc string) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	schema := map[string]any{}
+	if desc != "" {
+		schema["description"] = desc
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		schema["type"] = "string"
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		schema["type"] = "integer"
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Float32, reflect.Float64:
+		schema["type"] = "number"
+	case reflect.Slice, reflect.Array:
+		schema["type"] = "array"
+		schema["items"] = jsonSchemaForType(t.Elem(), "")
+	case reflect.Struct:
+		properties := map[string]any{}
+		required := []string{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			name := jsonFieldName(field)
+			if name == "" {
+				continue
+			}
+			property := jsonSchemaForType(field.Type, field.Tag.Get("desc"))
+			if enum := field.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, ",")
+			}
+			properties[name] = property
+			if field.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	default:
+		panic("unsupported field type: " + t.Kind().String())
+	}
+
+	return schema
+}
@@ -0,0 +1,115 @@
+package bricks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Returned when a model's structured answer isn't JSON or doesn't match its schema. The
+// error text says what's wrong, so it can be sent back to the model to fix its answer.
+var ErrInvalidStructuredOutput = errors.New("invalid structured output")
+
+// Return the JSON schema for a Go type, using the same struct tags as function params
+// (see jsonSchemaForParams). Use it to tell the model what shape of answer to produce.
+func JSONSchema(v any) map[string]any {
+	return jsonSchemaForParams(v)
+}
+
+// Decode a structured answer from the model into v (a pointer), checking it against the
+// schema of v's type first. Models like to wrap JSON in Markdown code fences or add a
+// sentence before it, so only the outermost JSON object in the text is used.
+//
+// The schema check rejects missing required properties, properties not in the schema,
+// wrong types and values not in an enum.
+func DecodeStructured(text string, v any) error {
+	raw, ok := extractJSONObject(text)
+	if !ok {
+		return fmt.Errorf("%w; the answer does not contain a JSON object", ErrInvalidStructuredOutput)
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return fmt.Errorf("%w; the answer is not valid JSON: %w", ErrInvalidStructuredOutput, err)
+	}
+	if err := validateSchema(value, JSONSchema(v), "$"); err != nil {
+		return fmt.Errorf("%w; %w", ErrInvalidStructuredOutput, err)
+	}
+	if err := json.Unmarshal([]byte(raw), v); err != nil {
+		return fmt.Errorf("%w; %w", ErrInvalidStructuredOutput, err)
+	}
+	return nil
+}
+
+// Return the text from the first "{" to the last "}".
+func extractJSONObject(text string) (string, bool) {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return "", false
+	}
+	return text[start : end+1], true
+}
+
+// Check a decoded JSON value against a schema from jsonSchemaForType. Only the parts of
+// JSON schema that jsonSchemaForType produces are supported.
+func validateSchema(value any, schema map[string]any, path string) error {
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, v := range obj {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s.%s is not allowed", path, name)
+			}
+			if err := validateSchema(v, property, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, v := range arr {
+			if err := validateSchema(v, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		if enum, ok := schema["enum"].([]string); ok && !slices.Contains(enum, str) {
+			return fmt.Errorf("%s must be one of [%s]", path, strings.Join(enum, ", "))
+		}
+	case "integer":
+		num, ok := value.(float64)
+		if !ok || num != float64(int64(num)) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+	return nil
+}
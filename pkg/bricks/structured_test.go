@@ -0,0 +1,53 @@
+package bricks_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+type Finding struct {
+	Title    string `json:"title" required:"true"`
+	Severity string `json:"severity" required:"true" enum:"low,medium,high"`
+}
+
+type FindingsAnswer struct {
+	Summary  string    `json:"summary" required:"true"`
+	Findings []Finding `json:"findings"`
+}
+
+func TestDecodeStructured(t *testing.T) {
+	// Code fences and surrounding text are ignored.
+	text := "Here you go:\n```json\n{\"summary\": \"Two issues\", \"findings\": [" +
+		"{\"title\": \"Open RDP\", \"severity\": \"high\"}]}\n```"
+	var answer FindingsAnswer
+	if err := bricks.DecodeStructured(text, &answer); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if answer.Summary != "Two issues" || len(answer.Findings) != 1 || answer.Findings[0].Severity != "high" {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+
+	cases := map[string]string{
+		"no json":          "I couldn't find anything.",
+		"missing required": `{"findings": []}`,
+		"unknown property": `{"summary": "x", "extra": 1}`,
+		"wrong type":       `{"summary": "x", "findings": {"title": "y"}}`,
+		"not in enum":      `{"summary": "x", "findings": [{"title": "y", "severity": "critical"}]}`,
+	}
+	for name, text := range cases {
+		err := bricks.DecodeStructured(text, &FindingsAnswer{})
+		if !errors.Is(err, bricks.ErrInvalidStructuredOutput) {
+			t.Errorf("%s: expected ErrInvalidStructuredOutput, got %v", name, err)
+		}
+	}
+
+	// The error says where the problem is, for the repair prompt.
+	err := bricks.DecodeStructured(`{"summary": "x", "findings": [{"title": "y", "severity": "critical"}]}`,
+		&FindingsAnswer{})
+	if !strings.Contains(err.Error(), "$.findings[0].severity must be one of [low, medium, high]") {
+		t.Errorf("unexpected error text: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package bricks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// ToolSelector picks the functions most relevant to a query, so the agent only sees a
+// handful of tools instead of the whole set. Fewer tools means less context spent on
+// tool definitions and instructions, and less chance of the model reaching for the wrong
+// one.
+//
+// Function description vectors are computed once when the selector is created. Only the
+// query is embedded per request.
+type ToolSelector struct {
+	embedder  Embedder
+	functions *FunctionSet
+	names     []string
+	vectors   [][]float32
+}
+
+// Create a selector over the function set. Each function is embedded by its full
+// description, including the extended description.
+//
+// If the embedder is nil, a HashedTFIDFEmbedder is built from the function descriptions.
+func NewToolSelector(ctx context.Context, embedder Embedder, fs *FunctionSet) (*ToolSelector, error) {
+	names := make([]string, 0, len(fs.Functions))
+	for name := range fs.Functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	docs := make([]string, len(names))
+	for i, name := range names {
+		fn := fs.Functions[name]
+		docs[i] = fn.Name + " " + fn.FullDescription()
+	}
+
+	if embedder == nil {
+		embedder = NewHashedTFIDFEmbedder(docs, 0)
+	}
+	vectors, err := embedder.Embed(ctx, docs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed function descriptions: %w", err)
+	}
+
+	return &ToolSelector{
+		embedder:  embedder,
+		functions: fs,
+		names:     names,
+		vectors:   vectors,
+	}, nil
+}
+
+// A function and how relevant it is to a query.
+type ScoredFunction struct {
+	Name  string
+	Score float64
+}
+
+// Score every function against the query, most relevant first. Ties are broken by name
+// so the order is stable.
+func (ts *ToolSelector) Rank(ctx context.Context, query string) ([]ScoredFunction, error) {
+	vectors, err := ts.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	scored := make([]ScoredFunction, len(ts.names))
+	for i, name := range ts.names {
+		scored[i] = ScoredFunction{Name: name, Score: cosineSimilarity(vectors[0], ts.vectors[i])}
+	}
+	sort.SliceStable(scored, func(a, b int) bool {
+		return scored[a].Score > scored[b].Score
+	})
+	return scored, nil
+}
+
+// Return a new function set with the same name, containing the k functions most relevant
+// to the query. If k is zero or covers every function, the whole set is returned.
+func (ts *ToolSelector) Select(ctx context.Context, query string, k int) (*FunctionSet, error) {
+	return ts.SelectFiltered(ctx, query, k, nil)
+}
+
+// Like Select, but only functions for which keep returns true are considered. A nil keep
+// considers every function. If k is zero or covers every kept function, all of them are
+// returned.
+func (ts *ToolSelector) SelectFiltered(ctx context.Context, query string, k int,
+	keep func(name string) bool) (*FunctionSet, error) {
+	if keep == nil && (k <= 0 || k >= len(ts.names)) {
+		return ts.functions, nil
+	}
+
+	var scored []ScoredFunction
+	if k > 0 {
+		ranked, err := ts.Rank(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		scored = ranked
+	} else {
+		for _, name := range ts.names {
+			scored = append(scored, ScoredFunction{Name: name})
+		}
+	}
+
+	selected := NewFunctionSet(ts.functions.Name)
+	selected.middleware = ts.functions.middleware
+	for _, s := range scored {
+		if k > 0 && len(selected.Functions) >= k {
+			break
+		}
+		if keep == nil || keep(s.Name) {
+			selected.Functions[s.Name] = ts.functions.Functions[s.Name]
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,93 @@
+package bricks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+)
+
+func newSelectorFunctions() *bricks.FunctionSet {
+	fs := bricks.NewFunctionSet("test")
+	handler := func(c bricks.FunctionContext) (any, error) { return nil, nil }
+	fs.AddFunction("query_assets", "Run a SQL query against the asset inventory: domains, IPs and services.",
+		"Use the assets table. Filter domains with type = 'domain'.", EchoRequest{}, handler)
+	fs.AddFunction("get_latest_emerging_threats", "List the latest emerging threats and CVEs.",
+		"", EchoRequest{}, handler)
+	fs.AddFunction("get_weather", "Get the weather forecast for a city.", "", EchoRequest{}, handler)
+	fs.AddFunction("get_assets_overview_link", "Get a link to the assets overview page in the UI.",
+		"", EchoRequest{}, handler)
+	return fs
+}
+
+func TestToolSelectorPicksRelevantFunctions(t *testing.T) {
+	ctx := context.Background()
+	selector, err := bricks.NewToolSelector(ctx, nil, newSelectorFunctions())
+	if err != nil {
+		t.Fatalf("failed to create selector: %v", err)
+	}
+
+	cases := map[string]string{
+		"How many domains do I have?":              "query_assets",
+		"Are there any new emerging threats?":      "get_latest_emerging_threats",
+		"What's the weather forecast in Portland?": "get_weather",
+	}
+	for query, want := range cases {
+		fs, err := selector.Select(ctx, query, 1)
+		if err != nil {
+			t.Fatalf("select failed: %v", err)
+		}
+		if _, ok := fs.Functions[want]; !ok || len(fs.Functions) != 1 {
+			t.Errorf("%q: expected %s, got %v", query, want, fs.Functions)
+		}
+		if fs.Name != "test" {
+			t.Errorf("expected the set name to be kept, got %q", fs.Name)
+		}
+	}
+
+	// Zero or a k covering everything returns the whole set.
+	for _, k := range []int{0, 4, 10} {
+		fs, _ := selector.Select(ctx, "anything", k)
+		if len(fs.Functions) != 4 {
+			t.Errorf("k=%d: expected every function, got %d", k, len(fs.Functions))
+		}
+	}
+}
+
+func TestToolSelectorSelectFiltered(t *testing.T) {
+	ctx := context.Background()
+	selector, err := bricks.NewToolSelector(ctx, nil, newSelectorFunctions())
+	if err != nil {
+		t.Fatalf("failed to create selector: %v", err)
+	}
+	noWeather := func(name string) bool { return name != "get_weather" }
+
+	// The most relevant function is excluded, so the next best is picked.
+	fs, err := selector.SelectFiltered(ctx, "What's the weather forecast in Portland?", 1, noWeather)
+	if err != nil {
+		t.Fatalf("select failed: %v", err)
+	}
+	if _, ok := fs.Functions["get_weather"]; ok || len(fs.Functions) != 1 {
+		t.Errorf("expected one function other than get_weather, got %v", fs.Functions)
+	}
+
+	// With k zero, every kept function is returned.
+	fs, _ = selector.SelectFiltered(ctx, "anything", 0, noWeather)
+	if _, ok := fs.Functions["get_weather"]; ok || len(fs.Functions) != 3 {
+		t.Errorf("expected the three other functions, got %v", fs.Functions)
+	}
+}
+
+func TestHashedTFIDFEmbedderIsDeterministic(t *testing.T) {
+	embedder := bricks.NewHashedTFIDFEmbedder([]string{"asset domains", "threats"}, 64)
+	a, _ := embedder.Embed(context.Background(), []string{"Show my domains"})
+	b, _ := embedder.Embed(context.Background(), []string{"Show my domains"})
+	if len(a[0]) != 64 {
+		t.Fatalf("expected 64 dimensions, got %d", len(a[0]))
+	}
+	for i := range a[0] {
+		if a[0][i] != b[0][i] {
+			t.Fatalf("expected identical vectors, differ at %d", i)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package bricks
+
+import "strings"
+
+// Token usage for one or more model invocations. An agent query usually invokes the model
+// several times, e.g., once per tool round, and the usage is summed across them.
+type Usage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+	// How many model invocations the usage covers.
+	Invocations int `json:"invocations"`
+	// Input tokens of the largest single invocation. Unlike InputTokens, which adds up
+	// every invocation of a tool loop, this is roughly the size of the context the model
+	// was given.
+	MaxInputTokens int64 `json:"max_input_tokens"`
+}
+
+// Add another usage to this one. MaxInputTokens is the larger of the two.
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.Invocations += other.Invocations
+	u.MaxInputTokens = max(u.MaxInputTokens, other.MaxInputTokens)
+}
+
+// Add one model invocation with the given token counts.
+func (u *Usage) addInvocation(inputTokens int64, outputTokens int64) {
+	u.Add(Usage{
+		InputTokens:    inputTokens,
+		OutputTokens:   outputTokens,
+		Invocations:    1,
+		MaxInputTokens: inputTokens,
+	})
+}
+
+// Price of a model in USD per million tokens.
+type ModelPrice struct {
+	InputPerMTok  float64
+	OutputPerMTok float64
+}
+
+// Known model prices, keyed by model ID. Bedrock cross-region inference profile prefixes
+// like "us." are stripped before lookup, so only the base model ID is needed here.
+//
+// These are on-demand list prices and will drift. They're for estimates in logs and
+// responses, not billing.
+var ModelPricing = map[string]ModelPrice{
+	// Bedrock
+	"anthropic.claude-3-5-haiku-20241022-v1:0":  {InputPerMTok: 0.80, OutputPerMTok: 4},
+	"anthropic.claude-3-7-sonnet-20250219-v1:0": {InputPerMTok: 3, OutputPerMTok: 15},
+	"anthropic.claude-sonnet-4-20250514-v1:0":   {InputPerMTok: 3, OutputPerMTok: 15},
+	"anthropic.claude-sonnet-4-5-20250929-v1:0": {InputPerMTok: 3, OutputPerMTok: 15},
+	"anthropic.claude-haiku-4-5-20251001-v1:0":  {InputPerMTok: 1, OutputPerMTok: 5},
+	"anthropic.claude-opus-4-1-20250805-v1:0":   {InputPerMTok: 15, OutputPerMTok: 75},
+	"amazon.nova-micro-v1:0":                    {InputPerMTok: 0.035, OutputPerMTok: 0.14},
+	"amazon.nova-lite-v1:0":                     {InputPerMTok: 0.06, OutputPerMTok: 0.24},
+	"amazon.nova-pro-v1:0":                      {InputPerMTok: 0.80, OutputPerMTok: 3.20},
+
+	// Anthropic API
+	"claude-sonnet-4-5": {InputPerMTok: 3, OutputPerMTok: 15},
+	"claude-sonnet-4-0": {InputPerMTok: 3, OutputPerMTok: 15},
+	"claude-haiku-4-5":  {InputPerMTok: 1, OutputPerMTok: 5},
+	"claude-opus-4-1":   {InputPerMTok: 15, OutputPerMTok: 75},
+}
+
+// Bedrock cross-region inference profile prefixes.
+var inferenceProfilePrefixes = []string{"us.", "eu.", "apac.", "global."}
+
+// Look up the price of a model. Returns false if the model isn't in ModelPricing.
+func LookupModelPrice(model string) (ModelPrice, bool) {
+	if price, ok := ModelPricing[model]; ok {
+		return price, true
+	}
+	for _, prefix := range inferenceProfilePrefixes {
+		if base, ok := strings.CutPrefix(model, prefix); ok {
+			price, ok := ModelPricing[base]
+			return price, ok
+		}
+	}
+	return ModelPrice{}, false
+}
+
+// Estimate the cost of the usage in USD for the given model. Returns false if the model's
+// price is unknown.
+func (u Usage) EstimateCost(model string) (float64, bool) {
+	price, ok := LookupModelPrice(model)
+	if !ok {
+		return 0, false
+	}
+	cost := float64(u.InputTokens)*price.InputPerMTok/1e6 +
+		float64(u.OutputTokens)*price.OutputPerMTok/1e6
+	return cost, true
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/bitovi/bishopfox-mcp-prototype/internal/service"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
 	"github.com/mark3labs/mcp-go/server"
 
 	"github.com/gin-gonic/gin"
@@ -15,6 +19,12 @@ func setupRouter(svc service.Service, mcpServer *server.StreamableHTTPServer) *g
 	r := gin.Default()
 
 	r.POST("/ask", AskHandler(svc))
+	r.GET("/sessions/:id", SessionHandler(svc))
+
+	// Debug endpoints show prompts and other internals, so they're off unless enabled.
+	if os.Getenv("ENABLE_DEBUG_ENDPOINTS") == "true" {
+		r.GET("/debug/prompt", DebugPromptHandler(svc))
+	}
 
 	// A separate server created from mcp-go handles the /mcp endpoint. Forward requests
 	// from that endpoint to there.
@@ -41,6 +51,12 @@ func AskHandler(svc service.Service) gin.HandlerFunc {
 			Query     string `json:"query"`
 			OrgID     string `form:"organization_id"`
 			SessionID string `form:"session_id"`
+			// Agent profile to use instead of the org's default.
+			Profile string `form:"profile"`
+			// Return a structured answer with the referenced assets and follow-ups.
+			Structured bool `form:"structured"`
+			// Include the functions the agent called in the response, for debugging.
+			IncludeTrace bool `form:"include_trace"`
 		}
 		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(400, gin.H{"error": "Invalid request"})
@@ -62,7 +78,26 @@ func AskHandler(svc service.Service) gin.HandlerFunc {
 			}
 		}
 
-		response, err := svc.Ask(c.Request.Context(), req.Query, orgID, auth, req.SessionID)
+		if strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+			streamAsk(c, svc, req.Query, orgID, auth, req.SessionID, service.AskOptions{
+				Profile:    req.Profile,
+				Structured: req.Structured,
+			}, req.IncludeTrace)
+			return
+		}
+
+		response, err := svc.Ask(c.Request.Context(), req.Query, orgID, auth, req.SessionID, service.AskOptions{
+			Profile:    req.Profile,
+			Structured: req.Structured,
+		})
+		if errors.Is(err, service.ErrSessionForbidden) {
+			c.JSON(403, gin.H{"error": sessionForbiddenMessage})
+			return
+		}
+		if errors.Is(err, service.ErrUnknownProfile) {
+			c.JSON(400, gin.H{"error": unknownProfileMessage})
+			return
+		}
 		if err != nil {
 			fmt.Println(err)
 			c.JSON(500, gin.H{"error": "Failed to process request; the issue has been logged"})
@@ -71,10 +106,157 @@ func AskHandler(svc service.Service) gin.HandlerFunc {
 
 		log.Debugln("/ask response:", response)
 
-		c.JSON(200, gin.H{
-			"session_id": response.SessionID,
-			"data":       response.Response,
-			"refs":       response.Refs,
-		})
+		c.JSON(200, askResponseBody(response, req.IncludeTrace))
+	}
+}
+
+// The /sessions/:id function shows how big an /ask session has grown and, once it has
+// been compacted, its digest and pinned asset IDs. Only the org and user that started the
+// session can see it.
+func SessionHandler(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			OrgID string `form:"organization_id"`
+		}
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		orgID, err := uuid.Parse(req.OrgID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "organization_id must be a valid UUID"})
+			return
+		}
+		sessionID := c.Param("id")
+		if _, err := uuid.Parse(sessionID); err != nil {
+			c.JSON(400, gin.H{"error": "session ID must be a valid UUID"})
+			return
+		}
+
+		info, err := svc.GetSession(c.Request.Context(), orgID, c.GetHeader("Authorization"), sessionID)
+		if errors.Is(err, service.ErrSessionNotFound) {
+			c.JSON(404, gin.H{"error": "session not found"})
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			c.JSON(500, gin.H{"error": "Failed to process request; the issue has been logged"})
+			return
+		}
+		c.JSON(200, info)
+	}
+}
+
+// The /debug/prompt function shows the prompt /ask would use for a question: the profile,
+// the functions that would be offered and the composed instruction. The agent isn't
+// called.
+func DebugPromptHandler(svc service.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			OrgID   string `form:"organization_id"`
+			Query   string `form:"query"`
+			Profile string `form:"profile"`
+		}
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request"})
+			return
+		}
+		orgID, err := uuid.Parse(req.OrgID)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "organization_id must be a valid UUID"})
+			return
+		}
+
+		prompt, err := svc.DebugPrompt(c.Request.Context(), req.Query, orgID, req.Profile)
+		if errors.Is(err, service.ErrUnknownProfile) {
+			c.JSON(400, gin.H{"error": unknownProfileMessage})
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			c.JSON(500, gin.H{"error": "Failed to process request; the issue has been logged"})
+			return
+		}
+		c.JSON(200, prompt)
+	}
+}
+
+// Returned when the session_id was started by a different organization or user. Tokens
+// without a subject can't continue any claimed session. It doesn't say which, so session
+// IDs can't be probed.
+const sessionForbiddenMessage = "session_id is not available; start a new session"
+
+const unknownProfileMessage = "profile does not exist"
+
+// The JSON body for an /ask response. The tool call trace can include raw SQL and query
+// results, so it's only included when asked for.
+func askResponseBody(response service.AskResult, includeTrace bool) gin.H {
+	body := gin.H{
+		"session_id": response.SessionID,
+		"data":       response.Response,
+		"refs":       response.Refs,
+		"references": response.References,
+		"usage":      response.Usage,
+		"state":      response.State,
+	}
+	if response.Structured != nil {
+		body["structured"] = response.Structured
+	}
+	if includeTrace {
+		toolCalls := response.ToolCalls
+		if toolCalls == nil {
+			toolCalls = []bricks.ToolCall{}
+		}
+		body["tool_calls"] = toolCalls
 	}
+	return body
+}
+
+// Server-Sent Events variant of /ask, used when the client sends
+// "Accept: text/event-stream". Answer text, tool activity and references are forwarded as
+// they arrive so the user isn't staring at a spinner while the agent works.
+//
+// Events:
+//   - text: {"type":"text","text":"..."} answer text delta. Not sent in structured mode.
+//   - tool_start/tool_end: {"type":"tool_start","function":"query_assets"}
+//   - reference: {"type":"reference","text":"Title - URL","ref":{"type":"...","key":"...","data":{...}}}
+//     text is left out for references without a URL.
+//   - done: the same payload as the non-streaming response, including tool_calls when
+//     include_trace is set.
+//   - error: {"error":"..."}
+func streamAsk(c *gin.Context, svc service.Service, query string, orgID uuid.UUID,
+	auth string, sessionID string, opts service.AskOptions, includeTrace bool) {
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(200)
+
+	// The agents deliver events one at a time, so writes to the response don't overlap.
+	send := func(event string, data any) {
+		c.SSEvent(event, data)
+		c.Writer.Flush()
+	}
+
+	opts.OnEvent = func(ev bricks.StreamEvent) {
+		send(ev.Type, ev)
+	}
+	response, err := svc.Ask(c.Request.Context(), query, orgID, auth, sessionID, opts)
+	if errors.Is(err, service.ErrSessionForbidden) {
+		send("error", gin.H{"error": sessionForbiddenMessage})
+		return
+	}
+	if errors.Is(err, service.ErrUnknownProfile) {
+		send("error", gin.H{"error": unknownProfileMessage})
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		send("error", gin.H{"error": "Failed to process request; the issue has been logged"})
+		return
+	}
+
+	log.Debugln("/ask response:", response)
+
+	send("done", askResponseBody(response, includeTrace))
 }
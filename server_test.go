@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bitovi/bishopfox-mcp-prototype/internal/service"
+	"github.com/bitovi/bishopfox-mcp-prototype/pkg/bricks"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Answers /ask with scripted events and a scripted result. The other Service methods
+// aren't used by these tests.
+type askStandIn struct {
+	service.Service
+	events []bricks.StreamEvent
+	result service.AskResult
+	err    error
+}
+
+func (s *askStandIn) Ask(ctx context.Context, query string, orgID uuid.UUID, authorization string,
+	sessionID string, opts service.AskOptions) (service.AskResult, error) {
+	for _, ev := range s.events {
+		opts.OnEvent(ev)
+	}
+	return s.result, s.err
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// POST /ask with Accept: text/event-stream and parse the events from the response.
+func streamAskRequest(t *testing.T, svc service.Service) []sseEvent {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := setupRouter(svc, nil)
+
+	req := httptest.NewRequest(http.MethodPost,
+		"/ask?organization_id=11111111-1111-1111-1111-111111111111&include_trace=true",
+		strings.NewReader(`{"query":"what changed?"}`))
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n") {
+		var ev sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			if name, ok := strings.CutPrefix(line, "event:"); ok {
+				ev.name = name
+			} else if data, ok := strings.CutPrefix(line, "data:"); ok {
+				ev.data = data
+			}
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestStreamAsk(t *testing.T) {
+	ref := bricks.Reference{Type: "asset", Key: "a1", Data: map[string]string{"id": "a1"}}
+	svc := &askStandIn{
+		events: []bricks.StreamEvent{
+			{Type: bricks.StreamEventToolStart, Function: "query_assets"},
+			{Type: bricks.StreamEventToolEnd, Function: "query_assets"},
+			{Type: bricks.StreamEventReference, Text: "Asset a1", Ref: &ref},
+			{Type: bricks.StreamEventText, Text: "Two hosts."},
+		},
+		result: service.AskResult{
+			SessionID: "22222222-2222-2222-2222-222222222222",
+			Response:  "Two hosts.",
+			Refs:      []string{"Asset a1"},
+		},
+	}
+
+	events := streamAskRequest(t, svc)
+	var names []string
+	for _, ev := range events {
+		names = append(names, ev.name)
+	}
+	if strings.Join(names, ",") != "tool_start,tool_end,reference,text,done" {
+		t.Fatalf("unexpected events %v", names)
+	}
+
+	var reference bricks.StreamEvent
+	if err := json.Unmarshal([]byte(events[2].data), &reference); err != nil {
+		t.Fatalf("bad reference event %q: %v", events[2].data, err)
+	}
+	if reference.Text != "Asset a1" || reference.Ref == nil || reference.Ref.Key != "a1" {
+		t.Errorf("unexpected reference event %+v", reference)
+	}
+
+	// The done event has the same payload as the non-streaming response.
+	var done map[string]any
+	if err := json.Unmarshal([]byte(events[4].data), &done); err != nil {
+		t.Fatalf("bad done event %q: %v", events[4].data, err)
+	}
+	if done["session_id"] != "22222222-2222-2222-2222-222222222222" || done["data"] != "Two hosts." {
+		t.Errorf("unexpected done payload %v", done)
+	}
+	if _, ok := done["tool_calls"]; !ok {
+		t.Errorf("expected tool_calls in the done payload with include_trace, got %v", done)
+	}
+}
+
+func TestStreamAskSessionForbidden(t *testing.T) {
+	svc := &askStandIn{err: service.ErrSessionForbidden}
+
+	events := streamAskRequest(t, svc)
+	if len(events) != 1 || events[0].name != "error" {
+		t.Fatalf("expected a single error event, got %v", events)
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(events[0].data), &body); err != nil {
+		t.Fatalf("bad error event %q: %v", events[0].data, err)
+	}
+	if body["error"] != sessionForbiddenMessage {
+		t.Errorf("unexpected error %q", body["error"])
+	}
+}